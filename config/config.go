@@ -4,32 +4,48 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/rakyll/globalconf"
 )
 
 type config struct {
-	CAdvisorUrl     string
-	DockerUrl       string
-	Systemd         bool
-	NumStats        int
-	Auth            bool
-	HaProxyMonitor  bool
-	Key             string
-	HostUuid        string
-	Port            int
-	Ip              string
-	ParsedPublicKey interface{}
-	HostUuidCheck   bool
-	EventsPoolSize  int
-	CattleUrl       string
-	CattleAccessKey string
-	CattleSecretKey string
-	PidFile         string
-	LogFile         string
+	CAdvisorUrl       string
+	CAdvisorApi       string
+	DockerUrl         string
+	Systemd           bool
+	NumStats          int
+	StatsHistory      int
+	Auth              bool
+	HaProxyMonitor    bool
+	Key               string
+	HostUuid          string
+	Port              int
+	Ip                string
+	ParsedPublicKey   interface{}
+	HostUuidCheck     bool
+	EventsPoolSize    int
+	CattleUrl         string
+	CattleAccessKey   string
+	CattleSecretKey   string
+	PidFile           string
+	LogFile           string
+	LogsFromFile      bool
+	StatsMinInterval  time.Duration
+	StatsMaxInterval  time.Duration
+	StatsBackend      string
+	StatsFsInterval   time.Duration
+	StatsNetwork      string
+	AlertRules        string
+	StatsSink         string
+	StatsSinkUrl      string
+	StatsSinkInterval time.Duration
+	Metrics           bool
+	MetricsListen     string
 }
 
 var Config config
@@ -57,8 +73,10 @@ func Parse() error {
 	flag.IntVar(&Config.Port, "port", 8080, "Listen port")
 	flag.StringVar(&Config.Ip, "ip", "", "Listen IP, defaults to all IPs")
 	flag.StringVar(&Config.CAdvisorUrl, "cadvisor-url", "http://localhost:8081", "cAdvisor URL")
+	flag.StringVar(&Config.CAdvisorApi, "cadvisor-api", "v2.0", "cAdvisor API version to read stats with, v1.3 or v2.0")
 	flag.StringVar(&Config.DockerUrl, "docker-host", "unix:///var/run/docker.sock", "Docker host URL")
-	flag.IntVar(&Config.NumStats, "num-stats", 600, "Number of stats to show by default")
+	flag.IntVar(&Config.NumStats, "num-stats", 600, "Number of recent stats samples to keep for the host and each container while their stats are streamed")
+	flag.IntVar(&Config.StatsHistory, "stats-history", 50, "Number of running containers whose stats are streamed all the time, along with the host's, so that their recent samples are there before anyone asks for them, 0 for the host only")
 	flag.BoolVar(&Config.Auth, "auth", false, "Authenticate requests")
 	flag.StringVar(&Config.HostUuid, "host-uuid", "", "Host UUID")
 	flag.BoolVar(&Config.HostUuidCheck, "host-uuid-check", true, "Validate host UUID")
@@ -69,6 +87,18 @@ func Parse() error {
 	flag.StringVar(&Config.CattleSecretKey, "cattle-secret-key", "", "Secret key for cattle api")
 	flag.StringVar(&Config.PidFile, "pid-file", "", "PID file")
 	flag.StringVar(&Config.LogFile, "log", "", "Log file")
+	flag.DurationVar(&Config.StatsMinInterval, "stats-min-interval", time.Second, "Shortest stats sampling interval a request can ask for")
+	flag.DurationVar(&Config.StatsMaxInterval, "stats-max-interval", time.Minute, "Longest stats sampling interval a request can ask for")
+	flag.StringVar(&Config.StatsBackend, "stats-backend", "docker", "Where stats are read from: docker for the docker API, cgroup to read cgroup files directly, falling back to docker, or cadvisor for the cAdvisor at cadvisor-url")
+	flag.DurationVar(&Config.StatsFsInterval, "stats-fs-interval", time.Minute, "How often container writable layer and volume usage is collected, 0 to turn it off")
+	flag.StringVar(&Config.StatsNetwork, "stats-network", "proc", "How container network stats are read: proc for /proc/<pid>/net, or netlink to list interfaces in the container's namespace")
+	flag.StringVar(&Config.AlertRules, "alert-rules", "", "Alert rules for every container, such as memory_percent>90:60s,cpu_throttled_percent>50,restarts>3:10m")
+	flag.StringVar(&Config.StatsSink, "stats-sink", "", "Export host and container metrics to statsd, dogstatsd or influxdb")
+	flag.StringVar(&Config.StatsSinkUrl, "stats-sink-url", "udp://localhost:8125", "Where to export metrics: udp://host:port for StatsD, or http://host:8086/write?db=name or udp://host:port for InfluxDB")
+	flag.DurationVar(&Config.StatsSinkInterval, "stats-sink-interval", 10*time.Second, "How often metrics are exported")
+	flag.BoolVar(&Config.Metrics, "metrics", false, "Serve Prometheus metrics at /metrics on the metrics listen address")
+	flag.StringVar(&Config.MetricsListen, "metrics-listen", "127.0.0.1:9106", "Address to serve Prometheus metrics on, loopback only by default since the endpoint isn't authenticated")
+	flag.BoolVar(&Config.LogsFromFile, "logs-from-file", false, "Read json-file driver logs directly from disk instead of the docker API")
 
 	confOptions := &globalconf.Options{
 		EnvPrefix: "HOST_API_",
@@ -87,6 +117,13 @@ func Parse() error {
 
 	conf.ParseAll()
 
+	if Config.StatsMinInterval <= 0 {
+		return fmt.Errorf("Invalid stats-min-interval %s, it has to be positive", Config.StatsMinInterval)
+	}
+	if Config.StatsMaxInterval > 0 && Config.StatsMaxInterval < Config.StatsMinInterval {
+		return fmt.Errorf("Invalid stats-max-interval %s, it's less than stats-min-interval", Config.StatsMaxInterval)
+	}
+
 	if len(Config.Key) > 0 {
 		if err := ParsedPublicKey(); err != nil {
 			glog.Error("Error reading file")
@@ -0,0 +1,348 @@
+package logs
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/rancher/websocket-proxy/common"
+)
+
+const (
+	archiveTarGz    = "tar.gz"
+	archiveNdjsonGz = "ndjson.gz"
+
+	downloadChunkSize        = 32 * 1024
+	downloadProgressInterval = time.Second
+	// Most bytes of logs spooled to disk for a tar.gz archive.
+	maxArchiveSpoolSize = 1 << 30
+)
+
+var errArchiveTooLarge = fmt.Errorf("Logs are larger than %d bytes, too large for a tar.gz archive", maxArchiveSpoolSize)
+
+// downloadMessage is sent for every chunk of the archive, periodically with
+// progress, and once at the end with the checksum of the whole archive.
+type downloadMessage struct {
+	Type   string `json:"type"`
+	Data   string `json:"data,omitempty"`
+	Lines  int64  `json:"lines,omitempty"`
+	Bytes  int64  `json:"bytes,omitempty"`
+	Sha256 string `json:"sha256,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// downloadOptions come from the Download, Archive, Since and Until claims, or
+// the download, archive, since and until URL parameters.
+type downloadOptions struct {
+	archive string
+	since   time.Time
+	until   time.Time
+}
+
+func isDownload(logs map[string]interface{}, query url.Values) bool {
+	download, _ := logs["Download"].(bool)
+	return download || query.Get("download") == "true"
+}
+
+func getDownloadOptions(logs map[string]interface{}, query url.Values) (*downloadOptions, error) {
+	opts := &downloadOptions{archive: archiveTarGz}
+
+	if archive, ok := logs["Archive"].(string); ok && archive != "" {
+		opts.archive = archive
+	}
+	if archive := query.Get("archive"); archive != "" {
+		opts.archive = archive
+	}
+	if opts.archive != archiveTarGz && opts.archive != archiveNdjsonGz {
+		return nil, fmt.Errorf("Invalid archive format %s", opts.archive)
+	}
+
+	var err error
+	if opts.since, err = getTime(logs["Since"], query.Get("since")); err != nil {
+		return nil, err
+	}
+	if opts.until, err = getTime(logs["Until"], query.Get("until")); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// getTime parses a time given as RFC3339 or as seconds since the epoch.
+func getTime(claim interface{}, param string) (time.Time, error) {
+	switch val := claim.(type) {
+	case float64:
+		return time.Unix(int64(val), 0), nil
+	case string:
+		if param == "" {
+			param = val
+		}
+	}
+	if param == "" {
+		return time.Time{}, nil
+	}
+	if seconds, err := strconv.ParseInt(param, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339Nano, param)
+}
+
+// download sends the whole log history of the containers named in the logs
+// claim as a compressed archive, base64 encoded in chunks.
+func (l *LogsHandler) download(key string, logs map[string]interface{}, filter *lineFilter, opts *downloadOptions, incomingMessages <-chan string, response chan<- common.Message) {
+	m, err := newLogSession(logs)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Couldn't get docker client.")
+		return
+	}
+	m.follow = false
+	m.tail = "all"
+	m.since = opts.since
+	m.until = opts.until
+
+	defer m.stop()
+	go m.stopOnClose(incomingMessages)
+
+	writer := newDownloadWriter(key, response)
+
+	if err := m.start(logs); err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Couldn't start reading logs.")
+		writer.fail(err)
+		return
+	}
+
+	sendArchive(m, filter, opts.archive, writer)
+}
+
+// sendArchive writes the archive and ends the download with either the
+// checksum or the error that cut it short. Writers stop the session when they
+// fail, so the session being done only means the client went away when there
+// was no error.
+func sendArchive(m *logSession, filter *lineFilter, archive string, writer *downloadWriter) {
+	var err error
+	switch archive {
+	case archiveNdjsonGz:
+		err = writeNdjsonGz(m, filter, writer)
+	default:
+		err = writeTarGz(m, filter, writer, maxArchiveSpoolSize)
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Error writing log archive.")
+		writer.fail(err)
+		return
+	}
+
+	select {
+	case <-m.done:
+		return
+	default:
+	}
+	writer.finish()
+}
+
+func writeNdjsonGz(m *logSession, filter *lineFilter, writer *downloadWriter) error {
+	gz := gzip.NewWriter(writer)
+	var err error
+	m.merge(func(line *logLine) {
+		if err != nil {
+			return
+		}
+		if matched, _ := filter.match(line); !matched {
+			return
+		}
+		writer.lines++
+		if _, err = io.WriteString(gz, jsonFrame(line, true, nil)+"\n"); err != nil {
+			m.stop()
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// writeTarGz writes a file per container. The size of each file has to be
+// known up front, so lines are spooled to temporary files first, up to limit
+// bytes in all. The files are removed as soon as they're created, so they're
+// gone however this returns.
+func writeTarGz(m *logSession, filter *lineFilter, writer *downloadWriter, limit int64) error {
+	spools := map[string]*os.File{}
+	names := map[string]string{}
+	defer func() {
+		for _, spool := range spools {
+			spool.Close()
+		}
+	}()
+
+	var err error
+	spooled := int64(0)
+	m.merge(func(line *logLine) {
+		if err != nil {
+			return
+		}
+		if matched, _ := filter.match(line); !matched {
+			return
+		}
+		spool, ok := spools[line.Container]
+		if !ok {
+			if spool, err = ioutil.TempFile("", "logs-"); err != nil {
+				m.stop()
+				return
+			}
+			os.Remove(spool.Name())
+			spools[line.Container] = spool
+			names[line.Container] = line.Name
+		}
+		if spooled += int64(len(line.Raw)); spooled > limit {
+			err = errArchiveTooLarge
+			m.stop()
+			return
+		}
+		writer.lines++
+		if _, err = spool.Write(line.Raw); err != nil {
+			m.stop()
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	ids := []string{}
+	for id := range spools {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	gz := gzip.NewWriter(writer)
+	tw := tar.NewWriter(gz)
+	for _, id := range ids {
+		spool := spools[id]
+		info, err := spool.Stat()
+		if err != nil {
+			return err
+		}
+		if _, err := spool.Seek(0, 0); err != nil {
+			return err
+		}
+		header := &tar.Header{
+			Name:    archiveFileName(id, names[id]),
+			Mode:    0644,
+			Size:    info.Size(),
+			ModTime: time.Now(),
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, bufio.NewReader(spool)); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func archiveFileName(id, name string) string {
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	if name == "" || name == id {
+		return id + ".log"
+	}
+	return name + "-" + id + ".log"
+}
+
+// downloadWriter sends what's written to it as base64 encoded chunks, along
+// with progress updates, and keeps a running checksum.
+type downloadWriter struct {
+	key          string
+	response     chan<- common.Message
+	buffer       []byte
+	hash         hash.Hash
+	bytes        int64
+	lines        int64
+	lastProgress time.Time
+}
+
+func newDownloadWriter(key string, response chan<- common.Message) *downloadWriter {
+	return &downloadWriter{
+		key:          key,
+		response:     response,
+		hash:         sha256.New(),
+		lastProgress: time.Now(),
+	}
+}
+
+func (w *downloadWriter) Write(data []byte) (int, error) {
+	w.hash.Write(data)
+	w.bytes += int64(len(data))
+	w.buffer = append(w.buffer, data...)
+	for len(w.buffer) >= downloadChunkSize {
+		w.sendChunk(w.buffer[:downloadChunkSize])
+		w.buffer = w.buffer[downloadChunkSize:]
+	}
+	return len(data), nil
+}
+
+func (w *downloadWriter) sendChunk(data []byte) {
+	w.send(downloadMessage{
+		Type: "chunk",
+		Data: base64.StdEncoding.EncodeToString(data),
+	})
+	if time.Since(w.lastProgress) >= downloadProgressInterval {
+		w.lastProgress = time.Now()
+		w.send(downloadMessage{
+			Type:  "progress",
+			Lines: w.lines,
+			Bytes: w.bytes,
+		})
+	}
+}
+
+func (w *downloadWriter) finish() {
+	if len(w.buffer) > 0 {
+		w.sendChunk(w.buffer)
+		w.buffer = nil
+	}
+	w.send(downloadMessage{
+		Type:   "done",
+		Lines:  w.lines,
+		Bytes:  w.bytes,
+		Sha256: hex.EncodeToString(w.hash.Sum(nil)),
+	})
+}
+
+func (w *downloadWriter) fail(err error) {
+	w.send(downloadMessage{
+		Type:  "error",
+		Error: err.Error(),
+	})
+}
+
+func (w *downloadWriter) send(message downloadMessage) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+	w.response <- common.Message{
+		Key:  w.key,
+		Type: common.Body,
+		Body: string(data),
+	}
+}
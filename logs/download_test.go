@@ -0,0 +1,190 @@
+package logs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rancher/websocket-proxy/common"
+)
+
+func readDownload(t *testing.T, response chan common.Message) ([]byte, downloadMessage) {
+	close(response)
+	received := []byte{}
+	var done downloadMessage
+	for message := range response {
+		decoded := downloadMessage{}
+		if err := json.Unmarshal([]byte(message.Body), &decoded); err != nil {
+			t.Fatal(err)
+		}
+		switch decoded.Type {
+		case "chunk":
+			chunk, err := base64.StdEncoding.DecodeString(decoded.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			received = append(received, chunk...)
+		case "done":
+			done = decoded
+		}
+	}
+	return received, done
+}
+
+func TestDownloadWriter(t *testing.T) {
+	response := make(chan common.Message, 100)
+	w := newDownloadWriter("key", response)
+
+	data := bytes.Repeat([]byte("0123456789"), downloadChunkSize/5)
+	w.Write(data[:100])
+	w.Write(data[100:])
+	w.finish()
+
+	received, done := readDownload(t, response)
+	if !bytes.Equal(received, data) {
+		t.Fatalf("Expected %d bytes, got %d", len(data), len(received))
+	}
+	sum := sha256.Sum256(data)
+	if done.Sha256 != hex.EncodeToString(sum[:]) || done.Bytes != int64(len(data)) {
+		t.Fatalf("Unexpected done message: %#v", done)
+	}
+}
+
+func TestWriteTarGz(t *testing.T) {
+	m := &logSession{
+		lines: make(chan *logLine, 10),
+		done:  make(chan struct{}),
+	}
+	for _, raw := range []string{"2016-09-01T10:00:00Z a\n", "2016-09-01T10:00:01Z b\n"} {
+		line := filterLine(streamStdout, raw)
+		line.Container = "0123456789abcdef"
+		line.Name = "web"
+		m.lines <- line
+	}
+	close(m.lines)
+
+	filter, _ := newLineFilter(map[string]interface{}{}, url.Values{})
+	response := make(chan common.Message, 100)
+	w := newDownloadWriter("key", response)
+	if err := writeTarGz(m, filter, w, maxArchiveSpoolSize); err != nil {
+		t.Fatal(err)
+	}
+	w.finish()
+	received, done := readDownload(t, response)
+	if done.Lines != 2 {
+		t.Fatalf("Expected 2 lines, got %d", done.Lines)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(received))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	header, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Name != "web-0123456789ab.log" {
+		t.Fatalf("Unexpected file name %s", header.Name)
+	}
+	content, _ := ioutil.ReadAll(tr)
+	if string(content) != "2016-09-01T10:00:00Z a\n2016-09-01T10:00:01Z b\n" {
+		t.Fatalf("Unexpected content [%s]", content)
+	}
+}
+
+func TestSendArchiveSpoolError(t *testing.T) {
+	tmp := os.Getenv("TMPDIR")
+	defer os.Setenv("TMPDIR", tmp)
+	os.Setenv("TMPDIR", "/nonexistent/logs")
+
+	m := &logSession{
+		lines: make(chan *logLine, 10),
+		done:  make(chan struct{}),
+	}
+	line := filterLine(streamStdout, "2016-09-01T10:00:00Z a\n")
+	line.Container = "0123456789abcdef"
+	m.lines <- line
+	close(m.lines)
+
+	filter, _ := newLineFilter(map[string]interface{}{}, url.Values{})
+	response := make(chan common.Message, 100)
+	sendArchive(m, filter, archiveTarGz, newDownloadWriter("key", response))
+	close(response)
+
+	types := []string{}
+	for message := range response {
+		decoded := downloadMessage{}
+		if err := json.Unmarshal([]byte(message.Body), &decoded); err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, decoded.Type)
+		if decoded.Type == "error" && decoded.Error == "" {
+			t.Fatal("Expected the error to be sent")
+		}
+	}
+	if len(types) != 1 || types[0] != "error" {
+		t.Fatalf("Expected only an error, got %v", types)
+	}
+}
+
+func TestGetDownloadOptions(t *testing.T) {
+	opts, err := getDownloadOptions(map[string]interface{}{"Since": float64(1472724000)},
+		url.Values{"archive": {"ndjson.gz"}, "until": {"2016-09-01T11:00:00Z"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.archive != archiveNdjsonGz || opts.since.Unix() != 1472724000 ||
+		!opts.until.Equal(time.Date(2016, 9, 1, 11, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Unexpected options %#v", opts)
+	}
+
+	if _, err := getDownloadOptions(map[string]interface{}{"Archive": "zip"}, url.Values{}); err == nil || !strings.Contains(err.Error(), "zip") {
+		t.Fatalf("Expected invalid archive error, got %v", err)
+	}
+}
+
+func TestWriteTarGzLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tmp := os.Getenv("TMPDIR")
+	defer os.Setenv("TMPDIR", tmp)
+	os.Setenv("TMPDIR", dir)
+
+	m := &logSession{
+		lines: make(chan *logLine, 10),
+		done:  make(chan struct{}),
+	}
+	for _, message := range []string{"2016-09-01T10:00:00Z a\n", "2016-09-01T10:00:01Z b\n"} {
+		line := filterLine(streamStdout, message)
+		line.Container = "0123456789abcdef"
+		m.lines <- line
+	}
+	close(m.lines)
+
+	filter, _ := newLineFilter(map[string]interface{}{}, url.Values{})
+	response := make(chan common.Message, 100)
+	if err := writeTarGz(m, filter, newDownloadWriter("key", response), 40); err != errArchiveTooLarge {
+		t.Fatalf("Expected the archive to be too large, got %v", err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("Expected the spools to be removed, found %d files", len(files))
+	}
+}
@@ -0,0 +1,111 @@
+package logs
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+)
+
+// lineFilter decides which lines are sent to the client. It can be set in the
+// logs claim with Include, Exclude, Stream and Highlight, or on the URL with
+// include, exclude, stream and highlight.
+type lineFilter struct {
+	include   []*regexp.Regexp
+	exclude   []*regexp.Regexp
+	stream    string
+	highlight bool
+}
+
+func newLineFilter(logs map[string]interface{}, query url.Values) (*lineFilter, error) {
+	filter := &lineFilter{}
+
+	include := append(getStringOrList(logs["Include"]), query["include"]...)
+	exclude := append(getStringOrList(logs["Exclude"]), query["exclude"]...)
+
+	for _, expr := range include {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		filter.include = append(filter.include, re)
+	}
+	for _, expr := range exclude {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		filter.exclude = append(filter.exclude, re)
+	}
+
+	stream, _ := logs["Stream"].(string)
+	if s := query.Get("stream"); s != "" {
+		stream = s
+	}
+	switch stream {
+	case "", "both", "all":
+		filter.stream = streamBoth
+	case streamStdout, streamStderr:
+		filter.stream = stream
+	default:
+		return nil, fmt.Errorf("Invalid stream %s", stream)
+	}
+
+	filter.highlight, _ = logs["Highlight"].(bool)
+	if h := query.Get("highlight"); h == "true" || h == "1" {
+		filter.highlight = true
+	}
+
+	return filter, nil
+}
+
+// match reports whether the line should be sent. If highlighting is enabled it
+// also returns the start and end offsets in the raw line of every include
+// match. Lines from a TTY aren't split into stdout and stderr, so they pass
+// any stream selection.
+func (f *lineFilter) match(line *logLine) (bool, [][]int) {
+	if f.stream != streamBoth && line.Stream != streamBoth && line.Stream != f.stream {
+		return false, nil
+	}
+
+	message := line.Message()
+	for _, re := range f.exclude {
+		if re.Match(message) {
+			return false, nil
+		}
+	}
+
+	if len(f.include) == 0 {
+		return true, nil
+	}
+
+	matched := false
+	var highlights [][]int
+	for _, re := range f.include {
+		if !f.highlight {
+			if re.Match(message) {
+				return true, nil
+			}
+			continue
+		}
+		for _, loc := range re.FindAllIndex(message, -1) {
+			matched = true
+			highlights = append(highlights, []int{loc[0] + line.Offset, loc[1] + line.Offset})
+		}
+	}
+	sort.Sort(byStart(highlights))
+	return matched, highlights
+}
+
+type byStart [][]int
+
+func (b byStart) Len() int           { return len(b) }
+func (b byStart) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byStart) Less(i, j int) bool { return b[i][0] < b[j][0] }
+
+func getStringOrList(param interface{}) []string {
+	if val, ok := param.(string); ok {
+		return []string{val}
+	}
+	return getStringList(param)
+}
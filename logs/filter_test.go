@@ -0,0 +1,70 @@
+package logs
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func filterLine(stream, raw string) *logLine {
+	line := &logLine{Stream: stream, Raw: []byte(raw)}
+	line.Timestamp, line.Offset = parseTimestamp(line.Raw)
+	return line
+}
+
+func TestLineFilter(t *testing.T) {
+	logs := map[string]interface{}{
+		"Include": []interface{}{"error", "warn"},
+		"Exclude": "ignored",
+	}
+	filter, err := newLineFilter(logs, url.Values{"stream": {"stderr"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		line    *logLine
+		matched bool
+	}{
+		{filterLine(streamStderr, "2016-09-01T10:00:00Z an error\n"), true},
+		{filterLine(streamStderr, "2016-09-01T10:00:00Z a warning\n"), true},
+		{filterLine(streamStderr, "2016-09-01T10:00:00Z info\n"), false},
+		{filterLine(streamStderr, "2016-09-01T10:00:00Z ignored error\n"), false},
+		{filterLine(streamStdout, "2016-09-01T10:00:00Z an error\n"), false},
+		{filterLine(streamBoth, "2016-09-01T10:00:00Z tty error\n"), true},
+	}
+	for _, c := range cases {
+		if matched, _ := filter.match(c.line); matched != c.matched {
+			t.Errorf("Expected match %v for [%s]", c.matched, c.line.Raw)
+		}
+	}
+}
+
+func TestLineFilterHighlight(t *testing.T) {
+	filter, err := newLineFilter(map[string]interface{}{"Include": "o+"}, url.Values{"highlight": {"true"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	line := filterLine(streamStdout, "2016-09-01T10:00:00Z foo boo\n")
+	matched, highlights := filter.match(line)
+	if !matched {
+		t.Fatal("Expected line to match")
+	}
+	expected := [][]int{{22, 24}, {26, 28}}
+	if !reflect.DeepEqual(highlights, expected) {
+		t.Fatalf("Expected highlights %v, got %v", expected, highlights)
+	}
+	if frame := legacyFrame(line, false, highlights); frame != "01 {22:24,26:28} 2016-09-01T10:00:00Z foo boo\n" {
+		t.Fatalf("Unexpected frame [%s]", frame)
+	}
+}
+
+func TestLineFilterInvalid(t *testing.T) {
+	if _, err := newLineFilter(map[string]interface{}{}, url.Values{"include": {"("}}); err == nil {
+		t.Fatal("Expected error for invalid regex")
+	}
+	if _, err := newLineFilter(map[string]interface{}{"Stream": "stdin"}, url.Values{}); err == nil {
+		t.Fatal("Expected error for invalid stream")
+	}
+}
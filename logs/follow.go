@@ -0,0 +1,497 @@
+package logs
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+	dockerClient "github.com/fsouza/go-dockerclient"
+	"golang.org/x/net/context"
+
+	"github.com/rancher/websocket-proxy/common"
+
+	"github.com/rancher/host-api/config"
+	"github.com/rancher/host-api/events"
+)
+
+// mergeWindow is how long lines from different containers are buffered so
+// that they can be interleaved by timestamp.
+const mergeWindow = 250 * time.Millisecond
+
+// How long to wait before listening to docker events again after the daemon's
+// event stream ends.
+const watchRetryInterval = 5 * time.Second
+
+// logSession follows the logs of one or more containers: a single container,
+// a fixed list of containers or every container matching a label selector.
+type logSession struct {
+	client *dockerClient.Client
+	// Inspects containers, the docker client doesn't decode their log path.
+	inspector *client.Client
+	tail      string
+	follow    bool
+	multi     bool
+	labels    map[string]string
+	// Only lines after since and up to until are read, if set.
+	since time.Time
+	until time.Time
+	lines chan *logLine
+	done  chan struct{}
+	once  sync.Once
+	wg    sync.WaitGroup
+
+	lock      sync.Mutex
+	following map[string]bool
+	lastSeen  map[string]time.Time
+}
+
+func isMultiLogs(logs map[string]interface{}) bool {
+	if container, ok := logs["Container"].(string); ok && container != "" {
+		return false
+	}
+	_, hasContainers := logs["Containers"]
+	_, hasLabels := logs["Labels"]
+	return hasContainers || hasLabels
+}
+
+func newLogSession(logs map[string]interface{}) (*logSession, error) {
+	client, err := events.NewDockerClient()
+	if err != nil {
+		return nil, err
+	}
+	inspector, err := newInspector()
+	if err != nil {
+		return nil, err
+	}
+
+	follow, found := logs["Follow"].(bool)
+	if !found {
+		follow = true
+	}
+
+	m := &logSession{
+		client:    client,
+		inspector: inspector,
+		tail:      getTail(logs),
+		follow:    follow,
+		multi:     isMultiLogs(logs),
+		lines:     make(chan *logLine, 100),
+		done:      make(chan struct{}),
+		following: map[string]bool{},
+		lastSeen:  map[string]time.Time{},
+	}
+	if m.multi {
+		m.labels = getStringMap(logs["Labels"])
+	}
+	return m, nil
+}
+
+// streamLogs follows the containers named in the logs claim and sends their
+// output line by line. A single Container is sent as is, while lines from
+// multiple containers are interleaved by timestamp and tagged with the
+// container name.
+func (l *LogsHandler) streamLogs(key string, logs map[string]interface{}, filter *lineFilter, frame framer, incomingMessages <-chan string, response chan<- common.Message) {
+	m, err := newLogSession(logs)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Couldn't get docker client.")
+		return
+	}
+	defer m.stop()
+	go m.stopOnClose(incomingMessages)
+
+	if err := m.start(logs); err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Couldn't start following logs.")
+		return
+	}
+
+	m.merge(func(line *logLine) {
+		matched, highlights := filter.match(line)
+		if !matched {
+			return
+		}
+		response <- common.Message{
+			Key:  key,
+			Type: common.Body,
+			Body: frame(line, m.multi, highlights),
+		}
+	})
+}
+
+func (m *logSession) stop() {
+	m.once.Do(func() {
+		close(m.done)
+	})
+}
+
+func (m *logSession) stopOnClose(incomingMessages <-chan string) {
+	for {
+		_, ok := <-incomingMessages
+		if !ok {
+			m.stop()
+			return
+		}
+	}
+}
+
+// start begins following every container named in the logs claim. Unless new
+// containers are being watched for, lines is closed once they're all done.
+func (m *logSession) start(logs map[string]interface{}) error {
+	watching := m.multi && len(m.labels) > 0 && m.follow
+	if watching {
+		if err := m.watch(); err != nil {
+			return err
+		}
+	}
+
+	ids := []string{}
+	if m.multi {
+		ids = getStringList(logs["Containers"])
+		if len(m.labels) > 0 {
+			containers, err := m.list()
+			if err != nil {
+				return err
+			}
+			ids = append(ids, containers...)
+		}
+	} else if container, ok := logs["Container"].(string); ok {
+		ids = append(ids, container)
+	}
+	for _, id := range ids {
+		m.add(id)
+	}
+
+	if !watching {
+		go func() {
+			m.wg.Wait()
+			close(m.lines)
+		}()
+	}
+	return nil
+}
+
+// merge emits lines until the session is done, interleaving them by timestamp
+// when following multiple containers.
+func (m *logSession) merge(emit func(*logLine)) {
+	window := time.Duration(0)
+	if m.multi {
+		window = mergeWindow
+	}
+	mergeLines(m.lines, m.done, window, emit)
+}
+
+func (m *logSession) list() ([]string, error) {
+	filters := []string{}
+	for k, v := range m.labels {
+		if v == "" {
+			filters = append(filters, k)
+		} else {
+			filters = append(filters, k+"="+v)
+		}
+	}
+
+	containers, err := m.client.ListContainers(dockerClient.ListContainersOptions{
+		All:     !m.follow,
+		Filters: map[string][]string{"label": filters},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, c := range containers {
+		ids = append(ids, c.ID)
+	}
+	return ids, nil
+}
+
+func (m *logSession) watch() error {
+	listener := make(chan *dockerClient.APIEvents, 10)
+	if err := m.client.AddEventListener(listener); err != nil {
+		return err
+	}
+
+	go func() {
+		defer func() {
+			m.client.RemoveEventListener(listener)
+		}()
+		for {
+			select {
+			case event, ok := <-listener:
+				if !ok {
+					// The docker client closes listeners when the daemon's
+					// event stream ends, like when it restarts.
+					if listener = m.relisten(); listener == nil {
+						return
+					}
+					continue
+				}
+				if event != nil && event.Status == "start" {
+					m.add(event.ID)
+				}
+			case <-m.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// relisten adds a new events listener once the previous one was closed, and
+// follows the containers that started in the meantime. It returns nil if the
+// session is done first.
+func (m *logSession) relisten() chan *dockerClient.APIEvents {
+	for {
+		select {
+		case <-m.done:
+			return nil
+		case <-time.After(watchRetryInterval):
+		}
+		listener := make(chan *dockerClient.APIEvents, 10)
+		if err := m.client.AddEventListener(listener); err != nil {
+			log.WithFields(log.Fields{"error": err}).Warn("Couldn't listen to docker events.")
+			continue
+		}
+		if ids, err := m.list(); err == nil {
+			for _, id := range ids {
+				m.add(id)
+			}
+		}
+		return listener
+	}
+}
+
+// add starts following a container, unless it's already followed or doesn't
+// match the label selector.
+func (m *logSession) add(id string) {
+	container, err := m.inspector.ContainerInspect(context.Background(), id)
+	if err != nil || container.ContainerJSONBase == nil {
+		log.WithFields(log.Fields{"error": err, "id": id}).Error("Couldn't inspect container.")
+		return
+	}
+	if len(m.labels) > 0 && (container.Config == nil || !matchesLabels(container.Config.Labels, m.labels)) {
+		return
+	}
+
+	m.lock.Lock()
+	if m.following[container.ID] {
+		m.lock.Unlock()
+		return
+	}
+	m.following[container.ID] = true
+	since := m.since
+	if m.lastSeen[container.ID].After(since) {
+		since = m.lastSeen[container.ID]
+	}
+	m.lock.Unlock()
+
+	name := strings.TrimPrefix(container.Name, "/")
+	if name == "" {
+		name = container.ID
+	}
+
+	tty := container.Config != nil && container.Config.Tty
+	logDriver := ""
+	if container.HostConfig != nil {
+		logDriver = container.HostConfig.LogConfig.Type
+	}
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+
+		last, err := m.followFile(container.ID, name, tty, since, container.LogPath, logDriver)
+		if err == errNoLogFile {
+			last = m.followAPI(container.ID, name, tty, since)
+		} else if err != nil && err != errLogsClosed {
+			log.WithFields(log.Fields{"error": err, "id": container.ID}).Error("Error reading container log file.")
+		}
+
+		m.lock.Lock()
+		delete(m.following, container.ID)
+		m.lastSeen[container.ID] = last
+		m.lock.Unlock()
+	}()
+}
+
+// followAPI reads a container's logs through the docker logs API and returns
+// the timestamp of the last line read.
+func (m *logSession) followAPI(id, name string, tty bool, since time.Time) time.Time {
+	logopts := dockerClient.LogsOptions{
+		Container:   id,
+		Follow:      m.follow,
+		Stdout:      true,
+		Stderr:      true,
+		Timestamps:  true,
+		Tail:        m.tail,
+		RawTerminal: tty,
+	}
+	writers := []*lineWriter{}
+	if tty {
+		w := newLineWriter(id, name, streamBoth, m.lines, m.done)
+		logopts.OutputStream = w
+		writers = append(writers, w)
+	} else {
+		stdout := newLineWriter(id, name, streamStdout, m.lines, m.done)
+		stderr := newLineWriter(id, name, streamStderr, m.lines, m.done)
+		logopts.OutputStream = stdout
+		logopts.ErrorStream = stderr
+		writers = append(writers, stdout, stderr)
+	}
+	for _, w := range writers {
+		w.since = since
+		w.until = m.until
+	}
+
+	// Returns an error, but ignoring it because it will always return an error when a streaming call is made.
+	m.client.Logs(logopts)
+
+	last := since
+	for _, w := range writers {
+		w.Flush()
+		if w.Last().After(last) {
+			last = w.Last()
+		}
+	}
+	return last
+}
+
+// followFile reads a container's logs straight from the json-file driver's
+// files, if enabled. It returns errNoLogFile if the logs have to be read
+// through the API instead.
+func (m *logSession) followFile(id, name string, tty bool, since time.Time, logPath, logDriver string) (time.Time, error) {
+	if !config.Config.LogsFromFile || logPath == "" {
+		return since, errNoLogFile
+	}
+	if logDriver != "" && logDriver != "json-file" {
+		return since, errNoLogFile
+	}
+
+	f := &logFile{
+		path:      logPath,
+		container: id,
+		name:      name,
+		tty:       tty,
+		follow:    m.follow,
+		tail:      tailCount(m.tail),
+		since:     since,
+		until:     m.until,
+		last:      since,
+		lines:     m.lines,
+		done:      m.done,
+		running: func() bool {
+			c, err := m.client.InspectContainer(id)
+			return err == nil && c.State.Running
+		},
+	}
+	err := f.run()
+	return f.last, err
+}
+
+func newInspector() (*client.Client, error) {
+	inspector, err := client.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+	inspector.UpdateClientVersion("1.22")
+	return inspector, nil
+}
+
+// mergeLines buffers lines for the length of the window and emits them ordered
+// by timestamp. A window of 0 emits lines as they come. It returns when lines
+// is closed or done is closed.
+func mergeLines(lines <-chan *logLine, done <-chan struct{}, window time.Duration, emit func(*logLine)) {
+	if window <= 0 {
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					return
+				}
+				emit(line)
+			case <-done:
+				return
+			}
+		}
+	}
+
+	ticker := time.NewTicker(window)
+	defer ticker.Stop()
+
+	buffer := []*logLine{}
+	flush := func() {
+		sort.Stable(byTimestamp(buffer))
+		for _, line := range buffer {
+			emit(line)
+		}
+		buffer = buffer[:0]
+	}
+
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				flush()
+				return
+			}
+			buffer = append(buffer, line)
+		case <-ticker.C:
+			flush()
+		case <-done:
+			return
+		}
+	}
+}
+
+type byTimestamp []*logLine
+
+func (b byTimestamp) Len() int           { return len(b) }
+func (b byTimestamp) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byTimestamp) Less(i, j int) bool { return b[i].Timestamp.Before(b[j].Timestamp) }
+
+func matchesLabels(labels map[string]string, selector map[string]string) bool {
+	for k, v := range selector {
+		actual, ok := labels[k]
+		if !ok || (v != "" && actual != v) {
+			return false
+		}
+	}
+	return true
+}
+
+func getTail(logs map[string]interface{}) string {
+	switch lines := logs["Lines"].(type) {
+	case int:
+		return strconv.Itoa(lines)
+	case float64:
+		return strconv.Itoa(int(lines))
+	}
+	return "100"
+}
+
+func getStringList(param interface{}) []string {
+	result := []string{}
+	if list, ok := param.([]interface{}); ok {
+		for _, item := range list {
+			if val, ok := item.(string); ok {
+				result = append(result, val)
+			}
+		}
+	}
+	return result
+}
+
+func getStringMap(param interface{}) map[string]string {
+	result := map[string]string{}
+	if m, ok := param.(map[string]interface{}); ok {
+		for k, item := range m {
+			if val, ok := item.(string); ok {
+				result[k] = val
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,139 @@
+package logs
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	streamStdout = "stdout"
+	streamStderr = "stderr"
+	streamBoth   = ""
+)
+
+var errLogsClosed = errors.New("Log session closed")
+
+// logLine is a single line of container output, as produced by the docker logs
+// API with Timestamps enabled.
+type logLine struct {
+	Container string
+	Name      string
+	Stream    string
+	Timestamp time.Time
+	// Raw is the line exactly as docker sent it, including the timestamp and
+	// trailing newline.
+	Raw []byte
+	// Offset is where the message starts in Raw, after the timestamp.
+	Offset int
+}
+
+func (l *logLine) Message() []byte {
+	return l.Raw[l.Offset:]
+}
+
+// lineWriter splits whatever docker writes into lines and hands them off to
+// the given channel. Writes fail once done is closed so that the docker
+// client gives up on the stream.
+type lineWriter struct {
+	sync.Mutex
+	container string
+	name      string
+	stream    string
+	lines     chan<- *logLine
+	done      <-chan struct{}
+	buffer    []byte
+	// Lines with a timestamp at or before since are dropped. This is used to
+	// skip output already seen when a container is followed again. Lines after
+	// until are dropped too, if it's set.
+	since time.Time
+	until time.Time
+	last  time.Time
+}
+
+func newLineWriter(container, name, stream string, lines chan<- *logLine, done <-chan struct{}) *lineWriter {
+	return &lineWriter{
+		container: container,
+		name:      name,
+		stream:    stream,
+		lines:     lines,
+		done:      done,
+	}
+}
+
+func (w *lineWriter) Write(data []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.buffer = append(w.buffer, data...)
+	for {
+		i := bytes.IndexByte(w.buffer, '\n')
+		if i < 0 {
+			break
+		}
+		raw := make([]byte, i+1)
+		copy(raw, w.buffer[:i+1])
+		w.buffer = w.buffer[i+1:]
+		if err := w.emit(raw); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// Flush emits anything left over that wasn't terminated by a newline.
+func (w *lineWriter) Flush() error {
+	w.Lock()
+	defer w.Unlock()
+
+	if len(w.buffer) == 0 {
+		return nil
+	}
+	raw := w.buffer
+	w.buffer = nil
+	return w.emit(raw)
+}
+
+// Last returns the timestamp of the last line written.
+func (w *lineWriter) Last() time.Time {
+	w.Lock()
+	defer w.Unlock()
+	return w.last
+}
+
+func (w *lineWriter) emit(raw []byte) error {
+	line := &logLine{
+		Container: w.container,
+		Name:      w.name,
+		Stream:    w.stream,
+		Raw:       raw,
+	}
+	line.Timestamp, line.Offset = parseTimestamp(raw)
+
+	if line.Offset > 0 {
+		if !line.Timestamp.After(w.since) || (!w.until.IsZero() && line.Timestamp.After(w.until)) {
+			return nil
+		}
+		w.last = line.Timestamp
+	}
+
+	select {
+	case w.lines <- line:
+		return nil
+	case <-w.done:
+		return errLogsClosed
+	}
+}
+
+// parseTimestamp parses the RFC3339 timestamp docker puts at the start of each
+// line. If there isn't one, the current time is used and the offset is 0.
+func parseTimestamp(raw []byte) (time.Time, int) {
+	i := bytes.IndexByte(raw, ' ')
+	if i > 0 {
+		if ts, err := time.Parse(time.RFC3339Nano, string(raw[:i])); err == nil {
+			return ts, i + 1
+		}
+	}
+	return time.Now(), 0
+}
@@ -0,0 +1,69 @@
+package logs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLineWriterSplitsLines(t *testing.T) {
+	lines := make(chan *logLine, 10)
+	done := make(chan struct{})
+	w := newLineWriter("c1", "web", streamStdout, lines, done)
+
+	w.Write([]byte("2016-09-01T10:00:00.000000001Z first\n2016-09-01T10:00:01Z sec"))
+	w.Write([]byte("ond\nno timestamp"))
+	w.Flush()
+	close(lines)
+
+	expected := []string{"first\n", "second\n", "no timestamp"}
+	i := 0
+	for line := range lines {
+		if string(line.Message()) != expected[i] {
+			t.Fatalf("Expected message [%s], got [%s]", expected[i], line.Message())
+		}
+		if line.Container != "c1" || line.Name != "web" || line.Stream != streamStdout {
+			t.Fatalf("Line wasn't tagged: %#v", line)
+		}
+		i++
+	}
+	if i != len(expected) {
+		t.Fatalf("Expected %d lines, got %d", len(expected), i)
+	}
+}
+
+func TestLineWriterSkipsSeenLines(t *testing.T) {
+	lines := make(chan *logLine, 10)
+	w := newLineWriter("c1", "web", streamStdout, lines, make(chan struct{}))
+	w.since, _ = time.Parse(time.RFC3339, "2016-09-01T10:00:00Z")
+
+	w.Write([]byte("2016-09-01T10:00:00Z old\n2016-09-01T10:00:02Z new\n"))
+	close(lines)
+
+	line := <-lines
+	if string(line.Message()) != "new\n" {
+		t.Fatalf("Expected only the new line, got [%s]", line.Message())
+	}
+	if _, ok := <-lines; ok {
+		t.Fatal("Expected old line to be dropped")
+	}
+}
+
+func TestMergeLinesOrdersByTimestamp(t *testing.T) {
+	lines := make(chan *logLine, 10)
+	done := make(chan struct{})
+	a := newLineWriter("a", "a", streamStdout, lines, done)
+	b := newLineWriter("b", "b", streamStdout, lines, done)
+
+	a.Write([]byte("2016-09-01T10:00:02Z a2\n"))
+	b.Write([]byte("2016-09-01T10:00:01Z b1\n"))
+	a.Write([]byte("2016-09-01T10:00:03Z a3\n"))
+	close(lines)
+
+	result := ""
+	mergeLines(lines, done, time.Second, func(line *logLine) {
+		result += string(line.Message())
+	})
+	if result != "b1\na2\na3\n" {
+		t.Fatalf("Lines weren't ordered by timestamp: [%s]", result)
+	}
+}
@@ -1,43 +1,115 @@
 package logs
 
 import (
-	"io"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
 )
 
-var messageSeparator = []byte("[RANLOGS]")
-var messageSeparatorLength = len(messageSeparator)
-var messageOffset = 3 + messageSeparatorLength
+const (
+	formatLegacy = "legacy"
+	formatJSON   = "json"
+)
 
-var stdoutPrefix = []byte("01 ")
-var stderrPrefix = []byte("02 ")
-var bothPrefix = []byte("00 ")
+// framer turns a line into the body of a message.
+type framer func(line *logLine, tagged bool, highlights [][]int) string
 
-type stdoutWriter struct {
-	writer io.Writer
+// jsonMessage is a line in the json format.
+type jsonMessage struct {
+	Stream     string  `json:"stream"`
+	Timestamp  string  `json:"timestamp"`
+	Container  string  `json:"container"`
+	Name       string  `json:"name,omitempty"`
+	Line       string  `json:"line"`
+	Highlights [][]int `json:"highlights,omitempty"`
 }
 
-type stderrorWriter struct {
-	writer io.Writer
-}
-type stdbothWriter struct {
-	writer io.Writer
-}
+// getFramer picks the message format from the Format claim or the format URL
+// parameter. Clients that ask for neither get the legacy format.
+func getFramer(logs map[string]interface{}, query url.Values) (framer, error) {
+	format, _ := logs["Format"].(string)
+	if f := query.Get("format"); f != "" {
+		format = f
+	}
 
-func wrapMessage(writer io.Writer, prefix []byte, message []byte) (n int, err error) {
-	msg := append(prefix, message...)
-	msg = append(msg, messageSeparator...)
-	n, err = writer.Write(msg)
-	return n - messageOffset, err
+	switch format {
+	case "", formatLegacy:
+		return legacyFrame, nil
+	case formatJSON:
+		return jsonFrame, nil
+	}
+	return nil, fmt.Errorf("Invalid log format %s", format)
 }
 
-func (w stdoutWriter) Write(message []byte) (n int, err error) {
-	return wrapMessage(w.writer, stdoutPrefix, message)
+var stdoutPrefix = []byte("01 ")
+var stderrPrefix = []byte("02 ")
+var bothPrefix = []byte("00 ")
+
+func legacyPrefix(stream string) []byte {
+	switch stream {
+	case streamStdout:
+		return stdoutPrefix
+	case streamStderr:
+		return stderrPrefix
+	}
+	return bothPrefix
 }
 
-func (w stderrorWriter) Write(message []byte) (n int, err error) {
-	return wrapMessage(w.writer, stderrPrefix, message)
+// legacyFrame formats a line as the stream prefix followed by the line as
+// docker sent it. When tagged the container name is added in brackets, and
+// highlighted matches are added as start:end offsets into the line in braces.
+func legacyFrame(line *logLine, tagged bool, highlights [][]int) string {
+	buffer := bytes.Buffer{}
+	buffer.Write(legacyPrefix(line.Stream))
+	if tagged {
+		buffer.WriteString("[" + line.Name + "] ")
+	}
+	if len(highlights) > 0 {
+		buffer.WriteByte('{')
+		for i, h := range highlights {
+			if i > 0 {
+				buffer.WriteByte(',')
+			}
+			buffer.WriteString(strconv.Itoa(h[0]) + ":" + strconv.Itoa(h[1]))
+		}
+		buffer.WriteString("} ")
+	}
+	buffer.Write(line.Raw)
+	return buffer.String()
 }
 
-func (w stdbothWriter) Write(message []byte) (n int, err error) {
-	return wrapMessage(w.writer, bothPrefix, message)
+// jsonFrame formats a line as a JSON object. The timestamp and trailing
+// newline are taken off the line, and highlights are offsets into what's left.
+func jsonFrame(line *logLine, tagged bool, highlights [][]int) string {
+	stream := line.Stream
+	if stream == streamBoth {
+		stream = "tty"
+	}
+
+	message := jsonMessage{
+		Stream:    stream,
+		Timestamp: line.Timestamp.UTC().Format(time.RFC3339Nano),
+		Container: line.Container,
+		Name:      line.Name,
+		Line:      string(bytes.TrimRight(line.Message(), "\r\n")),
+	}
+	for _, h := range highlights {
+		start := h[0] - line.Offset
+		end := h[1] - line.Offset
+		if end > len(message.Line) {
+			end = len(message.Line)
+		}
+		if start < end {
+			message.Highlights = append(message.Highlights, []int{start, end})
+		}
+	}
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return ""
+	}
+	return string(data)
 }
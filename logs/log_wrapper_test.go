@@ -0,0 +1,55 @@
+package logs
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJSONFrame(t *testing.T) {
+	line := filterLine(streamStderr, "2016-09-01T10:00:00.5Z boom [RANLOGS] boom\n")
+	line.Container = "abc"
+	line.Name = "web"
+
+	message := jsonMessage{}
+	if err := json.Unmarshal([]byte(jsonFrame(line, true, [][]int{{23, 27}})), &message); err != nil {
+		t.Fatal(err)
+	}
+	expected := jsonMessage{
+		Stream:     "stderr",
+		Timestamp:  "2016-09-01T10:00:00.5Z",
+		Container:  "abc",
+		Name:       "web",
+		Line:       "boom [RANLOGS] boom",
+		Highlights: [][]int{{0, 4}},
+	}
+	if !reflect.DeepEqual(message, expected) {
+		t.Fatalf("Expected %#v, got %#v", expected, message)
+	}
+}
+
+func TestGetFramer(t *testing.T) {
+	line := filterLine(streamStdout, "2016-09-01T10:00:00Z hello\n")
+
+	frame, err := getFramer(map[string]interface{}{}, url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := frame(line, false, nil); body != "01 2016-09-01T10:00:00Z hello\n" {
+		t.Fatalf("Expected legacy frame by default, got [%s]", body)
+	}
+
+	frame, err = getFramer(map[string]interface{}{"Format": "json"}, url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := frame(line, false, nil); !strings.HasPrefix(body, "{") {
+		t.Fatalf("Expected json frame, got [%s]", body)
+	}
+
+	if _, err := getFramer(map[string]interface{}{}, url.Values{"format": {"xml"}}); err == nil {
+		t.Fatal("Expected error for unknown format")
+	}
+}
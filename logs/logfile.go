@@ -0,0 +1,354 @@
+package logs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// How long to wait for the log file to change before checking again.
+	logFilePollInterval = time.Second
+	// How many idle polls before checking whether the container is still running.
+	logFileIdleChecks = 5
+	logFileBlockSize  = 32 * 1024
+)
+
+var errNoLogFile = errors.New("No log file for container")
+
+// watchLogDir watches the directory of a followed log file.
+var watchLogDir = newFileWatcher
+
+// jsonFileLine is a line written by docker's json-file log driver.
+type jsonFileLine struct {
+	Log    string    `json:"log"`
+	Stream string    `json:"stream"`
+	Time   time.Time `json:"time"`
+}
+
+// logFile reads a container's logs from the files written by the json-file
+// log driver, including rotated files, and optionally follows the current one.
+type logFile struct {
+	path      string
+	container string
+	name      string
+	tty       bool
+	follow    bool
+	// Number of lines to start from the end, or -1 for all of them.
+	tail    int
+	since   time.Time
+	until   time.Time
+	last    time.Time
+	lines   chan<- *logLine
+	done    <-chan struct{}
+	running func() bool
+
+	pending []byte
+}
+
+func (f *logFile) run() error {
+	current, err := os.Open(f.path)
+	if err != nil {
+		return errNoLogFile
+	}
+	defer func() {
+		current.Close()
+	}()
+
+	files := append(rotatedFiles(f.path), f.path)
+	start, offset, err := tailStart(files, f.tail)
+	if err != nil {
+		return errNoLogFile
+	}
+
+	for i := start; i < len(files)-1; i++ {
+		if err := f.readFile(files[i], offset); err != nil {
+			return err
+		}
+		offset = 0
+	}
+	if _, err := current.Seek(offset, 0); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(current)
+	if err := f.drain(reader); err != nil {
+		return err
+	}
+
+	if !f.follow {
+		return f.flush()
+	}
+
+	watcher := watchLogDir(filepath.Dir(f.path))
+	defer watcher.Close()
+
+	idle := 0
+	for {
+		if err := f.drain(reader); err != nil {
+			return err
+		}
+
+		next, err := f.reopen(current, reader)
+		if err != nil {
+			return err
+		}
+		if next != nil {
+			current.Close()
+			current = next
+			reader = bufio.NewReader(current)
+			continue
+		}
+
+		changed := watcher.Wait(logFilePollInterval)
+		select {
+		case <-f.done:
+			return errLogsClosed
+		default:
+		}
+
+		if changed {
+			idle = 0
+			continue
+		}
+
+		idle++
+		if idle >= logFileIdleChecks {
+			idle = 0
+			if !f.running() {
+				if err := f.drain(reader); err != nil {
+					return err
+				}
+				return f.flush()
+			}
+		}
+	}
+}
+
+// reopen returns the new log file if the current one was rotated. The
+// json-file driver rotates by renaming the current file and creating a new
+// one, and lines can be written to the old one up until the rename, so it's
+// drained again before switching over.
+func (f *logFile) reopen(current *os.File, reader *bufio.Reader) (*os.File, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, nil
+	}
+	currentInfo, err := current.Stat()
+	if err != nil || os.SameFile(info, currentInfo) {
+		return nil, nil
+	}
+	next, err := os.Open(f.path)
+	if err != nil {
+		return nil, nil
+	}
+	if err := f.drain(reader); err != nil {
+		next.Close()
+		return nil, err
+	}
+	if err := f.flush(); err != nil {
+		next.Close()
+		return nil, err
+	}
+	return next, nil
+}
+
+func (f *logFile) readFile(path string, offset int64) error {
+	file, err := os.Open(path)
+	if err != nil {
+		// Rotated away while we were reading, nothing to do about it.
+		return nil
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, 0); err != nil {
+		return err
+	}
+	if err := f.drain(bufio.NewReader(file)); err != nil {
+		return err
+	}
+	return f.flush()
+}
+
+// drain emits every complete line up to the end of the file. A partial line is
+// kept until the rest of it is written.
+func (f *logFile) drain(reader *bufio.Reader) error {
+	for {
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			f.pending = append(f.pending, data...)
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if len(f.pending) > 0 {
+			data = append(f.pending, data...)
+			f.pending = nil
+		}
+		if err := f.emit(data); err != nil {
+			return err
+		}
+	}
+}
+
+func (f *logFile) flush() error {
+	if len(f.pending) == 0 {
+		return nil
+	}
+	data := f.pending
+	f.pending = nil
+	return f.emit(data)
+}
+
+func (f *logFile) emit(data []byte) error {
+	entry := jsonFileLine{}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil
+	}
+	if !entry.Time.After(f.since) || (!f.until.IsZero() && entry.Time.After(f.until)) {
+		return nil
+	}
+	f.last = entry.Time
+
+	stream := entry.Stream
+	if f.tty {
+		stream = streamBoth
+	}
+	timestamp := entry.Time.UTC().Format(time.RFC3339Nano)
+	line := &logLine{
+		Container: f.container,
+		Name:      f.name,
+		Stream:    stream,
+		Timestamp: entry.Time,
+		Raw:       []byte(timestamp + " " + entry.Log),
+		Offset:    len(timestamp) + 1,
+	}
+
+	select {
+	case f.lines <- line:
+		return nil
+	case <-f.done:
+		return errLogsClosed
+	}
+}
+
+// rotatedFiles returns the rotated files for a log file, oldest first.
+func rotatedFiles(path string) []string {
+	matches, _ := filepath.Glob(path + ".*")
+	numbers := []int{}
+	for _, match := range matches {
+		if n, err := strconv.Atoi(strings.TrimPrefix(match, path+".")); err == nil {
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(numbers)))
+
+	files := []string{}
+	for _, n := range numbers {
+		files = append(files, path+"."+strconv.Itoa(n))
+	}
+	return files
+}
+
+// tailStart finds the file and offset to start reading from so that the last
+// tail lines across all of the files are read.
+func tailStart(files []string, tail int) (int, int64, error) {
+	if tail < 0 {
+		return 0, 0, nil
+	}
+	if tail == 0 {
+		info, err := os.Stat(files[len(files)-1])
+		if err != nil {
+			return 0, 0, err
+		}
+		return len(files) - 1, info.Size(), nil
+	}
+
+	needed := tail
+	for i := len(files) - 1; i >= 0; i-- {
+		offset, remaining, err := scanBackwards(files[i], needed)
+		if err != nil {
+			if i == len(files)-1 {
+				return 0, 0, err
+			}
+			return i + 1, 0, nil
+		}
+		if remaining == 0 {
+			return i, offset, nil
+		}
+		needed = remaining
+	}
+	return 0, 0, nil
+}
+
+// scanBackwards finds the offset where the last n lines of a file start. If
+// the file has fewer lines, the offset is 0 and the number of lines still
+// needed is returned.
+func scanBackwards(path string, n int) (int64, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	size := info.Size()
+	if size == 0 {
+		return 0, n, nil
+	}
+
+	end := size
+	last := make([]byte, 1)
+	if _, err := file.ReadAt(last, size-1); err != nil {
+		return 0, 0, err
+	}
+	if last[0] == '\n' {
+		end--
+	}
+
+	count := 0
+	block := make([]byte, logFileBlockSize)
+	for end > 0 {
+		start := end - logFileBlockSize
+		if start < 0 {
+			start = 0
+		}
+		data := block[:end-start]
+		if _, err := file.ReadAt(data, start); err != nil && err != io.EOF {
+			return 0, 0, err
+		}
+		for {
+			i := bytes.LastIndexByte(data, '\n')
+			if i < 0 {
+				break
+			}
+			count++
+			if count == n {
+				return start + int64(i) + 1, 0, nil
+			}
+			data = data[:i]
+		}
+		end = start
+	}
+
+	// The first line in the file doesn't have a newline before it.
+	return 0, n - count - 1, nil
+}
+
+func tailCount(tail string) int {
+	if n, err := strconv.Atoi(tail); err == nil && n >= 0 {
+		return n
+	}
+	return -1
+}
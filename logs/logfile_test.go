@@ -0,0 +1,251 @@
+package logs
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeLogFile(t *testing.T, path string, from, to int) {
+	data := ""
+	for i := from; i < to; i++ {
+		ts := time.Date(2016, 9, 1, 10, 0, i, 0, time.UTC).Format(time.RFC3339Nano)
+		data += fmt.Sprintf(`{"log":"line %d\n","stream":"stdout","time":"%s"}`+"\n", i, ts)
+	}
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readLogFile(t *testing.T, path string, tail int) []string {
+	lines := make(chan *logLine, 100)
+	f := &logFile{
+		path:      path,
+		container: "c1",
+		name:      "web",
+		tail:      tail,
+		lines:     lines,
+		done:      make(chan struct{}),
+	}
+	if err := f.run(); err != nil {
+		t.Fatal(err)
+	}
+	close(lines)
+
+	result := []string{}
+	for line := range lines {
+		if line.Stream != streamStdout || line.Container != "c1" {
+			t.Fatalf("Line wasn't tagged: %#v", line)
+		}
+		result = append(result, string(line.Message()))
+	}
+	return result
+}
+
+func TestLogFileTailAcrossRotatedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "c1-json.log")
+	writeLogFile(t, path+".2", 0, 3)
+	writeLogFile(t, path+".1", 3, 6)
+	writeLogFile(t, path, 6, 8)
+
+	all := readLogFile(t, path, -1)
+	if len(all) != 8 || all[0] != "line 0\n" || all[7] != "line 7\n" {
+		t.Fatalf("Unexpected lines: %v", all)
+	}
+
+	tail := readLogFile(t, path, 4)
+	if len(tail) != 4 || tail[0] != "line 4\n" || tail[3] != "line 7\n" {
+		t.Fatalf("Unexpected tail: %v", tail)
+	}
+
+	if none := readLogFile(t, path, 0); len(none) != 0 {
+		t.Fatalf("Expected no lines, got %v", none)
+	}
+}
+
+func TestRotatedFilesOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "c1-json.log")
+	for _, suffix := range []string{".1", ".10", ".2", ".gz"} {
+		writeLogFile(t, path+suffix, 0, 1)
+	}
+
+	files := rotatedFiles(path)
+	expected := []string{path + ".10", path + ".2", path + ".1"}
+	if fmt.Sprint(files) != fmt.Sprint(expected) {
+		t.Fatalf("Expected %v, got %v", expected, files)
+	}
+}
+
+func TestLogFileFollowsRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "c1-json.log")
+	writeLogFile(t, path, 0, 1)
+
+	lines := make(chan *logLine, 100)
+	done := make(chan struct{})
+	f := &logFile{
+		path:      path,
+		container: "c1",
+		follow:    true,
+		tail:      -1,
+		lines:     lines,
+		done:      done,
+		running:   func() bool { return true },
+	}
+	result := make(chan error)
+	go func() {
+		result <- f.run()
+	}()
+
+	expectLine := func(expected string) {
+		select {
+		case line := <-lines:
+			if string(line.Message()) != expected {
+				t.Fatalf("Expected [%s], got [%s]", expected, line.Message())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for [%s]", expected)
+		}
+	}
+
+	expectLine("line 0\n")
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	writeLogFile(t, path, 1, 2)
+	expectLine("line 1\n")
+
+	close(done)
+	if err := <-result; err != errLogsClosed {
+		t.Fatalf("Expected closed error, got %v", err)
+	}
+}
+
+func TestLogFileDrainsBeforeRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "c1-json.log")
+	writeLogFile(t, path, 0, 1)
+	current, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer current.Close()
+
+	lines := make(chan *logLine, 100)
+	f := &logFile{
+		path:      path,
+		container: "c1",
+		tail:      -1,
+		lines:     lines,
+		done:      make(chan struct{}),
+	}
+	reader := bufio.NewReader(current)
+	if err := f.drain(reader); err != nil {
+		t.Fatal(err)
+	}
+	if next, err := f.reopen(current, reader); next != nil || err != nil {
+		t.Fatalf("Expected no rotation, got %v, %v", next, err)
+	}
+
+	// A line written after the last drain, just before the rotation.
+	writeLogFile(t, path+".tmp", 1, 2)
+	last, _ := ioutil.ReadFile(path + ".tmp")
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(last)
+	file.Close()
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	writeLogFile(t, path, 2, 3)
+
+	next, err := f.reopen(current, reader)
+	if err != nil || next == nil {
+		t.Fatalf("Expected the new file, got %v, %v", next, err)
+	}
+	next.Close()
+	close(lines)
+
+	result := []string{}
+	for line := range lines {
+		result = append(result, string(line.Message()))
+	}
+	if len(result) != 2 || result[0] != "line 0\n" || result[1] != "line 1\n" {
+		t.Fatalf("Expected lines 0 and 1 from the old file, got %q", result)
+	}
+}
+
+func TestLogFilePollingEndsWhenStopped(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Watching a directory that doesn't exist falls back to polling.
+	oldWatch := watchLogDir
+	defer func() {
+		watchLogDir = oldWatch
+	}()
+	watchLogDir = func(string) *fileWatcher {
+		return newFileWatcher(filepath.Join(dir, "missing"))
+	}
+
+	path := filepath.Join(dir, "c1-json.log")
+	writeLogFile(t, path, 0, 1)
+
+	lines := make(chan *logLine, 100)
+	f := &logFile{
+		path:      path,
+		container: "c1",
+		follow:    true,
+		tail:      -1,
+		lines:     lines,
+		done:      make(chan struct{}),
+		running:   func() bool { return false },
+	}
+	result := make(chan error)
+	go func() {
+		result <- f.run()
+	}()
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(logFileIdleChecks*logFilePollInterval + 5*time.Second):
+		t.Fatal("Expected following to end once the container stopped")
+	}
+	if len(lines) != 1 {
+		t.Errorf("Expected 1 line, got %d", len(lines))
+	}
+}
@@ -0,0 +1,86 @@
+package logs
+
+import (
+	"syscall"
+	"time"
+)
+
+// fileWatcher waits for changes in a directory using inotify. If inotify
+// can't be set up it falls back to polling.
+type fileWatcher struct {
+	fd    int
+	epfd  int
+	valid bool
+}
+
+func newFileWatcher(dir string) *fileWatcher {
+	w := &fileWatcher{fd: -1, epfd: -1}
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return w
+	}
+	w.fd = fd
+
+	mask := uint32(syscall.IN_MODIFY | syscall.IN_CREATE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_DELETE_SELF)
+	if _, err := syscall.InotifyAddWatch(fd, dir, mask); err != nil {
+		w.Close()
+		return w
+	}
+
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		w.Close()
+		return w
+	}
+	w.epfd = epfd
+
+	event := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fd, &event); err != nil {
+		w.Close()
+		return w
+	}
+
+	w.valid = true
+	return w
+}
+
+// Wait blocks until something in the directory changes or the timeout passes,
+// and reports whether there was a change. When polling it can't tell, so it
+// reports none and callers read the file again anyway.
+func (w *fileWatcher) Wait(timeout time.Duration) bool {
+	if !w.valid {
+		time.Sleep(timeout)
+		return false
+	}
+
+	events := make([]syscall.EpollEvent, 1)
+	n, err := syscall.EpollWait(w.epfd, events, int(timeout/time.Millisecond))
+	if err != nil && err != syscall.EINTR {
+		time.Sleep(timeout)
+		return false
+	}
+	if n <= 0 {
+		return false
+	}
+
+	buffer := make([]byte, 4096)
+	for {
+		if n, err := syscall.Read(w.fd, buffer); n <= 0 || err != nil {
+			break
+		}
+	}
+	return true
+}
+
+func (w *fileWatcher) Close() {
+	if w.epfd >= 0 {
+		syscall.Close(w.epfd)
+		w.epfd = -1
+	}
+	if w.fd >= 0 {
+		syscall.Close(w.fd)
+		w.fd = -1
+	}
+	w.valid = false
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package logs
+
+import (
+	"time"
+)
+
+// fileWatcher polls for changes where inotify isn't available.
+type fileWatcher struct {
+}
+
+func newFileWatcher(dir string) *fileWatcher {
+	return &fileWatcher{}
+}
+
+// Wait sleeps for the timeout. Polling can't tell whether anything changed,
+// so it reports no change and callers read the file again anyway.
+func (w *fileWatcher) Wait(timeout time.Duration) bool {
+	time.Sleep(timeout)
+	return false
+}
+
+func (w *fileWatcher) Close() {
+}
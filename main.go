@@ -5,6 +5,7 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
@@ -19,6 +20,7 @@ import (
 	"github.com/rancher/host-api/logs"
 	"github.com/rancher/host-api/proxy"
 	"github.com/rancher/host-api/stats"
+	"github.com/rancher/host-api/top"
 	"github.com/rancher/host-api/util"
 
 	"github.com/golang/glog"
@@ -57,11 +59,32 @@ func main() {
 		logrus.Fatal(err)
 	}
 
+	stats.StartHistory()
+
+	if err := stats.StartSink(); err != nil {
+		logrus.Fatal(err)
+	}
+
+	if config.Config.Metrics {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", &stats.MetricsHTTPHandler{})
+		logrus.Infof("Serving metrics on %s", config.Config.MetricsListen)
+		go func() {
+			if err := http.ListenAndServe(config.Config.MetricsListen, mux); err != nil {
+				logrus.WithFields(logrus.Fields{"error": err}).Error("Couldn't serve metrics.")
+			}
+		}()
+	}
+
 	rancherClient, err := util.GetRancherClient()
 	if err != nil {
 		logrus.Fatal(err)
 	}
 
+	if err := stats.StartAlerts(rancherClient); err != nil {
+		logrus.Fatal(err)
+	}
+
 	tokenRequest := &rclient.HostApiProxyToken{
 		ReportedUuid: config.Config.HostUuid,
 	}
@@ -83,6 +106,9 @@ func main() {
 	handlers["/v2-beta/hoststats/"] = &stats.HostStatsHandler{}
 	handlers["/v1/containerstats/"] = &stats.ContainerStatsHandler{}
 	handlers["/v2-beta/containerstats/"] = &stats.ContainerStatsHandler{}
+	handlers["/v1/metrics/"] = &stats.MetricsHandler{}
+	handlers["/v2-beta/metrics/"] = &stats.MetricsHandler{}
+	handlers["/v2-beta/top/"] = &top.Handler{}
 	handlers["/v1/exec/"] = &exec.ExecHandler{}
 	handlers["/v2-beta/exec/"] = &exec.ExecHandler{}
 	handlers["/v1/console/"] = &console.Handler{}
@@ -0,0 +1,138 @@
+// Package proc reads processes from /proc, or from HOST_PROC when the host's
+// /proc is mounted elsewhere.
+package proc
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The kernel counts CPU time in USER_HZ, which is 100 on every platform docker
+// supports.
+const UserHz = 100
+
+var PageSize = uint64(os.Getpagesize())
+
+// Stat is what's read of a process from /proc/<pid>/stat.
+type Stat struct {
+	Command string
+	State   string
+	Ppid    int
+	// CPU time used so far, user and system.
+	// Units: USER_HZ
+	CpuTime uint64
+	// Units: Bytes.
+	Rss uint64
+	// When the process started.
+	// Units: USER_HZ since boot
+	StartTime uint64
+}
+
+// Path joins parts to where the host's /proc is.
+func Path(parts ...string) string {
+	root := os.Getenv("HOST_PROC")
+	if root == "" {
+		root = "/proc"
+	}
+	return filepath.Join(append([]string{root}, parts...)...)
+}
+
+func ReadStat(pid int) (*Stat, error) {
+	stat, err := ioutil.ReadFile(Path(strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return nil, err
+	}
+	return ParseStat(stat)
+}
+
+// ParseStat parses /proc/<pid>/stat. The command is in parentheses and can
+// contain anything, so the fields are found after the last one.
+func ParseStat(stat []byte) (*Stat, error) {
+	open := bytes.IndexByte(stat, '(')
+	end := bytes.LastIndexByte(stat, ')')
+	if open < 0 || end < open {
+		return nil, fmt.Errorf("Invalid stat %q", stat)
+	}
+	fields := strings.Fields(string(stat[end+1:]))
+	// Fields are numbered from 3, the state, in proc(5).
+	if len(fields) < 22 {
+		return nil, fmt.Errorf("Invalid stat %q", stat)
+	}
+	field := func(n int) uint64 {
+		value, _ := strconv.ParseUint(fields[n-3], 10, 64)
+		return value
+	}
+
+	return &Stat{
+		Command:   string(stat[open+1 : end]),
+		State:     fields[0],
+		Ppid:      int(field(4)),
+		CpuTime:   field(14) + field(15),
+		Rss:       field(24) * PageSize,
+		StartTime: field(22),
+	}, nil
+}
+
+// Uptime is how long the host has been up.
+// Units: seconds
+func Uptime() (float64, error) {
+	data, err := ioutil.ReadFile(Path("uptime"))
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("Invalid uptime %q", data)
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+// CpuUsage works out how much CPU processes use between samples, keeping the
+// CPU time of each one from the previous sample. Processes that weren't in
+// it get what they used since they started.
+type CpuUsage struct {
+	uptime   float64
+	elapsed  float64
+	lastRead time.Time
+	lastCpu  map[int]uint64
+	cpu      map[int]uint64
+}
+
+func NewCpuUsage() *CpuUsage {
+	return &CpuUsage{
+		cpu: map[int]uint64{},
+	}
+}
+
+// Next starts a sample taken at now.
+func (u *CpuUsage) Next(now time.Time) error {
+	uptime, err := Uptime()
+	if err != nil {
+		return err
+	}
+	u.uptime = uptime
+	u.elapsed = now.Sub(u.lastRead).Seconds()
+	u.lastRead = now
+	u.lastCpu = u.cpu
+	u.cpu = map[int]uint64{}
+	return nil
+}
+
+// Percent records a process in the current sample and returns its CPU usage
+// as a percentage of one CPU.
+func (u *CpuUsage) Percent(pid int, stat *Stat) float64 {
+	u.cpu[pid] = stat.CpuTime
+	if prev, ok := u.lastCpu[pid]; ok && u.elapsed > 0 && stat.CpuTime >= prev {
+		return float64(stat.CpuTime-prev) / UserHz / u.elapsed * 100
+	}
+	if age := u.uptime - float64(stat.StartTime)/UserHz; age > 0 {
+		return float64(stat.CpuTime) / UserHz / age * 100
+	}
+	return 0
+}
@@ -0,0 +1,54 @@
+package proc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseStat(t *testing.T) {
+	stat := "42 (my (odd) proc) S 1 42 42 0 -1 4194560 100 0 0 0 250 50 0 0 20 0 1 0 1000 1000000 3 18446744073709551615\n"
+	process, err := ParseStat([]byte(stat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if process.State != "S" || process.Ppid != 1 || process.CpuTime != 300 || process.Rss != 3*PageSize || process.Command != "my (odd) proc" || process.StartTime != 1000 {
+		t.Errorf("Wrong process %+v", process)
+	}
+
+	if _, err := ParseStat([]byte("42 (short) S 1")); err == nil {
+		t.Error("Expected an error for a short stat")
+	}
+}
+
+func TestCpuUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("HOST_PROC", dir)
+	defer os.Unsetenv("HOST_PROC")
+	if err := ioutil.WriteFile(filepath.Join(dir, "uptime"), []byte("100.00 50.00\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	usage := NewCpuUsage()
+	now := time.Now()
+	if err := usage.Next(now); err != nil {
+		t.Fatal(err)
+	}
+	// Started 50s after boot, used 10s since.
+	if percent := usage.Percent(1, &Stat{CpuTime: 1000, StartTime: 5000}); percent != 20 {
+		t.Errorf("Expected 20%% since the process started, got %v", percent)
+	}
+
+	if err := usage.Next(now.Add(10 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if percent := usage.Percent(1, &Stat{CpuTime: 1500, StartTime: 5000}); percent != 50 {
+		t.Errorf("Expected 50%% since the last sample, got %v", percent)
+	}
+}
@@ -11,21 +11,43 @@ type AggregatedStat struct {
 	Id           string `json:"id,omitempty"`
 	ResourceType string `json:"resourceType,omitempty"`
 	MemLimit     uint64 `json:"memLimit,omitempty"`
+	// Container metadata, when asked for with metadata=true. Rollups have
+	// their stack and service.
+	Name    string `json:"name,omitempty"`
+	Image   string `json:"image,omitempty"`
+	Stack   string `json:"stack,omitempty"`
+	Service string `json:"service,omitempty"`
+	// Number of containers added up in a rollup.
+	Containers int `json:"containers,omitempty"`
 	*containerStats
+	Rates *Rates `json:"rates,omitempty"`
+	// The processes using the most CPU, when asked for with processes=N.
+	Processes []ProcessStats `json:"processes,omitempty"`
 }
 
-func convertToAggregatedStats(id string, containerIds map[string]string, resourceType string, stats []containerInfo, memLimit uint64) []AggregatedStats {
+func convertToAggregatedStats(id string, containerIds map[string]string, resourceType string, stats []containerInfo, memLimit uint64, decorator *statsDecorator) []AggregatedStats {
 	totalAggregatedStats := []AggregatedStats{}
 	if len(stats) == 0 {
 		return totalAggregatedStats
 	}
+	if decorator.rollup != "" {
+		return append(totalAggregatedStats, decorator.rollupStats(stats, memLimit))
+	}
 
 	totalAggregatedStat := []AggregatedStat{}
 	for j := 0; j < len(stats); j++ {
-		aggStats := AggregatedStat{id, resourceType, memLimit, stats[j].Stats[0]}
+		aggStats := AggregatedStat{
+			Id:             id,
+			ResourceType:   resourceType,
+			MemLimit:       memLimit,
+			containerStats: stats[j].Stats[0],
+			Rates:          stats[j].Rates,
+			Processes:      stats[j].Processes,
+		}
 		if id == "" {
 			aggStats.Id = containerIds[stats[j].Id]
 		}
+		decorator.enrich(&aggStats, stats[j].Id)
 		totalAggregatedStat = append(totalAggregatedStat, aggStats)
 	}
 	totalAggregatedStats = append(totalAggregatedStats, totalAggregatedStat)
@@ -33,8 +55,8 @@ func convertToAggregatedStats(id string, containerIds map[string]string, resourc
 	return totalAggregatedStats
 }
 
-func writeAggregatedStats(id string, containerIds map[string]string, resourceType string, infos []containerInfo, memLimit uint64, writer io.Writer) error {
-	aggregatedStats := convertToAggregatedStats(id, containerIds, resourceType, infos, memLimit)
+func writeAggregatedStats(id string, containerIds map[string]string, resourceType string, infos []containerInfo, memLimit uint64, decorator *statsDecorator, writer io.Writer) error {
+	aggregatedStats := convertToAggregatedStats(id, containerIds, resourceType, infos, memLimit, decorator)
 	for _, stat := range aggregatedStats {
 		data, err := json.Marshal(stat)
 		if err != nil {
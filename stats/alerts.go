@@ -0,0 +1,541 @@
+package stats
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/types"
+	dockerClient "github.com/fsouza/go-dockerclient"
+	rclient "github.com/rancher/go-rancher/client"
+
+	"github.com/rancher/host-api/config"
+	"github.com/rancher/host-api/events"
+)
+
+const (
+	// Containers can set or override rules with labels such as
+	// io.rancher.alert.memory_percent=90:60s, or turn one off with off.
+	alertLabelPrefix = "io.rancher.alert."
+	alertRuleOff     = "off"
+
+	alertMemoryPercent       = "memory_percent"
+	alertCpuThrottledPercent = "cpu_throttled_percent"
+	alertRestarts            = "restarts"
+
+	// Restarts are counted over the last 10 minutes unless a rule says
+	// otherwise.
+	defaultRestartWindow = 10 * time.Minute
+
+	// Alerts are published to Rancher's event bus under these names, with the
+	// container and rule in the data.
+	alertEventFiring   = "container.alert.firing"
+	alertEventResolved = "container.alert.resolved"
+	alertPublisher     = "host-api"
+
+	alertCheckInterval = time.Second
+	alertListInterval  = 10 * time.Second
+	// How many alerts can wait to be sent before new ones are dropped.
+	alertQueueSize = 100
+	// How long to wait before listening to docker events again, doubling up to
+	// the max while the daemon is unreachable.
+	alertEventsRetry    = time.Second
+	alertEventsRetryMax = time.Minute
+)
+
+// alertRule fires when a metric stays above a threshold for a duration. For
+// restarts the duration is the window they're counted over.
+type alertRule struct {
+	metric    string
+	threshold float64
+	duration  time.Duration
+}
+
+// alert is sent to Rancher when a rule fires or resolves.
+type alert struct {
+	container string
+	rule      alertRule
+	value     float64
+	firing    bool
+	time      time.Time
+}
+
+// parseAlertRules parses the --alert-rules setting, rules separated by commas
+// such as memory_percent>90:60s.
+func parseAlertRules(spec string) ([]alertRule, error) {
+	rules := []alertRule{}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		fields := strings.SplitN(part, ">", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Invalid alert rule %s", part)
+		}
+		rule, err := parseAlertRule(strings.TrimSpace(fields[0]), strings.TrimSpace(fields[1]))
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parseAlertRule parses a threshold and an optional duration, such as 90:60s.
+func parseAlertRule(metric, spec string) (alertRule, error) {
+	rule := alertRule{metric: metric}
+	switch metric {
+	case alertMemoryPercent, alertCpuThrottledPercent:
+	case alertRestarts:
+		rule.duration = defaultRestartWindow
+	default:
+		return rule, fmt.Errorf("Unknown alert metric %s", metric)
+	}
+
+	parts := strings.SplitN(spec, ":", 2)
+	threshold, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return rule, fmt.Errorf("Invalid alert threshold %s", parts[0])
+	}
+	rule.threshold = threshold
+	if len(parts) == 2 {
+		if rule.duration, err = time.ParseDuration(parts[1]); err != nil {
+			return rule, fmt.Errorf("Invalid alert duration %s", parts[1])
+		}
+	}
+	return rule, nil
+}
+
+// containerAlertRules are the configured rules with a container's labels
+// applied over them. Invalid labels are logged and ignored.
+func containerAlertRules(defaults []alertRule, id string, labels map[string]string) []alertRule {
+	byMetric := map[string]alertRule{}
+	for _, rule := range defaults {
+		byMetric[rule.metric] = rule
+	}
+	for label, value := range labels {
+		if !strings.HasPrefix(label, alertLabelPrefix) {
+			continue
+		}
+		metric := strings.TrimPrefix(label, alertLabelPrefix)
+		if value == alertRuleOff {
+			delete(byMetric, metric)
+			continue
+		}
+		rule, err := parseAlertRule(metric, value)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "id": id, "label": label}).Warn("Invalid alert label.")
+			continue
+		}
+		byMetric[metric] = rule
+	}
+
+	rules := []alertRule{}
+	for _, rule := range byMetric {
+		rules = append(rules, rule)
+	}
+	sort.Sort(byAlertMetric(rules))
+	return rules
+}
+
+type byAlertMetric []alertRule
+
+func (r byAlertMetric) Len() int {
+	return len(r)
+}
+
+func (r byAlertMetric) Swap(i, j int) {
+	r[i], r[j] = r[j], r[i]
+}
+
+func (r byAlertMetric) Less(i, j int) bool {
+	return r[i].metric < r[j].metric
+}
+
+// containerAlerts tracks the rules of one container. A rule is pending from
+// when its metric first goes over the threshold, and fires once it's stayed
+// over for the rule's duration. It resolves as soon as the metric is back
+// under.
+type containerAlerts struct {
+	id      string
+	rules   []alertRule
+	sub     *subscription
+	seq     uint64
+	prev    *containerStats
+	pending map[string]time.Time
+	firing  map[string]bool
+	starts  []time.Time
+	// running is whether the container was last seen running, so that only
+	// starts after it stopped are counted as restarts.
+	running bool
+}
+
+func newContainerAlerts(id string, rules []alertRule) *containerAlerts {
+	return &containerAlerts{
+		id:      id,
+		rules:   rules,
+		pending: map[string]time.Time{},
+		firing:  map[string]bool{},
+	}
+}
+
+// needsStats is whether any rule is on a metric from the stats stream.
+func (c *containerAlerts) needsStats() bool {
+	for _, rule := range c.rules {
+		if rule.metric != alertRestarts {
+			return true
+		}
+	}
+	return false
+}
+
+// observe evaluates the stats rules against a new sample.
+func (c *containerAlerts) observe(stats *containerStats, now time.Time) []alert {
+	prev := c.prev
+	c.prev = stats
+
+	alerts := []alert{}
+	for _, rule := range c.rules {
+		var value float64
+		switch rule.metric {
+		case alertMemoryPercent:
+			// Docker reports the host's memory as the limit of containers
+			// without one.
+			if stats.Memory.Limit == 0 {
+				continue
+			}
+			value = float64(stats.Memory.WorkingSet) / float64(stats.Memory.Limit) * 100
+		case alertCpuThrottledPercent:
+			if prev == nil {
+				continue
+			}
+			periods := counterDelta(prev.Cpu.Throttling.Periods, stats.Cpu.Throttling.Periods)
+			if periods == 0 {
+				value = 0
+			} else {
+				value = float64(counterDelta(prev.Cpu.Throttling.ThrottledPeriods, stats.Cpu.Throttling.ThrottledPeriods)) / float64(periods) * 100
+			}
+		default:
+			continue
+		}
+		if a := c.evaluate(rule, value, now); a != nil {
+			alerts = append(alerts, *a)
+		}
+	}
+	return alerts
+}
+
+// started records a start of the container, for restart rules.
+func (c *containerAlerts) started(now time.Time) {
+	c.starts = append(c.starts, now)
+}
+
+// checkRestarts evaluates the restart rules, dropping starts older than any
+// of their windows.
+func (c *containerAlerts) checkRestarts(now time.Time) []alert {
+	alerts := []alert{}
+	window := time.Duration(0)
+	for _, rule := range c.rules {
+		if rule.metric != alertRestarts {
+			continue
+		}
+		if rule.duration > window {
+			window = rule.duration
+		}
+		count := 0
+		for _, start := range c.starts {
+			if now.Sub(start) <= rule.duration {
+				count++
+			}
+		}
+		// Restarts are already counted over the window, so they fire as
+		// soon as there are too many.
+		immediate := rule
+		immediate.duration = 0
+		if a := c.evaluate(immediate, float64(count), now); a != nil {
+			a.rule = rule
+			alerts = append(alerts, *a)
+		}
+	}
+
+	kept := c.starts[:0]
+	for _, start := range c.starts {
+		if now.Sub(start) <= window {
+			kept = append(kept, start)
+		}
+	}
+	c.starts = kept
+	return alerts
+}
+
+func (c *containerAlerts) evaluate(rule alertRule, value float64, now time.Time) *alert {
+	if value <= rule.threshold {
+		delete(c.pending, rule.metric)
+		if c.firing[rule.metric] {
+			delete(c.firing, rule.metric)
+			return &alert{c.id, rule, value, false, now}
+		}
+		return nil
+	}
+
+	since, ok := c.pending[rule.metric]
+	if !ok {
+		since = now
+		c.pending[rule.metric] = now
+	}
+	if !c.firing[rule.metric] && now.Sub(since) >= rule.duration {
+		c.firing[rule.metric] = true
+		return &alert{c.id, rule, value, true, now}
+	}
+	return nil
+}
+
+// resolveStats resolves the alerts on metrics from the stats stream, when the
+// stream ends because the container stopped. Restart alerts are left to their
+// window, as the container may be about to restart again.
+func (c *containerAlerts) resolveStats(now time.Time) []alert {
+	alerts := []alert{}
+	for _, rule := range c.rules {
+		if rule.metric == alertRestarts {
+			continue
+		}
+		delete(c.pending, rule.metric)
+		if c.firing[rule.metric] {
+			delete(c.firing, rule.metric)
+			alerts = append(alerts, alert{c.id, rule, 0, false, now})
+		}
+	}
+	c.prev = nil
+	return alerts
+}
+
+// resolveAll resolves every firing alert, when the container's removed.
+func (c *containerAlerts) resolveAll(now time.Time) []alert {
+	alerts := []alert{}
+	for _, rule := range c.rules {
+		if c.firing[rule.metric] {
+			alerts = append(alerts, alert{c.id, rule, 0, false, now})
+		}
+	}
+	c.firing = map[string]bool{}
+	return alerts
+}
+
+// StartAlerts evaluates the --alert-rules and container alert labels against
+// the stats of every running container, and publishes an event to Rancher
+// when one fires or resolves. It does nothing without a Rancher client.
+func StartAlerts(rancher *rclient.RancherClient) error {
+	if rancher == nil {
+		return nil
+	}
+	defaults, err := parseAlertRules(config.Config.AlertRules)
+	if err != nil {
+		return err
+	}
+
+	eventsClient, err := events.NewDockerClient()
+	if err != nil {
+		return err
+	}
+	listen := func() (<-chan *dockerClient.APIEvents, error) {
+		listener := make(chan *dockerClient.APIEvents, 10)
+		if err := eventsClient.AddEventListener(listener); err != nil {
+			return nil, err
+		}
+		return listener, nil
+	}
+	containerEvents, err := listen()
+	if err != nil {
+		return err
+	}
+
+	queue := startAlertQueue(alertQueueSize, func(a alert) error {
+		_, err := rancher.Publish.Create(alertEvent(a))
+		return err
+	})
+	go runAlerts(statsHub, defaults, listContainers, containerEvents, listen, queue.add)
+	return nil
+}
+
+// alertQueue sends alerts in the background, so that a slow Rancher API
+// doesn't hold up evaluating rules. Alerts are dropped while it's full.
+type alertQueue chan alert
+
+func startAlertQueue(size int, send func(alert) error) alertQueue {
+	q := make(alertQueue, size)
+	go func() {
+		for a := range q {
+			if err := send(a); err != nil {
+				log.WithFields(log.Fields{"error": err, "id": a.container, "metric": a.rule.metric}).Error("Couldn't send alert.")
+			}
+		}
+	}()
+	return q
+}
+
+func (q alertQueue) add(a alert) {
+	select {
+	case q <- a:
+	default:
+		log.WithFields(log.Fields{"id": a.container, "metric": a.rule.metric}).Warn("Too many alerts waiting to be sent, dropping one.")
+	}
+}
+
+func runAlerts(h *hub, defaults []alertRule, list func() ([]types.Container, error), containerEvents <-chan *dockerClient.APIEvents, listen func() (<-chan *dockerClient.APIEvents, error), send func(alert)) {
+	tracked := map[string]*containerAlerts{}
+	sendAll := func(alerts []alert) {
+		for _, a := range alerts {
+			send(a)
+		}
+	}
+	subscribe := func(c *containerAlerts) {
+		if c.sub != nil || !c.needsStats() {
+			return
+		}
+		sub, err := h.subscribe(c.id)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "id": c.id}).Debug("Couldn't get stats for alerts.")
+			return
+		}
+		c.sub = sub
+	}
+	// update tracks the running containers that aren't yet, such as those
+	// started since the last list.
+	update := func() {
+		containers, err := list()
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Warn("Couldn't list containers for alerts.")
+			return
+		}
+		for _, container := range containers {
+			c, ok := tracked[container.ID]
+			if !ok {
+				c = newContainerAlerts(container.ID, containerAlertRules(defaults, container.ID, container.Labels))
+				c.running = true
+				tracked[container.ID] = c
+			}
+			subscribe(c)
+		}
+	}
+
+	update()
+	check := time.NewTicker(alertCheckInterval)
+	defer check.Stop()
+	listTicker := time.NewTicker(alertListInterval)
+	defer listTicker.Stop()
+	var relisten <-chan time.Time
+	retry := alertEventsRetry
+	for {
+		select {
+		case <-check.C:
+			now := time.Now()
+			for _, c := range tracked {
+				sendAll(c.checkRestarts(now))
+				if c.sub == nil {
+					continue
+				}
+				if stats, seq := c.sub.Latest(); stats != nil && seq != c.seq {
+					c.seq = seq
+					sendAll(c.observe(stats, now))
+				}
+				// A stopped container's stream ends, and it's subscribed to
+				// again if it comes back.
+				select {
+				case <-c.sub.Done():
+					c.sub.Close()
+					c.sub = nil
+					sendAll(c.resolveStats(now))
+				default:
+				}
+			}
+		case <-listTicker.C:
+			update()
+		case <-relisten:
+			relisten = nil
+			listener, err := listen()
+			if err != nil {
+				log.WithFields(log.Fields{"error": err}).Warn("Couldn't listen to docker events for alerts.")
+				if retry *= 2; retry > alertEventsRetryMax {
+					retry = alertEventsRetryMax
+				}
+				relisten = time.After(retry)
+				continue
+			}
+			containerEvents = listener
+			retry = alertEventsRetry
+			// Starts and restarts were missed in the meantime.
+			update()
+		case event, ok := <-containerEvents:
+			if !ok {
+				// The docker client closes listeners when the daemon's event
+				// stream ends, like when it restarts.
+				log.Info("Docker events ended, listening again for alerts.")
+				containerEvents = nil
+				relisten = time.After(retry)
+				continue
+			}
+			if event == nil {
+				continue
+			}
+			c, ok := tracked[event.ID]
+			if !ok {
+				// A new container's first start isn't a restart, it's
+				// tracked from when it's running.
+				if event.Status == "start" {
+					update()
+				}
+				continue
+			}
+			switch event.Status {
+			case "start":
+				// The list may have found it running before its start
+				// event came in.
+				if !c.running {
+					c.started(time.Now())
+					c.running = true
+				}
+				subscribe(c)
+			case "die":
+				c.running = false
+			case "destroy":
+				sendAll(c.resolveAll(time.Now()))
+				if c.sub != nil {
+					c.sub.Close()
+				}
+				delete(tracked, event.ID)
+			}
+		}
+	}
+}
+
+// alertEvent is the event published for an alert. It goes out as a Publish
+// rather than a ContainerEvent, since Rancher takes a ContainerEvent's
+// externalStatus as the container's new state. The event is named
+// container.alert.firing or container.alert.resolved, and its data holds the
+// hostUuid, the container's externalId, and the alert's metric, threshold,
+// duration in seconds and the value that fired or resolved it.
+func alertEvent(a alert) *rclient.Publish {
+	name := alertEventResolved
+	if a.firing {
+		name = alertEventFiring
+	}
+	return &rclient.Publish{
+		Name:      name,
+		Publisher: alertPublisher,
+		Time:      a.time.UnixNano() / int64(time.Millisecond),
+		Data: map[string]interface{}{
+			"hostUuid":   config.Config.HostUuid,
+			"externalId": a.container,
+			"alert": map[string]interface{}{
+				"metric":    a.rule.metric,
+				"threshold": a.rule.threshold,
+				"duration":  a.rule.duration.Seconds(),
+				"value":     a.value,
+			},
+		},
+	}
+}
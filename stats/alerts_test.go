@@ -0,0 +1,266 @@
+package stats
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/docker/engine-api/types"
+	dockerClient "github.com/fsouza/go-dockerclient"
+)
+
+func TestParseAlertRules(t *testing.T) {
+	rules, err := parseAlertRules("memory_percent>90:60s, cpu_throttled_percent>50,restarts>3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []alertRule{
+		{alertMemoryPercent, 90, time.Minute},
+		{alertCpuThrottledPercent, 50, 0},
+		{alertRestarts, 3, defaultRestartWindow},
+	}
+	if len(rules) != len(expected) {
+		t.Fatalf("Got %+v, expected %+v", rules, expected)
+	}
+	for i := range expected {
+		if rules[i] != expected[i] {
+			t.Errorf("Got %+v, expected %+v", rules[i], expected[i])
+		}
+	}
+
+	for _, spec := range []string{"memory_percent", "disk_percent>90", "memory_percent>high", "memory_percent>90:soon"} {
+		if _, err := parseAlertRules(spec); err == nil {
+			t.Errorf("Expected an error for %s", spec)
+		}
+	}
+}
+
+func TestContainerAlertRules(t *testing.T) {
+	defaults := []alertRule{
+		{alertMemoryPercent, 90, time.Minute},
+		{alertRestarts, 3, defaultRestartWindow},
+	}
+	rules := containerAlertRules(defaults, "c1", map[string]string{
+		alertLabelPrefix + alertCpuThrottledPercent: "25:10s",
+		alertLabelPrefix + alertMemoryPercent:       "80",
+		alertLabelPrefix + alertRestarts:            alertRuleOff,
+		alertLabelPrefix + "bogus":                  "1",
+		"io.rancher.stack.name":                     "web",
+	})
+	expected := []alertRule{
+		{alertCpuThrottledPercent, 25, 10 * time.Second},
+		{alertMemoryPercent, 80, 0},
+	}
+	if len(rules) != len(expected) || rules[0] != expected[0] || rules[1] != expected[1] {
+		t.Errorf("Got %+v, expected %+v", rules, expected)
+	}
+}
+
+func TestContainerAlertsMemory(t *testing.T) {
+	c := newContainerAlerts("c1", []alertRule{{alertMemoryPercent, 90, time.Minute}})
+	sample := func(workingSet uint64) *containerStats {
+		stats := &containerStats{}
+		stats.Memory.WorkingSet = workingSet
+		stats.Memory.Limit = 1000
+		return stats
+	}
+	start := time.Now()
+
+	if alerts := c.observe(sample(950), start); len(alerts) != 0 {
+		t.Errorf("Fired before the duration %+v", alerts)
+	}
+	if alerts := c.observe(sample(960), start.Add(30*time.Second)); len(alerts) != 0 {
+		t.Errorf("Fired before the duration %+v", alerts)
+	}
+	alerts := c.observe(sample(970), start.Add(time.Minute))
+	if len(alerts) != 1 || !alerts[0].firing || alerts[0].value != 97 {
+		t.Fatalf("Expected the alert to fire, got %+v", alerts)
+	}
+	if alerts := c.observe(sample(980), start.Add(2*time.Minute)); len(alerts) != 0 {
+		t.Errorf("Fired again %+v", alerts)
+	}
+	alerts = c.observe(sample(500), start.Add(3*time.Minute))
+	if len(alerts) != 1 || alerts[0].firing {
+		t.Fatalf("Expected the alert to resolve, got %+v", alerts)
+	}
+
+	// Dropping under the threshold starts the duration again.
+	c.observe(sample(950), start.Add(4*time.Minute))
+	c.observe(sample(500), start.Add(4*time.Minute+30*time.Second))
+	if alerts := c.observe(sample(950), start.Add(5*time.Minute)); len(alerts) != 0 {
+		t.Errorf("Fired without staying over the threshold %+v", alerts)
+	}
+}
+
+func TestContainerAlertsThrottling(t *testing.T) {
+	c := newContainerAlerts("c1", []alertRule{{alertCpuThrottledPercent, 50, 0}})
+	sample := func(periods, throttled uint64) *containerStats {
+		stats := &containerStats{}
+		stats.Cpu.Throttling.Periods = periods
+		stats.Cpu.Throttling.ThrottledPeriods = throttled
+		return stats
+	}
+	now := time.Now()
+
+	if alerts := c.observe(sample(100, 90), now); len(alerts) != 0 {
+		t.Errorf("Fired without a previous sample %+v", alerts)
+	}
+	alerts := c.observe(sample(200, 160), now.Add(time.Second))
+	if len(alerts) != 1 || !alerts[0].firing || alerts[0].value != 70 {
+		t.Fatalf("Expected the alert to fire, got %+v", alerts)
+	}
+	alerts = c.observe(sample(300, 170), now.Add(2*time.Second))
+	if len(alerts) != 1 || alerts[0].firing {
+		t.Fatalf("Expected the alert to resolve, got %+v", alerts)
+	}
+}
+
+func TestContainerAlertsRestarts(t *testing.T) {
+	c := newContainerAlerts("c1", []alertRule{{alertRestarts, 2, time.Minute}})
+	if c.needsStats() {
+		t.Error("Restart rules don't need stats")
+	}
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		c.started(now.Add(time.Duration(i) * time.Second))
+	}
+	alerts := c.checkRestarts(now.Add(3 * time.Second))
+	if len(alerts) != 1 || !alerts[0].firing || alerts[0].value != 3 || alerts[0].rule.duration != time.Minute {
+		t.Fatalf("Expected the alert to fire, got %+v", alerts)
+	}
+
+	alerts = c.checkRestarts(now.Add(2 * time.Minute))
+	if len(alerts) != 1 || alerts[0].firing {
+		t.Fatalf("Expected the alert to resolve, got %+v", alerts)
+	}
+	if len(c.starts) != 0 {
+		t.Errorf("Expected old starts to be dropped, got %v", c.starts)
+	}
+}
+
+func TestAlertEvent(t *testing.T) {
+	now := time.Now()
+	event := alertEvent(alert{"c1", alertRule{alertMemoryPercent, 90, time.Minute}, 95, true, now})
+	if event.Name != alertEventFiring || event.Data["externalId"] != "c1" || event.Time != now.UnixNano()/int64(time.Millisecond) {
+		t.Errorf("Wrong event %+v", event)
+	}
+	data, _ := event.Data["alert"].(map[string]interface{})
+	if data["metric"] != alertMemoryPercent || data["value"] != 95.0 || data["duration"] != 60.0 {
+		t.Errorf("Wrong alert data %+v", event.Data)
+	}
+}
+
+func TestAlertsListenAgainWhenEventsEnd(t *testing.T) {
+	closed := make(chan *dockerClient.APIEvents)
+	close(closed)
+	listened := make(chan struct{}, 1)
+	listen := func() (<-chan *dockerClient.APIEvents, error) {
+		listened <- struct{}{}
+		return make(chan *dockerClient.APIEvents), nil
+	}
+	list := func() ([]types.Container, error) {
+		return nil, nil
+	}
+	go runAlerts(newHub(nil), nil, list, closed, listen, func(alert) {})
+
+	select {
+	case <-listened:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected to listen to docker events again")
+	}
+}
+
+func TestAlertQueueDropsWhenFull(t *testing.T) {
+	block := make(chan struct{})
+	sent := make(chan alert, 10)
+	q := startAlertQueue(1, func(a alert) error {
+		<-block
+		sent <- a
+		return nil
+	})
+	for i := 0; i < 5; i++ {
+		q.add(alert{container: strconv.Itoa(i)})
+	}
+	close(block)
+	close(q)
+
+	time.Sleep(100 * time.Millisecond)
+	if len(sent) > 2 {
+		t.Errorf("Expected alerts to be dropped while the queue was full, %d were sent", len(sent))
+	}
+	if len(sent) == 0 {
+		t.Error("Expected an alert to be sent")
+	}
+}
+
+func TestAlertsCountOnlyRestarts(t *testing.T) {
+	containerEvents := make(chan *dockerClient.APIEvents)
+	listen := func() (<-chan *dockerClient.APIEvents, error) {
+		return make(chan *dockerClient.APIEvents), nil
+	}
+	list := func() ([]types.Container, error) {
+		return []types.Container{{ID: "c1"}}, nil
+	}
+	sent := make(chan alert, 10)
+	rules := []alertRule{{alertRestarts, 0, time.Minute}}
+	go runAlerts(newHub(nil), rules, list, containerEvents, listen, func(a alert) {
+		sent <- a
+	})
+
+	// The list found c1 running, so its start event isn't a restart.
+	containerEvents <- &dockerClient.APIEvents{ID: "c1", Status: "start"}
+	select {
+	case a := <-sent:
+		t.Fatalf("Expected the first start not to count, got %+v", a)
+	case <-time.After(2 * alertCheckInterval):
+	}
+
+	containerEvents <- &dockerClient.APIEvents{ID: "c1", Status: "die"}
+	containerEvents <- &dockerClient.APIEvents{ID: "c1", Status: "start"}
+	select {
+	case a := <-sent:
+		if !a.firing || a.value != 1 {
+			t.Errorf("Expected one restart to fire, got %+v", a)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the restart to fire")
+	}
+}
+
+func TestAlertsResolveWhenStreamEnds(t *testing.T) {
+	reader := newFakeReader()
+	h := newHub(func(id string) (containerReader, error) {
+		return reader, nil
+	})
+	list := func() ([]types.Container, error) {
+		return []types.Container{{ID: "c1"}}, nil
+	}
+	sent := make(chan alert, 10)
+	rules := []alertRule{{alertMemoryPercent, 50, 0}}
+	go runAlerts(h, rules, list, make(chan *dockerClient.APIEvents), nil, func(a alert) {
+		sent <- a
+	})
+
+	stats := &containerStats{}
+	stats.Memory.WorkingSet = 90
+	stats.Memory.Limit = 100
+	reader.samples <- stats
+	select {
+	case a := <-sent:
+		if !a.firing {
+			t.Fatalf("Expected the alert to fire, got %+v", a)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the alert to fire")
+	}
+
+	close(reader.samples)
+	select {
+	case a := <-sent:
+		if a.firing || a.rule.metric != alertMemoryPercent {
+			t.Errorf("Expected the alert to resolve, got %+v", a)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the alert to resolve once the stream ended")
+	}
+}
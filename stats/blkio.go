@@ -0,0 +1,143 @@
+package stats
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/shirou/gopsutil/disk"
+)
+
+// Device names by major:minor, which don't change while the device exists.
+var (
+	deviceNamesLock sync.Mutex
+	deviceNames     = map[string]string{}
+)
+
+// deviceName resolves a block device's name from /sys/dev/block, or returns
+// "" if it can't be found. Devices that aren't found aren't cached, since they
+// may just not be there yet.
+func deviceName(major, minor uint64) string {
+	key := fmt.Sprintf("%d:%d", major, minor)
+
+	deviceNamesLock.Lock()
+	defer deviceNamesLock.Unlock()
+	if name, ok := deviceNames[key]; ok {
+		return name
+	}
+
+	target, err := os.Readlink(hostSys("dev", "block", key))
+	if err != nil {
+		return ""
+	}
+	name := filepath.Base(target)
+	deviceNames[key] = name
+	return name
+}
+
+// deviceNumbers reads a block device's major and minor numbers from sysfs.
+func deviceNumbers(name string) (uint64, uint64, error) {
+	data, err := ioutil.ReadFile(hostSys("class", "block", name, "dev"))
+	if err != nil {
+		return 0, 0, err
+	}
+	var major, minor uint64
+	if _, err := fmt.Sscanf(strings.TrimSpace(string(data)), "%d:%d", &major, &minor); err != nil {
+		return 0, 0, err
+	}
+	return major, minor, nil
+}
+
+type byDevice []PerDiskStats
+
+func (s byDevice) Len() int      { return len(s) }
+func (s byDevice) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byDevice) Less(i, j int) bool {
+	if s[i].Major != s[j].Major {
+		return s[i].Major < s[j].Major
+	}
+	return s[i].Minor < s[j].Minor
+}
+
+// perDiskStats groups blkio records, which have one operation each, into an
+// entry per device.
+func perDiskStats(records []blkioRecord) []PerDiskStats {
+	devices := map[[2]uint64]*PerDiskStats{}
+	for _, record := range records {
+		key := [2]uint64{uint64(record.Major), uint64(record.Minor)}
+		device, ok := devices[key]
+		if !ok {
+			device = &PerDiskStats{
+				Major:  key[0],
+				Minor:  key[1],
+				Device: deviceName(key[0], key[1]),
+				Stats:  map[string]uint64{},
+			}
+			devices[key] = device
+		}
+		device.Stats[record.Op] += uint64(record.Value)
+	}
+
+	result := []PerDiskStats{}
+	for _, device := range devices {
+		result = append(result, *device)
+	}
+	sort.Sort(byDevice(result))
+	return result
+}
+
+// hostDiskIo returns the host's IO stats for each whole disk. Partitions are
+// left out so that nothing is counted twice, as are disks that have never
+// been used.
+func hostDiskIo(counters map[string]disk.IOCountersStat) DiskIoStats {
+	stats := DiskIoStats{
+		IoServiceBytes: []PerDiskStats{},
+		IoServiced:     []PerDiskStats{},
+		IoQueued:       []PerDiskStats{},
+		IoServiceTime:  []PerDiskStats{},
+	}
+	for name, counter := range counters {
+		if _, err := os.Stat(hostSys("block", name)); err != nil {
+			continue
+		}
+		if counter.ReadCount == 0 && counter.WriteCount == 0 {
+			continue
+		}
+		major, minor, err := deviceNumbers(name)
+		if err != nil {
+			continue
+		}
+
+		device := func(values map[string]uint64) PerDiskStats {
+			return PerDiskStats{Major: major, Minor: minor, Device: name, Stats: values}
+		}
+		stats.IoServiceBytes = append(stats.IoServiceBytes, device(map[string]uint64{
+			"Read":  counter.ReadBytes,
+			"Write": counter.WriteBytes,
+			"Total": counter.ReadBytes + counter.WriteBytes,
+		}))
+		stats.IoServiced = append(stats.IoServiced, device(map[string]uint64{
+			"Read":  counter.ReadCount,
+			"Write": counter.WriteCount,
+			"Total": counter.ReadCount + counter.WriteCount,
+		}))
+		stats.IoQueued = append(stats.IoQueued, device(map[string]uint64{
+			"Total": counter.IopsInProgress,
+		}))
+		// The kernel counts milliseconds.
+		stats.IoServiceTime = append(stats.IoServiceTime, device(map[string]uint64{
+			"Read":  counter.ReadTime * 1000000,
+			"Write": counter.WriteTime * 1000000,
+			"Total": (counter.ReadTime + counter.WriteTime) * 1000000,
+		}))
+	}
+	sort.Sort(byDevice(stats.IoServiceBytes))
+	sort.Sort(byDevice(stats.IoServiced))
+	sort.Sort(byDevice(stats.IoQueued))
+	sort.Sort(byDevice(stats.IoServiceTime))
+	return stats
+}
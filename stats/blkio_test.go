@@ -0,0 +1,86 @@
+package stats
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shirou/gopsutil/disk"
+)
+
+func fakeSys(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "sys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"dev/block", "block/sdz", "class/block/sdz", "class/block/sdz1"} {
+		if err := os.MkdirAll(filepath.Join(dir, path), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ioutil.WriteFile(filepath.Join(dir, "class/block/sdz/dev"), []byte("250:0\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "class/block/sdz1/dev"), []byte("250:1\n"), 0644)
+	os.Symlink("../../devices/virtual/block/sdz", filepath.Join(dir, "dev/block/250:0"))
+	return dir
+}
+
+func TestPerDiskStats(t *testing.T) {
+	dir := fakeSys(t)
+	defer os.RemoveAll(dir)
+	os.Setenv("HOST_SYS", dir)
+	defer os.Unsetenv("HOST_SYS")
+
+	records := []blkioRecord{
+		{Major: 250, Minor: 0, Op: "Read", Value: 10},
+		{Major: 251, Minor: 0, Op: "Read", Value: 1},
+		{Major: 250, Minor: 0, Op: "Write", Value: 20},
+	}
+	devices := perDiskStats(records)
+	if len(devices) != 2 {
+		t.Fatalf("Expected 2 devices, got %d", len(devices))
+	}
+	if devices[0].Major != 250 || devices[0].Device != "sdz" || devices[0].Stats["Read"] != 10 || devices[0].Stats["Write"] != 20 {
+		t.Errorf("Wrong stats for first device %+v", devices[0])
+	}
+	if devices[1].Major != 251 || devices[1].Device != "" {
+		t.Errorf("Wrong stats for second device %+v", devices[1])
+	}
+}
+
+func TestHostDiskIo(t *testing.T) {
+	dir := fakeSys(t)
+	defer os.RemoveAll(dir)
+	os.Setenv("HOST_SYS", dir)
+	defer os.Unsetenv("HOST_SYS")
+
+	stats := hostDiskIo(map[string]disk.IOCountersStat{
+		"sdz":  {Name: "sdz", ReadCount: 2, WriteCount: 3, ReadBytes: 100, WriteBytes: 200, ReadTime: 4},
+		"sdz1": {Name: "sdz1", ReadCount: 2, WriteCount: 3, ReadBytes: 100, WriteBytes: 200},
+	})
+	if len(stats.IoServiceBytes) != 1 {
+		t.Fatalf("Expected only the whole disk, got %+v", stats.IoServiceBytes)
+	}
+	bytes := stats.IoServiceBytes[0]
+	if bytes.Device != "sdz" || bytes.Major != 250 || bytes.Stats["Total"] != 300 {
+		t.Errorf("Wrong bytes %+v", bytes)
+	}
+	if stats.IoServiced[0].Stats["Write"] != 3 || stats.IoServiceTime[0].Stats["Read"] != 4000000 {
+		t.Errorf("Wrong IO counts or times %+v %+v", stats.IoServiced[0], stats.IoServiceTime[0])
+	}
+}
+
+func TestDeviceNameRetriesMisses(t *testing.T) {
+	dir := fakeSys(t)
+	defer os.RemoveAll(dir)
+	os.Setenv("HOST_SYS", dir)
+	defer os.Unsetenv("HOST_SYS")
+
+	if name := deviceName(252, 0); name != "" {
+		t.Fatalf("Expected no name before the device shows up, got %s", name)
+	}
+	os.Symlink("../../devices/virtual/block/sdy", filepath.Join(dir, "dev/block/252:0"))
+	if name := deviceName(252, 0); name != "sdy" {
+		t.Errorf("Expected sdy once the device shows up, got [%s]", name)
+	}
+}
@@ -0,0 +1,362 @@
+package stats
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cadvisorApiV1 = "v1.3"
+	cadvisorApiV2 = "v2.0"
+
+	// cAdvisor reports no limit as the largest value the kernel takes, which
+	// is reported as no limit here.
+	cadvisorNoLimit = uint64(1) << 62
+)
+
+// cadvisorSource reads the host and containers from a cAdvisor, with either
+// its v1 or its v2 API.
+type cadvisorSource struct {
+	client *cadvisorClient
+}
+
+func newCadvisorSource(cadvisorUrl, api string) (*cadvisorSource, error) {
+	if api != cadvisorApiV1 && api != cadvisorApiV2 {
+		return nil, fmt.Errorf("Unsupported cAdvisor API %s", api)
+	}
+	if _, err := url.Parse(cadvisorUrl); err != nil {
+		return nil, err
+	}
+	return &cadvisorSource{
+		client: &cadvisorClient{
+			url:  strings.TrimSuffix(cadvisorUrl, "/"),
+			api:  api,
+			http: &http.Client{Timeout: 10 * time.Second},
+		},
+	}, nil
+}
+
+// openHost reads the root container from cAdvisor, with the filesystems
+// collected the same way as with the docker backend.
+func (s *cadvisorSource) openHost() (containerReader, error) {
+	reader, err := s.open(hostStreamId)
+	if err != nil {
+		return nil, err
+	}
+	return newFsReader(reader, hostStreamId, hostFsInterval, func(string) ([]FsStats, error) {
+		return getFsStats()
+	}), nil
+}
+
+func (s *cadvisorSource) openContainer(id string) (containerReader, error) {
+	return s.open(id)
+}
+
+func (s *cadvisorSource) open(id string) (containerReader, error) {
+	spec, err := s.client.spec(id)
+	if err != nil {
+		return nil, err
+	}
+	reader := &cadvisorReader{
+		client: s.client,
+		id:     id,
+		closed: make(chan struct{}),
+	}
+	reader.cpuLimit = cpuLimit(spec.Cpu.Quota, spec.Cpu.Period)
+	if spec.Memory.Limit < cadvisorNoLimit {
+		reader.memLimit = spec.Memory.Limit
+	}
+	if id == hostStreamId {
+		if reader.memLimit, err = getMemCapcity(); err != nil {
+			return nil, err
+		}
+	}
+	return reader, nil
+}
+
+// cadvisorReader polls cAdvisor for the latest sample of a container, or of
+// the root container for the host, skipping samples it's already read.
+type cadvisorReader struct {
+	client   *cadvisorClient
+	id       string
+	cpuLimit uint64
+	memLimit uint64
+	last     time.Time
+	started  bool
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func (r *cadvisorReader) Next() (*containerStats, error) {
+	for {
+		if r.started {
+			select {
+			case <-time.After(hostSampleInterval):
+			case <-r.closed:
+				return nil, errReaderClosed
+			}
+		}
+		r.started = true
+
+		sample, err := r.client.latest(r.id)
+		if err != nil {
+			return nil, err
+		}
+		if sample == nil || !sample.Timestamp.After(r.last) {
+			continue
+		}
+		r.last = sample.Timestamp
+
+		stats := sample.convert()
+		stats.Cpu.Limit = r.cpuLimit
+		stats.Memory.Limit = r.memLimit
+		if r.id == hostStreamId {
+			addHostExtras(stats)
+		}
+		return stats, nil
+	}
+}
+
+func (r *cadvisorReader) Close() error {
+	r.once.Do(func() {
+		close(r.closed)
+	})
+	return nil
+}
+
+// addHostExtras makes the root container look like the host stream of the
+// docker backend: virtual interfaces are left out, and what cAdvisor doesn't
+// report is read from the host.
+func addHostExtras(stats *containerStats) {
+	interfaces := []InterfaceStats{}
+	for _, iface := range stats.Network.Interfaces {
+		if !isVirtualInterface(iface.Name) {
+			interfaces = append(interfaces, iface)
+		}
+	}
+	stats.Network.Interfaces = interfaces
+	stats.Network.Tcp, _ = getHostTcpStats()
+	stats.Load, _ = getLoadStats()
+	stats.Pressure, _ = getHostPressure()
+	stats.FileDescriptors, _ = getFdStats()
+	stats.Uptime, _ = getUptime()
+}
+
+type cadvisorSpec struct {
+	Cpu struct {
+		Quota  int64 `json:"quota"`
+		Period int64 `json:"period"`
+	} `json:"cpu"`
+	Memory struct {
+		Limit uint64 `json:"limit"`
+	} `json:"memory"`
+}
+
+// cadvisorInfo is a container as returned by the v1 API.
+type cadvisorInfo struct {
+	Spec  cadvisorSpec     `json:"spec"`
+	Stats []*cadvisorStats `json:"stats"`
+}
+
+// cadvisorStats is the part of a cAdvisor sample that's reported. The v1 and
+// v2 APIs mostly share the layout, which containerStats follows.
+type cadvisorStats struct {
+	Timestamp time.Time `json:"timestamp"`
+	Cpu       struct {
+		Usage CpuUsage       `json:"usage"`
+		Cfs   ThrottlingData `json:"cfs"`
+	} `json:"cpu"`
+	DiskIo DiskIoStats `json:"diskio"`
+	Memory struct {
+		MemoryStats
+		ContainerData struct {
+			Pgfault    uint64 `json:"pgfault"`
+			Pgmajfault uint64 `json:"pgmajfault"`
+		} `json:"container_data"`
+	} `json:"memory"`
+	// v2 only has the interfaces.
+	Network struct {
+		InterfaceStats
+		Interfaces []InterfaceStats `json:"interfaces"`
+	} `json:"network"`
+	// A list of filesystems with v1, and the usage of the writable layer with
+	// v2.
+	Filesystem json.RawMessage `json:"filesystem"`
+	Processes  struct {
+		ProcessCount uint64 `json:"process_count"`
+	} `json:"processes"`
+}
+
+func (s *cadvisorStats) convert() *containerStats {
+	stats := &containerStats{
+		Timestamp: s.Timestamp,
+		DiskIo:    s.DiskIo,
+		Memory:    s.Memory.MemoryStats,
+	}
+	stats.Cpu.Usage = s.Cpu.Usage
+	stats.Cpu.Throttling = s.Cpu.Cfs
+	stats.Memory.Pgfault = s.Memory.ContainerData.Pgfault
+	stats.Memory.Pgmajfault = s.Memory.ContainerData.Pgmajfault
+	stats.Network.InterfaceStats = s.Network.InterfaceStats
+	stats.Network.Interfaces = s.Network.Interfaces
+	if s.Processes.ProcessCount > 0 {
+		stats.Pids = &PidsStats{Current: s.Processes.ProcessCount}
+	}
+	stats.Filesystem = cadvisorFilesystem(s.Filesystem)
+
+	for _, devices := range [][]PerDiskStats{
+		stats.DiskIo.IoServiceBytes,
+		stats.DiskIo.IoServiced,
+		stats.DiskIo.IoQueued,
+		stats.DiskIo.IoServiceTime,
+		stats.DiskIo.IoWaitTime,
+	} {
+		for i := range devices {
+			if devices[i].Device == "" {
+				devices[i].Device = deviceName(devices[i].Major, devices[i].Minor)
+			}
+		}
+	}
+	return stats
+}
+
+func cadvisorFilesystem(raw json.RawMessage) []FsStats {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 {
+		return nil
+	}
+	if raw[0] == '[' {
+		filesystems := []FsStats{}
+		if err := json.Unmarshal(raw, &filesystems); err != nil {
+			return nil
+		}
+		return filesystems
+	}
+
+	var layer struct {
+		TotalUsageBytes *uint64 `json:"totalUsageBytes"`
+	}
+	if err := json.Unmarshal(raw, &layer); err != nil || layer.TotalUsageBytes == nil {
+		return nil
+	}
+	return []FsStats{{
+		Mountpoint: "/",
+		Type:       fsTypeRootfs,
+		Usage:      *layer.TotalUsageBytes,
+	}}
+}
+
+// cadvisorClient gets the spec and the latest sample of a docker container,
+// or of the root container when the id is empty.
+type cadvisorClient struct {
+	url  string
+	api  string
+	http *http.Client
+}
+
+func (c *cadvisorClient) spec(id string) (*cadvisorSpec, error) {
+	if c.api == cadvisorApiV1 {
+		info, err := c.infoV1(id, 0)
+		if err != nil {
+			return nil, err
+		}
+		return &info.Spec, nil
+	}
+
+	specs := map[string]*cadvisorSpec{}
+	if err := c.get(c.pathV2("spec", id), &specs); err != nil {
+		return nil, err
+	}
+	for _, spec := range specs {
+		return spec, nil
+	}
+	return nil, fmt.Errorf("cAdvisor has no container %s", id)
+}
+
+func (c *cadvisorClient) latest(id string) (*cadvisorStats, error) {
+	var samples []*cadvisorStats
+	if c.api == cadvisorApiV1 {
+		info, err := c.infoV1(id, 1)
+		if err != nil {
+			return nil, err
+		}
+		samples = info.Stats
+	} else {
+		containers := map[string][]*cadvisorStats{}
+		if err := c.get(c.pathV2("stats", id)+"&count=1", &containers); err != nil {
+			return nil, err
+		}
+		found := false
+		for _, containerSamples := range containers {
+			samples, found = containerSamples, true
+		}
+		if !found {
+			return nil, fmt.Errorf("cAdvisor has no container %s", id)
+		}
+	}
+	if len(samples) == 0 {
+		return nil, nil
+	}
+	return samples[len(samples)-1], nil
+}
+
+// infoV1 gets a container with up to numStats samples. Docker containers
+// come back in a map keyed by their cgroup.
+func (c *cadvisorClient) infoV1(id string, numStats int) (*cadvisorInfo, error) {
+	body, err := json.Marshal(map[string]int{"num_stats": numStats})
+	if err != nil {
+		return nil, err
+	}
+	if id == hostStreamId {
+		info := &cadvisorInfo{}
+		return info, c.post("/api/"+c.api+"/containers/", body, info)
+	}
+
+	containers := map[string]*cadvisorInfo{}
+	if err := c.post("/api/"+c.api+"/docker/"+id, body, &containers); err != nil {
+		return nil, err
+	}
+	for _, info := range containers {
+		return info, nil
+	}
+	return nil, fmt.Errorf("cAdvisor has no container %s", id)
+}
+
+func (c *cadvisorClient) pathV2(request, id string) string {
+	if id == hostStreamId {
+		return "/api/" + c.api + "/" + request + "?type=name"
+	}
+	return "/api/" + c.api + "/" + request + "/" + id + "?type=docker"
+}
+
+func (c *cadvisorClient) get(path string, value interface{}) error {
+	resp, err := c.http.Get(c.url + path)
+	if err != nil {
+		return err
+	}
+	return decodeCadvisorResponse(resp, value)
+}
+
+func (c *cadvisorClient) post(path string, body []byte, value interface{}) error {
+	resp, err := c.http.Post(c.url+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	return decodeCadvisorResponse(resp, value)
+}
+
+func decodeCadvisorResponse(resp *http.Response, value interface{}) error {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("cAdvisor returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return json.NewDecoder(resp.Body).Decode(value)
+}
@@ -0,0 +1,182 @@
+package stats
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testCadvisorStats = `{
+	"timestamp": "2017-01-02T03:04:05Z",
+	"cpu": {
+		"usage": {"total": 3000, "per_cpu_usage": [1000, 2000], "user": 2000, "system": 1000},
+		"cfs": {"periods": 10, "throttled_periods": 2, "throttled_time": 500}
+	},
+	"diskio": {
+		"io_service_bytes": [{"major": 8, "minor": 0, "stats": {"Read": 100, "Write": 200}}]
+	},
+	"memory": {
+		"usage": 1000,
+		"working_set": 700,
+		"rss": 500,
+		"container_data": {"pgfault": 30, "pgmajfault": 3}
+	},
+	"network": {
+		"name": "eth0",
+		"rx_bytes": 10,
+		"interfaces": [{"name": "eth0", "rx_bytes": 10, "tx_bytes": 20}]
+	},
+	"filesystem": %s,
+	"processes": {"process_count": 4}
+}`
+
+const testCadvisorSpec = `{
+	"cpu": {"limit": 1024, "quota": 50000, "period": 100000},
+	"memory": {"limit": 18446744073709551615}
+}`
+
+func testCadvisorSample(filesystem string) string {
+	return fmt.Sprintf(testCadvisorStats, filesystem)
+}
+
+func TestCadvisorV1(t *testing.T) {
+	sample := testCadvisorSample(`[{"device": "/dev/sda1", "type": "vfs", "capacity": 1000, "usage": 400}]`)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/api/v1.3/docker/abc" {
+			http.Error(w, "unknown container", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"/docker/abc": {"spec": ` + testCadvisorSpec + `, "stats": [` + sample + `]}}`))
+	}))
+	defer server.Close()
+
+	source, err := newCadvisorSource(server.URL+"/", cadvisorApiV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := source.openContainer("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	stats, err := reader.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !stats.Timestamp.Equal(time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("Wrong timestamp %v", stats.Timestamp)
+	}
+	if stats.Cpu.Usage.Total != 3000 || len(stats.Cpu.Usage.PerCpu) != 2 || stats.Cpu.Throttling.ThrottledTime != 500 || stats.Cpu.Limit != 500 {
+		t.Errorf("Wrong CPU %+v", stats.Cpu)
+	}
+	if stats.Memory.WorkingSet != 700 || stats.Memory.Pgmajfault != 3 || stats.Memory.Limit != 0 {
+		t.Errorf("Wrong memory %+v", stats.Memory)
+	}
+	if len(stats.DiskIo.IoServiceBytes) != 1 || stats.DiskIo.IoServiceBytes[0].Stats["Write"] != 200 {
+		t.Errorf("Wrong disk IO %+v", stats.DiskIo)
+	}
+	if len(stats.Network.Interfaces) != 1 || stats.Network.Interfaces[0].TxBytes != 20 {
+		t.Errorf("Wrong network %+v", stats.Network)
+	}
+	if len(stats.Filesystem) != 1 || stats.Filesystem[0].Limit != 1000 || stats.Pids.Current != 4 {
+		t.Errorf("Wrong filesystem %+v or pids %+v", stats.Filesystem, stats.Pids)
+	}
+
+	if _, err := source.openContainer("missing"); err == nil {
+		t.Error("Expected an error for a missing container")
+	}
+}
+
+func TestCadvisorV2(t *testing.T) {
+	requests := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("type") != "docker" {
+			http.Error(w, "unknown container", http.StatusInternalServerError)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v2.0/spec/abc":
+			w.Write([]byte(`{"/docker/abc": ` + testCadvisorSpec + `}`))
+		case "/api/v2.0/stats/abc":
+			atomic.AddInt32(&requests, 1)
+			w.Write([]byte(`{"/docker/abc": [` + testCadvisorSample(`{"totalUsageBytes": 2048}`) + `]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	source, err := newCadvisorSource(server.URL, cadvisorApiV2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := source.openContainer("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := reader.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Cpu.Usage.User != 2000 || stats.Memory.RSS != 500 {
+		t.Errorf("Wrong stats %+v", stats)
+	}
+	expected := FsStats{Mountpoint: "/", Type: fsTypeRootfs, Usage: 2048}
+	if len(stats.Filesystem) != 1 || stats.Filesystem[0] != expected {
+		t.Errorf("Got filesystem %+v, expected %+v", stats.Filesystem, expected)
+	}
+
+	// The same sample isn't read twice, so the next read waits until the
+	// reader is closed.
+	go func() {
+		time.Sleep(1500 * time.Millisecond)
+		reader.Close()
+	}()
+	if _, err := reader.Next(); err != errReaderClosed {
+		t.Errorf("Expected the reader to be closed, got %v", err)
+	}
+	if polled := atomic.LoadInt32(&requests); polled < 2 {
+		t.Errorf("Expected cAdvisor to be polled again, got %d requests", polled)
+	}
+}
+
+func TestNewCadvisorSourceChecksApi(t *testing.T) {
+	if _, err := newCadvisorSource("http://localhost:8081", "v3"); err == nil {
+		t.Error("Expected an error for an unknown API")
+	}
+}
+
+func TestCadvisorHostExtras(t *testing.T) {
+	dir, err := ioutil.TempDir("", "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("HOST_PROC", dir)
+	defer os.Unsetenv("HOST_PROC")
+	os.Setenv("HOST_SYS", dir)
+	defer os.Unsetenv("HOST_SYS")
+	writeFiles(t, dir, map[string]string{
+		"pressure/cpu": "some avg10=1.00 avg60=0.50 avg300=0.10 total=100\n",
+		"loadavg":      "0.50 0.25 0.10 1/100 1000\n",
+	})
+
+	stats := &containerStats{}
+	stats.Network.Interfaces = []InterfaceStats{{Name: "eth0"}, {Name: "docker0"}, {Name: "veth1234"}}
+	addHostExtras(stats)
+	if len(stats.Network.Interfaces) != 1 || stats.Network.Interfaces[0].Name != "eth0" {
+		t.Errorf("Expected only eth0, got %+v", stats.Network.Interfaces)
+	}
+	if stats.Pressure == nil || stats.Pressure.Cpu == nil || stats.Pressure.Cpu.Some.Total != 100 {
+		t.Errorf("Expected the host's pressure, got %+v", stats.Pressure)
+	}
+	if stats.Load == nil || stats.Load.Load1 != 0.5 {
+		t.Errorf("Expected the host's load, got %+v", stats.Load)
+	}
+}
@@ -0,0 +1,369 @@
+package stats
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/engine-api/client"
+	"golang.org/x/net/context"
+
+	"github.com/rancher/host-api/proc"
+)
+
+// cgroupPaths are the directories of a container's cgroups. With cgroup v1
+// there's one per controller, with the unified v2 hierarchy there's just the
+// one.
+type cgroupPaths struct {
+	unified bool
+	dirs    map[string]string
+}
+
+func (c *cgroupPaths) dir(controller string) string {
+	if c.unified {
+		return c.dirs[""]
+	}
+	return c.dirs[controller]
+}
+
+// findCgroups finds the cgroups of a process, from /proc/<pid>/cgroup.
+func findCgroups(pid int) (*cgroupPaths, error) {
+	data, err := ioutil.ReadFile(proc.Path(strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return nil, err
+	}
+	return parseCgroups(data, hostSys("fs", "cgroup"))
+}
+
+func parseCgroups(data []byte, root string) (*cgroupPaths, error) {
+	paths := &cgroupPaths{dirs: map[string]string{}}
+	unified := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[0] == "0" && parts[1] == "" {
+			unified = parts[2]
+			continue
+		}
+		// Controllers mounted together, like cpu,cpuacct, usually have a
+		// symlink for each of them.
+		for _, controller := range strings.Split(parts[1], ",") {
+			for _, mount := range []string{controller, parts[1]} {
+				dir := filepath.Join(root, mount, parts[2])
+				if _, err := os.Stat(dir); err == nil {
+					paths.dirs[controller] = dir
+					break
+				}
+			}
+		}
+	}
+
+	if len(paths.dirs) > 0 {
+		return paths, nil
+	}
+	if unified != "" {
+		dir := filepath.Join(root, unified)
+		if _, err := os.Stat(filepath.Join(dir, "cgroup.controllers")); err == nil {
+			paths.unified = true
+			paths.dirs[""] = dir
+			return paths, nil
+		}
+	}
+	return nil, fmt.Errorf("No cgroups found")
+}
+
+// cgroupReader samples a container's stats from its cgroup files instead of
+// the docker API.
+type cgroupReader struct {
+	cgroups  *cgroupPaths
+	network  *networkReader
+	cpuLimit uint64
+	started  bool
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func openCgroupReader(id string) (containerReader, error) {
+	dclient, err := client.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+	dclient.UpdateClientVersion("1.22")
+
+	inspect, err := dclient.ContainerInspect(context.Background(), id)
+	if err != nil {
+		return nil, err
+	}
+	if inspect.ContainerJSONBase == nil || inspect.State == nil || inspect.State.Pid == 0 {
+		return nil, fmt.Errorf("No running process for container %s", id)
+	}
+	cgroups, err := findCgroups(inspect.State.Pid)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := &cgroupReader{
+		cgroups: cgroups,
+		network: newNetworkReader(id, inspect.State.Pid),
+		closed:  make(chan struct{}),
+	}
+	if inspect.HostConfig != nil {
+		reader.cpuLimit = cpuLimit(inspect.HostConfig.CPUQuota, inspect.HostConfig.CPUPeriod)
+	}
+	return reader, nil
+}
+
+func (r *cgroupReader) Next() (*containerStats, error) {
+	if r.started {
+		select {
+		case <-time.After(hostSampleInterval):
+		case <-r.closed:
+			return nil, errReaderClosed
+		}
+	}
+	r.started = true
+
+	stats, err := readCgroupStats(r.cgroups)
+	if err != nil {
+		return nil, err
+	}
+	stats.Cpu.Limit = r.cpuLimit
+	r.network.read(stats)
+	return stats, nil
+}
+
+func (r *cgroupReader) Close() error {
+	r.once.Do(func() {
+		close(r.closed)
+	})
+	return nil
+}
+
+// readCgroupStats reads a sample from the cgroup files. The container is gone
+// once its cgroup is, which ends the stream.
+func readCgroupStats(cgroups *cgroupPaths) (*containerStats, error) {
+	stats := &containerStats{}
+	var err error
+	if cgroups.unified {
+		err = readCgroupV2(cgroups.dir(""), stats)
+	} else {
+		err = readCgroupV1(cgroups, stats)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func readCgroupV1(cgroups *cgroupPaths, stats *containerStats) error {
+	cpuacct := cgroups.dir("cpuacct")
+	total, err := readUint(filepath.Join(cpuacct, "cpuacct.usage"))
+	if err != nil {
+		return err
+	}
+	stats.Cpu.Usage.Total = total
+	stats.Cpu.Usage.PerCpu = []uint64{}
+	if data, err := ioutil.ReadFile(filepath.Join(cpuacct, "cpuacct.usage_percpu")); err == nil {
+		for _, field := range strings.Fields(string(data)) {
+			value, _ := strconv.ParseUint(field, 10, 64)
+			stats.Cpu.Usage.PerCpu = append(stats.Cpu.Usage.PerCpu, value)
+		}
+	}
+	if cpuStat, err := readKeyValues(filepath.Join(cpuacct, "cpuacct.stat")); err == nil {
+		stats.Cpu.Usage.User = cpuStat["user"] * uint64(time.Second) / proc.UserHz
+		stats.Cpu.Usage.System = cpuStat["system"] * uint64(time.Second) / proc.UserHz
+	}
+	if cpuStat, err := readKeyValues(filepath.Join(cgroups.dir("cpu"), "cpu.stat")); err == nil {
+		stats.Cpu.Throttling.Periods = cpuStat["nr_periods"]
+		stats.Cpu.Throttling.ThrottledPeriods = cpuStat["nr_throttled"]
+		stats.Cpu.Throttling.ThrottledTime = cpuStat["throttled_time"]
+	}
+
+	memory := cgroups.dir("memory")
+	if stats.Memory.Usage, err = readUint(filepath.Join(memory, "memory.usage_in_bytes")); err != nil {
+		return err
+	}
+	stats.Memory.MaxUsage, _ = readUint(filepath.Join(memory, "memory.max_usage_in_bytes"))
+	stats.Memory.Limit, _ = readUint(filepath.Join(memory, "memory.limit_in_bytes"))
+	stats.Memory.Failcnt, _ = readUint(filepath.Join(memory, "memory.failcnt"))
+	if memStat, err := readKeyValues(filepath.Join(memory, "memory.stat")); err == nil {
+		stats.Memory.Cache = memStat["total_cache"]
+		stats.Memory.RSS = memStat["total_rss"]
+		stats.Memory.Swap = memStat["total_swap"]
+		stats.Memory.Pgfault = memStat["total_pgfault"]
+		stats.Memory.Pgmajfault = memStat["total_pgmajfault"]
+		stats.Memory.WorkingSet = workingSet(stats.Memory.Usage, memStat["total_inactive_file"])
+	}
+
+	blkio := cgroups.dir("blkio")
+	stats.DiskIo.IoServiceBytes = readBlkioFile(filepath.Join(blkio, "blkio.throttle.io_service_bytes"))
+	stats.DiskIo.IoServiced = readBlkioFile(filepath.Join(blkio, "blkio.throttle.io_serviced"))
+	stats.DiskIo.IoQueued = readBlkioFile(filepath.Join(blkio, "blkio.io_queued_recursive"))
+	stats.DiskIo.IoServiceTime = readBlkioFile(filepath.Join(blkio, "blkio.io_service_time_recursive"))
+	stats.DiskIo.IoWaitTime = readBlkioFile(filepath.Join(blkio, "blkio.io_wait_time_recursive"))
+
+	if pids := cgroups.dir("pids"); pids != "" {
+		stats.Pids = readPids(filepath.Join(pids, "pids.current"))
+	}
+	return nil
+}
+
+func readCgroupV2(dir string, stats *containerStats) error {
+	cpuStat, err := readKeyValues(filepath.Join(dir, "cpu.stat"))
+	if err != nil {
+		return err
+	}
+	usec := uint64(time.Microsecond)
+	stats.Cpu.Usage.Total = cpuStat["usage_usec"] * usec
+	stats.Cpu.Usage.User = cpuStat["user_usec"] * usec
+	stats.Cpu.Usage.System = cpuStat["system_usec"] * usec
+	stats.Cpu.Throttling.Periods = cpuStat["nr_periods"]
+	stats.Cpu.Throttling.ThrottledPeriods = cpuStat["nr_throttled"]
+	stats.Cpu.Throttling.ThrottledTime = cpuStat["throttled_usec"] * usec
+
+	if stats.Memory.Usage, err = readUint(filepath.Join(dir, "memory.current")); err != nil {
+		return err
+	}
+	stats.Memory.MaxUsage, _ = readUint(filepath.Join(dir, "memory.peak"))
+	stats.Memory.Limit, _ = readUint(filepath.Join(dir, "memory.max"))
+	stats.Memory.Swap, _ = readUint(filepath.Join(dir, "memory.swap.current"))
+	if memStat, err := readKeyValues(filepath.Join(dir, "memory.stat")); err == nil {
+		stats.Memory.Cache = memStat["file"]
+		stats.Memory.RSS = memStat["anon"]
+		stats.Memory.Pgfault = memStat["pgfault"]
+		stats.Memory.Pgmajfault = memStat["pgmajfault"]
+		stats.Memory.WorkingSet = workingSet(stats.Memory.Usage, memStat["inactive_file"])
+	}
+	if events, err := readKeyValues(filepath.Join(dir, "memory.events")); err == nil {
+		stats.Memory.Failcnt = events["max"]
+	}
+
+	stats.DiskIo = readIoStat(filepath.Join(dir, "io.stat"))
+	stats.Pids = readPids(filepath.Join(dir, "pids.current"))
+	stats.Pressure, _ = readCgroupPressure(dir)
+	return nil
+}
+
+// workingSet is the usage less the inactive page cache, which can be
+// reclaimed under pressure, the same as cAdvisor.
+func workingSet(usage, inactiveFile uint64) uint64 {
+	if inactiveFile < usage {
+		return usage - inactiveFile
+	}
+	return 0
+}
+
+// readUint reads a file holding a single number. "max", meaning no limit,
+// reads as 0.
+func readUint(path string) (uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	value := strings.TrimSpace(string(data))
+	if value == "max" {
+		return 0, nil
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+// readPids reads pids.current, or returns nil if there's none.
+func readPids(path string) *PidsStats {
+	current, err := readUint(path)
+	if err != nil {
+		return nil
+	}
+	return &PidsStats{Current: current}
+}
+
+// readKeyValues reads a file of "key value" lines, like memory.stat.
+func readKeyValues(path string) (map[string]uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]uint64{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if value, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			values[fields[0]] = value
+		}
+	}
+	return values, nil
+}
+
+// readBlkioFile reads a cgroup v1 blkio file of "major:minor Op value" lines.
+func readBlkioFile(path string) []PerDiskStats {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return []PerDiskStats{}
+	}
+	records := []blkioRecord{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		record := blkioRecord{Op: fields[1]}
+		if _, err := fmt.Sscanf(fields[0], "%d:%d", &record.Major, &record.Minor); err != nil {
+			continue
+		}
+		if record.Value, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+	return perDiskStats(records)
+}
+
+// readIoStat reads cgroup v2's io.stat, which has a line per device of
+// key=value pairs.
+func readIoStat(path string) DiskIoStats {
+	records := map[string][]blkioRecord{}
+	if data, err := ioutil.ReadFile(path); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				continue
+			}
+			var major, minor int64
+			if _, err := fmt.Sscanf(fields[0], "%d:%d", &major, &minor); err != nil {
+				continue
+			}
+			values := map[string]int64{}
+			for _, field := range fields[1:] {
+				parts := strings.SplitN(field, "=", 2)
+				if len(parts) != 2 {
+					continue
+				}
+				values[parts[0]], _ = strconv.ParseInt(parts[1], 10, 64)
+			}
+			add := func(stat, op string, value int64) {
+				records[stat] = append(records[stat], blkioRecord{Major: major, Minor: minor, Op: op, Value: value})
+			}
+			add("bytes", "Read", values["rbytes"])
+			add("bytes", "Write", values["wbytes"])
+			add("bytes", "Total", values["rbytes"]+values["wbytes"])
+			add("ios", "Read", values["rios"])
+			add("ios", "Write", values["wios"])
+			add("ios", "Total", values["rios"]+values["wios"])
+		}
+	}
+	return DiskIoStats{
+		IoServiceBytes: perDiskStats(records["bytes"]),
+		IoServiced:     perDiskStats(records["ios"]),
+	}
+}
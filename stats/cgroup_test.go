@@ -0,0 +1,125 @@
+package stats
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	for path, content := range files {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCgroupV1(t *testing.T) {
+	root, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	dir := "/docker/abc"
+	writeFiles(t, root, map[string]string{
+		"cpu,cpuacct" + dir + "/cpuacct.usage":             "3000000000\n",
+		"cpu,cpuacct" + dir + "/cpuacct.usage_percpu":      "1000000000 2000000000 \n",
+		"cpu,cpuacct" + dir + "/cpuacct.stat":              "user 200\nsystem 100\n",
+		"cpu,cpuacct" + dir + "/cpu.stat":                  "nr_periods 10\nnr_throttled 2\nthrottled_time 500\n",
+		"memory" + dir + "/memory.usage_in_bytes":          "1000\n",
+		"memory" + dir + "/memory.limit_in_bytes":          "4096\n",
+		"memory" + dir + "/memory.failcnt":                 "3\n",
+		"memory" + dir + "/memory.stat":                    "cache 1\ntotal_cache 400\ntotal_rss 500\ntotal_inactive_file 300\n",
+		"blkio" + dir + "/blkio.throttle.io_service_bytes": "8:0 Read 100\n8:0 Write 200\n8:0 Total 300\nTotal 300\n",
+		"pids" + dir + "/pids.current":                     "7\n",
+	})
+	os.Symlink("cpu,cpuacct", filepath.Join(root, "cpuacct"))
+
+	cgroups, err := parseCgroups([]byte("9:pids:"+dir+"\n4:cpu,cpuacct:"+dir+"\n3:memory:"+dir+"\n2:blkio:"+dir+"\n0::/\n"), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cgroups.unified {
+		t.Fatal("Expected cgroup v1")
+	}
+
+	stats, err := readCgroupStats(cgroups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Cpu.Usage.Total != 3000000000 || len(stats.Cpu.Usage.PerCpu) != 2 || stats.Cpu.Usage.User != 2000000000 || stats.Cpu.Usage.System != 1000000000 {
+		t.Errorf("Wrong CPU usage %+v", stats.Cpu.Usage)
+	}
+	if stats.Cpu.Throttling.ThrottledPeriods != 2 {
+		t.Errorf("Wrong throttling %+v", stats.Cpu.Throttling)
+	}
+	if stats.Memory.Usage != 1000 || stats.Memory.WorkingSet != 700 || stats.Memory.Cache != 400 || stats.Memory.Limit != 4096 || stats.Memory.Failcnt != 3 {
+		t.Errorf("Wrong memory %+v", stats.Memory)
+	}
+	if len(stats.DiskIo.IoServiceBytes) != 1 || stats.DiskIo.IoServiceBytes[0].Stats["Write"] != 200 {
+		t.Errorf("Wrong disk IO %+v", stats.DiskIo.IoServiceBytes)
+	}
+	if stats.Pids.Current != 7 {
+		t.Errorf("Wrong pids %+v", stats.Pids)
+	}
+}
+
+func TestCgroupV2(t *testing.T) {
+	root, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	dir := "system.slice/docker-abc.scope"
+	writeFiles(t, root, map[string]string{
+		dir + "/cgroup.controllers":  "cpu io memory pids\n",
+		dir + "/cpu.stat":            "usage_usec 3000\nuser_usec 2000\nsystem_usec 1000\nnr_periods 10\nnr_throttled 2\nthrottled_usec 5\n",
+		dir + "/memory.current":      "1000\n",
+		dir + "/memory.max":          "max\n",
+		dir + "/memory.swap.current": "10\n",
+		dir + "/memory.stat":         "anon 500\nfile 400\ninactive_file 300\n",
+		dir + "/memory.events":       "low 0\nhigh 0\nmax 4\noom 1\n",
+		dir + "/io.stat":             "8:0 rbytes=100 wbytes=200 rios=1 wios=2 dbytes=0 dios=0\n",
+		dir + "/pids.current":        "3\n",
+		dir + "/memory.pressure":     "some avg10=1.50 avg60=0.75 avg300=0.25 total=12345\nfull avg10=0.50 avg60=0.00 avg300=0.00 total=678\n",
+	})
+
+	cgroups, err := parseCgroups([]byte("0::/"+dir+"\n"), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cgroups.unified {
+		t.Fatal("Expected cgroup v2")
+	}
+
+	stats, err := readCgroupStats(cgroups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Cpu.Usage.Total != 3000000 || stats.Cpu.Usage.User != 2000000 || stats.Cpu.Throttling.ThrottledTime != 5000 {
+		t.Errorf("Wrong CPU %+v", stats.Cpu)
+	}
+	if stats.Memory.WorkingSet != 700 || stats.Memory.RSS != 500 || stats.Memory.Limit != 0 || stats.Memory.Swap != 10 || stats.Memory.Failcnt != 4 {
+		t.Errorf("Wrong memory %+v", stats.Memory)
+	}
+	if len(stats.DiskIo.IoServiced) != 1 || stats.DiskIo.IoServiced[0].Stats["Total"] != 3 || stats.DiskIo.IoServiceBytes[0].Stats["Read"] != 100 {
+		t.Errorf("Wrong disk IO %+v", stats.DiskIo)
+	}
+	if stats.Pids.Current != 3 {
+		t.Errorf("Wrong pids %+v", stats.Pids)
+	}
+	if stats.Pressure == nil || stats.Pressure.Cpu != nil || stats.Pressure.Memory == nil || stats.Pressure.Memory.Full.Total != 678 {
+		t.Errorf("Wrong pressure %+v", stats.Pressure)
+	}
+
+	if _, err := parseCgroups([]byte("0::/missing\n"), root); err == nil {
+		t.Error("Expected an error for a missing cgroup")
+	}
+}
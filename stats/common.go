@@ -4,20 +4,81 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
-	jwt "github.com/dgrijalva/jwt-go"
-	"github.com/shirou/gopsutil/mem"
-	"github.com/vishvananda/netlink"
-	"github.com/vishvananda/netns"
+	"io"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
+
+	log "github.com/Sirupsen/logrus"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/shirou/gopsutil/mem"
+
+	"github.com/rancher/websocket-proxy/common"
 )
 
+// maxMessageSize is the longest line of stats that can be sent as a message.
+const maxMessageSize = 4 * 1024 * 1024
+
+// newMessageWriter returns a writer whose lines are each sent as a message.
+// The writer is closed when the client goes away. The returned channel is
+// closed once everything written before the writer was closed has been sent.
+func newMessageWriter(key string, incomingMessages <-chan string, response chan<- common.Message) (*io.PipeWriter, <-chan struct{}) {
+	reader, writer := io.Pipe()
+	sent := make(chan struct{})
+
+	go func(w *io.PipeWriter) {
+		for {
+			_, ok := <-incomingMessages
+			if !ok {
+				w.Close()
+				return
+			}
+		}
+	}(writer)
+
+	go func(r *io.PipeReader) {
+		defer close(sent)
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), maxMessageSize)
+		for scanner.Scan() {
+			text := scanner.Text()
+			message := common.Message{
+				Key:  key,
+				Type: common.Body,
+				Body: text,
+			}
+			response <- message
+		}
+		if err := scanner.Err(); err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("Error with the container stat scanner.")
+			r.CloseWithError(err)
+		}
+	}(reader)
+
+	return writer, sent
+}
+
 func pathParts(path string) []string {
 	path = strings.TrimPrefix(path, "/")
 	path = strings.TrimSuffix(path, "/")
 	return strings.Split(path, "/")
 }
 
+// hostProc and hostSys build paths under the host's /proc and /sys, which can
+// be mounted elsewhere and set with HOST_PROC and HOST_SYS, like gopsutil.
+func hostSys(parts ...string) string {
+	return hostPath("HOST_SYS", "/sys", parts)
+}
+
+func hostPath(env, def string, parts []string) string {
+	root := os.Getenv(env)
+	if root == "" {
+		root = def
+	}
+	return filepath.Join(append([]string{root}, parts...)...)
+}
+
 func parseRequestToken(tokenString string, parsedPublicKey interface{}) (*jwt.Token, error) {
 	if tokenString == "" {
 		return nil, fmt.Errorf("No JWT token provided")
@@ -28,11 +89,6 @@ func parseRequestToken(tokenString string, parsedPublicKey interface{}) (*jwt.To
 	})
 }
 
-func getContainerStats(reader *bufio.Reader, count int, id string, pid int) (containerInfo, error) {
-	i, err := getDockerContainerInfo(reader, count, id, pid)
-	return i, err
-}
-
 type DockerStats struct {
 	Read      time.Time `json:"read"`
 	PidsStats struct {
@@ -49,54 +105,14 @@ type DockerStats struct {
 		TxPackets int64 `json:"tx_packets"`
 	} `json:"networks"`
 	BlkioStats struct {
-		IoServiceBytesRecursive []struct {
-			Major int64  `json:"major"`
-			Minor int64  `json:"minor"`
-			Op    string `json:"op"`
-			Value int64  `json:"value"`
-		} `json:"io_service_bytes_recursive"`
-		IoServicedRecursive []struct {
-			Major int64  `json:"major"`
-			Minor int64  `json:"minor"`
-			Op    string `json:"op"`
-			Value int64  `json:"value"`
-		} `json:"io_serviced_recursive"`
-		IoQueueRecursive []struct {
-			Major int64  `json:"major"`
-			Minor int64  `json:"minor"`
-			Op    string `json:"op"`
-			Value int64  `json:"value"`
-		} `json:"io_queue_recursive"`
-		IoServiceTimeRecursive []struct {
-			Major int64  `json:"major"`
-			Minor int64  `json:"minor"`
-			Op    string `json:"op"`
-			Value int64  `json:"value"`
-		} `json:"io_service_time_recursive"`
-		IoWaitTimeRecursive []struct {
-			Major int64  `json:"major"`
-			Minor int64  `json:"minor"`
-			Op    string `json:"op"`
-			Value int64  `json:"value"`
-		} `json:"io_wait_time_recursive"`
-		IoMergedRecursive []struct {
-			Major int64  `json:"major"`
-			Minor int64  `json:"minor"`
-			Op    string `json:"op"`
-			Value int64  `json:"value"`
-		} `json:"io_merged_recursive"`
-		IoTimeRecursive []struct {
-			Major int64  `json:"major"`
-			Minor int64  `json:"minor"`
-			Op    string `json:"op"`
-			Value int64  `json:"value"`
-		} `json:"io_time_recursive"`
-		SectorsRecursive []struct {
-			Major int64  `json:"major"`
-			Minor int64  `json:"minor"`
-			Op    string `json:"op"`
-			Value int64  `json:"value"`
-		} `json:"sectors_recursive"`
+		IoServiceBytesRecursive []blkioRecord `json:"io_service_bytes_recursive"`
+		IoServicedRecursive     []blkioRecord `json:"io_serviced_recursive"`
+		IoQueueRecursive        []blkioRecord `json:"io_queue_recursive"`
+		IoServiceTimeRecursive  []blkioRecord `json:"io_service_time_recursive"`
+		IoWaitTimeRecursive     []blkioRecord `json:"io_wait_time_recursive"`
+		IoMergedRecursive       []blkioRecord `json:"io_merged_recursive"`
+		IoTimeRecursive         []blkioRecord `json:"io_time_recursive"`
+		SectorsRecursive        []blkioRecord `json:"sectors_recursive"`
 	} `json:"blkio_stats"`
 	MemoryStats struct {
 		Stats struct {
@@ -129,6 +145,8 @@ type DockerStats struct {
 			Pgfault                 int64  `json:"pgfault"`
 			InactiveFile            int64  `json:"inactive_file"`
 			TotalPgpgin             int64  `json:"total_pgpgin"`
+			Swap                    int64  `json:"swap"`
+			TotalSwap               int64  `json:"total_swap"`
 		} `json:"stats"`
 		MaxUsage int64 `json:"max_usage"`
 		Usage    int64 `json:"usage"`
@@ -166,8 +184,10 @@ type DockerStats struct {
 }
 
 type containerInfo struct {
-	Id    string
-	Stats []*containerStats
+	Id        string
+	Stats     []*containerStats
+	Rates     *Rates
+	Processes []ProcessStats
 }
 
 type containerStats struct {
@@ -176,10 +196,78 @@ type containerStats struct {
 	DiskIo    DiskIoStats  `json:"diskio,omitempty"`
 	Network   NetworkStats `json:"network,omitempty"`
 	Memory    MemoryStats  `json:"memory,omitempty"`
+	Pids      *PidsStats   `json:"pids,omitempty"`
+
+	// The host's filesystems, or a container's writable layer and the
+	// filesystems its mounts are on.
+	Filesystem []FsStats `json:"filesystem,omitempty"`
+
+	// Pressure stall information, for the host, and for containers on
+	// cgroup v2.
+	Pressure *PressureStats `json:"pressure,omitempty"`
+
+	// Only reported for the host.
+	Load            *LoadStats `json:"load,omitempty"`
+	FileDescriptors *FdStats   `json:"file_descriptors,omitempty"`
+	// Units: seconds
+	Uptime uint64 `json:"uptime,omitempty"`
+}
+
+type LoadStats struct {
+	// Load averages over 1, 5 and 15 minutes.
+	Load1  float64 `json:"load1"`
+	Load5  float64 `json:"load5"`
+	Load15 float64 `json:"load15"`
+	// Number of runnable processes and threads, and the number of them in
+	// total.
+	Running uint64 `json:"running"`
+	Total   uint64 `json:"total"`
+}
+
+type FsStats struct {
+	// The block device, and where it's mounted. For a container's mounts,
+	// the path on the host and the path in the container, and for its
+	// writable layer, just its usage.
+	Device     string `json:"device"`
+	Mountpoint string `json:"mountpoint"`
+	Type       string `json:"type"`
+	// Size, bytes used and bytes available to unprivileged users.
+	// Units: Bytes.
+	Limit     uint64 `json:"capacity"`
+	Usage     uint64 `json:"usage"`
+	Available uint64 `json:"available"`
+	// Number of inodes in total and free.
+	Inodes     uint64 `json:"inodes"`
+	InodesFree uint64 `json:"inodes_free"`
+}
+
+type FdStats struct {
+	// Number of file handles allocated, and the most there can be.
+	Allocated uint64 `json:"allocated"`
+	Max       uint64 `json:"max"`
+}
+
+type PidsStats struct {
+	// Number of processes and threads.
+	Current uint64 `json:"current"`
 }
 
 type CpuStats struct {
-	Usage CpuUsage `json:"usage"`
+	Usage      CpuUsage       `json:"usage"`
+	Throttling ThrottlingData `json:"throttling"`
+	// CPU limit set with a CFS quota, or 0 if there's none.
+	// Units: millicores
+	Limit uint64 `json:"limit,omitempty"`
+}
+
+type ThrottlingData struct {
+	// Number of periods with throttling active.
+	Periods uint64 `json:"periods"`
+	// Number of periods when the container hit its throttling limit.
+	ThrottledPeriods uint64 `json:"throttled_periods"`
+	// Aggregate time the container was throttled for.
+	// Units: nanoseconds
+	ThrottledTime uint64 `json:"throttled_time"`
 }
 
 type CpuUsage struct {
@@ -200,19 +288,39 @@ type CpuUsage struct {
 	System uint64 `json:"system"`
 }
 
+type blkioRecord struct {
+	Major int64  `json:"major"`
+	Minor int64  `json:"minor"`
+	Op    string `json:"op"`
+	Value int64  `json:"value"`
+}
+
 type DiskIoStats struct {
+	// Bytes transferred, by operation.
 	IoServiceBytes []PerDiskStats `json:"io_service_bytes,omitempty"`
+	// Number of IOs completed, by operation.
+	IoServiced []PerDiskStats `json:"io_serviced,omitempty"`
+	// Number of IOs queued.
+	IoQueued []PerDiskStats `json:"io_queued,omitempty"`
+	// Time spent by the device servicing IOs.
+	// Units: nanoseconds
+	IoServiceTime []PerDiskStats `json:"io_service_time,omitempty"`
+	// Time IOs spent waiting in the scheduler queues.
+	// Units: nanoseconds
+	IoWaitTime []PerDiskStats `json:"io_wait_time,omitempty"`
 }
 
 type PerDiskStats struct {
-	Major uint64            `json:"major"`
-	Minor uint64            `json:"minor"`
-	Stats map[string]uint64 `json:"stats"`
+	Major  uint64            `json:"major"`
+	Minor  uint64            `json:"minor"`
+	Device string            `json:"device,omitempty"`
+	Stats  map[string]uint64 `json:"stats"`
 }
 
 type NetworkStats struct {
 	InterfaceStats
 	Interfaces []InterfaceStats `json:"interfaces,omitempty"`
+	Tcp        *TcpStats        `json:"tcp,omitempty"`
 }
 
 type MemoryStats struct {
@@ -220,6 +328,39 @@ type MemoryStats struct {
 	// accessed.
 	// Units: Bytes.
 	Usage uint64 `json:"usage"`
+
+	// Maximum memory usage recorded.
+	// Units: Bytes.
+	MaxUsage uint64 `json:"max_usage"`
+
+	// The amount of working set memory, this includes recently accessed memory,
+	// dirty memory, and kernel memory. Working set is <= "usage".
+	// Units: Bytes.
+	WorkingSet uint64 `json:"working_set"`
+
+	// Number of bytes of page cache memory.
+	// Units: Bytes.
+	Cache uint64 `json:"cache"`
+
+	// The amount of anonymous and swap cache memory (includes transparent
+	// hugepages).
+	// Units: Bytes.
+	RSS uint64 `json:"rss"`
+
+	// The amount of swap currently used.
+	// Units: Bytes.
+	Swap uint64 `json:"swap"`
+
+	// The memory limit, or the host's memory for the host.
+	// Units: Bytes.
+	Limit uint64 `json:"limit"`
+
+	// Number of times the usage hit the limit.
+	Failcnt uint64 `json:"failcnt"`
+
+	// Cumulative count of page faults, and of major page faults.
+	Pgfault    uint64 `json:"pgfault"`
+	Pgmajfault uint64 `json:"pgmajfault"`
 }
 
 type InterfaceStats struct {
@@ -243,27 +384,7 @@ type InterfaceStats struct {
 	TxDropped uint64 `json:"tx_dropped"`
 }
 
-func getContainerInfo(reader *bufio.Reader, count int, id string, pid int) (containerInfo, error) {
-	contInfo := containerInfo{}
-	contInfo.Id = id
-	stats := []*containerStats{}
-	for i := 0; i < count; i++ {
-		str, err := reader.ReadString([]byte("\n")[0])
-		if err != nil {
-			return containerInfo{}, err
-		}
-		dockerStats, err := FromString(str)
-		if err != nil {
-			return containerInfo{}, err
-		}
-		contStats := convertDockerStats(dockerStats, pid)
-		stats = append(stats, contStats)
-	}
-	contInfo.Stats = stats
-	return contInfo, nil
-}
-
-func convertDockerStats(stats DockerStats, pid int) *containerStats {
+func convertDockerStats(stats DockerStats) *containerStats {
 	containerStats := containerStats{}
 	containerStats.Timestamp = stats.Read
 	containerStats.Cpu.Usage.Total = uint64(stats.CPUStats.CPUUsage.TotalUsage)
@@ -272,29 +393,28 @@ func convertDockerStats(stats DockerStats, pid int) *containerStats {
 		containerStats.Cpu.Usage.PerCpu = append(containerStats.Cpu.Usage.PerCpu, uint64(value))
 	}
 	containerStats.Cpu.Usage.System = uint64(stats.CPUStats.CPUUsage.UsageInKernelmode)
-	containerStats.Cpu.Usage.User = uint64(stats.CPUStats.CPUUsage.UsageInKernelmode)
+	containerStats.Cpu.Usage.User = uint64(stats.CPUStats.CPUUsage.UsageInUsermode)
+	containerStats.Cpu.Throttling.Periods = uint64(stats.CPUStats.ThrottlingData.Periods)
+	containerStats.Cpu.Throttling.ThrottledPeriods = uint64(stats.CPUStats.ThrottlingData.ThrottledPeriods)
+	containerStats.Cpu.Throttling.ThrottledTime = uint64(stats.CPUStats.ThrottlingData.ThrottledTime)
 	containerStats.Memory.Usage = uint64(stats.MemoryStats.Usage)
-	containerStats.Network.Interfaces = []InterfaceStats{}
-	for name, netStats := range getLinkStats(pid) {
-		data := InterfaceStats{}
-		data.Name = name
-		data.RxBytes = uint64(netStats.RxBytes)
-		data.RxDropped = uint64(netStats.RxDropped)
-		data.RxErrors = uint64(netStats.RxErrors)
-		data.RxPackets = uint64(netStats.RxPackets)
-		data.TxBytes = uint64(netStats.TxBytes)
-		data.TxDropped = uint64(netStats.TxDropped)
-		data.TxPackets = uint64(netStats.TxPackets)
-		data.TxErrors = uint64(netStats.TxErrors)
-		containerStats.Network.Interfaces = append(containerStats.Network.Interfaces, data)
-	}
-	containerStats.DiskIo.IoServiceBytes = []PerDiskStats{}
-	for _, diskStats := range stats.BlkioStats.IoServiceBytesRecursive {
-		data := PerDiskStats{}
-		data.Stats = map[string]uint64{}
-		data.Stats[diskStats.Op] = uint64(diskStats.Value)
-		containerStats.DiskIo.IoServiceBytes = append(containerStats.DiskIo.IoServiceBytes, data)
+	containerStats.Memory.MaxUsage = uint64(stats.MemoryStats.MaxUsage)
+	containerStats.Memory.Cache = uint64(stats.MemoryStats.Stats.TotalCache)
+	containerStats.Memory.RSS = uint64(stats.MemoryStats.Stats.TotalRss)
+	containerStats.Memory.Swap = uint64(stats.MemoryStats.Stats.TotalSwap)
+	containerStats.Memory.Limit = uint64(stats.MemoryStats.Limit)
+	containerStats.Memory.Failcnt = uint64(stats.MemoryStats.Failcnt)
+	containerStats.Memory.Pgfault = uint64(stats.MemoryStats.Stats.TotalPgfault)
+	containerStats.Memory.Pgmajfault = uint64(stats.MemoryStats.Stats.TotalPgmajfault)
+	containerStats.Memory.WorkingSet = workingSet(containerStats.Memory.Usage, uint64(stats.MemoryStats.Stats.TotalInactiveFile))
+	if stats.PidsStats.Current > 0 {
+		containerStats.Pids = &PidsStats{Current: uint64(stats.PidsStats.Current)}
 	}
+	containerStats.DiskIo.IoServiceBytes = perDiskStats(stats.BlkioStats.IoServiceBytesRecursive)
+	containerStats.DiskIo.IoServiced = perDiskStats(stats.BlkioStats.IoServicedRecursive)
+	containerStats.DiskIo.IoQueued = perDiskStats(stats.BlkioStats.IoQueueRecursive)
+	containerStats.DiskIo.IoServiceTime = perDiskStats(stats.BlkioStats.IoServiceTimeRecursive)
+	containerStats.DiskIo.IoWaitTime = perDiskStats(stats.BlkioStats.IoWaitTimeRecursive)
 	return &containerStats
 }
 
@@ -314,28 +434,3 @@ func getMemCapcity() (uint64, error) {
 	}
 	return data.Total, nil
 }
-
-func getLinkStats(pid int) map[string]*netlink.LinkStatistics {
-	ret := map[string]*netlink.LinkStatistics{}
-	nsHandler, err := netns.GetFromPid(pid)
-	if err != nil {
-		return nil
-	}
-	defer nsHandler.Close()
-	handler, err := netlink.NewHandleAt(nsHandler)
-	if err != nil {
-		return nil
-	}
-	defer handler.Delete()
-	links, err := handler.LinkList()
-	if err != nil {
-		return nil
-	}
-	for _, link := range links {
-		attr := link.Attrs()
-		if attr.Name != "lo" {
-			ret[attr.Name] = attr.Statistics
-		}
-	}
-	return ret
-}
@@ -0,0 +1,42 @@
+package stats
+
+import "testing"
+
+func TestConvertDockerStats(t *testing.T) {
+	raw := `{"cpu_stats":{"cpu_usage":{"total_usage":300,"usage_in_usermode":200,"usage_in_kernelmode":100},` +
+		`"throttling_data":{"periods":10,"throttled_periods":4,"throttled_time":5000}},` +
+		`"memory_stats":{"usage":1000,"max_usage":1500,"failcnt":2,"limit":2048,` +
+		`"stats":{"total_cache":400,"total_rss":500,"total_swap":50,"total_inactive_file":300,"total_pgfault":7,"total_pgmajfault":1}}}`
+	dockerStats, err := FromString(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats := convertDockerStats(dockerStats)
+	if stats.Cpu.Usage.User != 200 || stats.Cpu.Usage.System != 100 {
+		t.Errorf("Wrong CPU usage %+v", stats.Cpu.Usage)
+	}
+	if stats.Cpu.Throttling != (ThrottlingData{10, 4, 5000}) {
+		t.Errorf("Wrong throttling %+v", stats.Cpu.Throttling)
+	}
+
+	expected := MemoryStats{
+		Usage:      1000,
+		MaxUsage:   1500,
+		WorkingSet: 700,
+		Cache:      400,
+		RSS:        500,
+		Swap:       50,
+		Limit:      2048,
+		Failcnt:    2,
+		Pgfault:    7,
+		Pgmajfault: 1,
+	}
+	if stats.Memory != expected {
+		t.Errorf("Wrong memory stats %+v", stats.Memory)
+	}
+	// Without pids_stats there's nothing to report.
+	if stats.Pids != nil {
+		t.Errorf("Expected no pids, got %+v", stats.Pids)
+	}
+}
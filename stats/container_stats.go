@@ -1,7 +1,6 @@
 package stats
 
 import (
-	"bufio"
 	"io"
 	"net/url"
 	"time"
@@ -10,12 +9,18 @@ import (
 
 	"github.com/docker/engine-api/client"
 	"github.com/docker/engine-api/types"
+	dockerClient "github.com/fsouza/go-dockerclient"
 	"github.com/rancher/host-api/config"
+	"github.com/rancher/host-api/events"
 	"github.com/rancher/websocket-proxy/backend"
 	"github.com/rancher/websocket-proxy/common"
 	"golang.org/x/net/context"
 )
 
+// How long to wait before listening to docker events again after the
+// daemon's event stream ends.
+const eventsRetryInterval = 5 * time.Second
+
 type ContainerStatsHandler struct {
 }
 
@@ -28,6 +33,12 @@ func (s *ContainerStatsHandler) Handle(key string, initialMessage string, incomi
 		return
 	}
 
+	opts, err := parseStreamOptions(requestUrl.Query())
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Invalid stats options.")
+		return
+	}
+
 	tokenString := requestUrl.Query().Get("token")
 
 	containerIds := map[string]string{}
@@ -58,42 +69,12 @@ func (s *ContainerStatsHandler) Handle(key string, initialMessage string, incomi
 		return
 	}
 
-	dclient, err := client.NewEnvClient()
-	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Couldn't get docker client.")
-		return
-	}
-	dclient.UpdateClientVersion("1.22")
+	writer, sent := newMessageWriter(key, incomingMessages, response)
+	defer func() {
+		writer.Close()
+		<-sent
+	}()
 
-	reader, writer := io.Pipe()
-
-	go func(w *io.PipeWriter) {
-		for {
-			_, ok := <-incomingMessages
-			if !ok {
-				w.Close()
-				return
-			}
-		}
-	}(writer)
-
-	go func(r *io.PipeReader) {
-		scanner := bufio.NewScanner(r)
-		for scanner.Scan() {
-			text := scanner.Text()
-			message := common.Message{
-				Key:  key,
-				Type: common.Body,
-				Body: text,
-			}
-			response <- message
-		}
-		if err := scanner.Err(); err != nil {
-			log.WithFields(log.Fields{"error": err}).Error("Error with the container stat scanner.")
-		}
-	}(reader)
-
-	count := 1
 	memLimit, err := getMemCapcity()
 	if err != nil {
 		log.WithFields(log.Fields{"error": err, "id": id}).Error("Error getting memory capacity.")
@@ -102,92 +83,320 @@ func (s *ContainerStatsHandler) Handle(key string, initialMessage string, incomi
 
 	// get single container stats
 	if id != "" {
-		inspect, err := dclient.ContainerInspect(context.Background(), id)
+		err := streamStats([]string{id}, id, containerIds, "container", uint64(memLimit), opts, nil, writer)
 		if err != nil {
-			log.WithFields(log.Fields{"error": err}).Error("Can not inspect containers")
-			return
+			log.WithFields(log.Fields{"error": err, "id": id}).Error("Error getting container info.")
 		}
-		statsReader, err := dclient.ContainerStats(context.Background(), id, true)
+	} else {
+		// Watch before listing so that no container starts unnoticed.
+		done := make(chan struct{})
+		defer close(done)
+		changes, err := watchContainers(containerIds, done)
 		if err != nil {
-			log.WithFields(log.Fields{"error": err}).Error("Can not get stats reader from docker")
+			log.WithFields(log.Fields{"error": err}).Error("Couldn't watch docker events.")
 			return
 		}
-		defer statsReader.Close()
-
-		pid := inspect.State.Pid
-		bufioReader := bufio.NewReader(statsReader)
-		for {
-			infos := []containerInfo{}
-			cInfo, err := getContainerStats(bufioReader, count, id, pid)
-
-			if err != nil {
-				log.WithFields(log.Fields{"error": err, "id": id}).Error("Error getting container info.")
-				return
-			}
-			infos = append(infos, cInfo)
-			for i := range infos {
-				if len(infos[i].Stats) > 0 {
-					infos[i].Stats[0].Timestamp = time.Now()
-				}
-			}
-
-			err = writeAggregatedStats(id, containerIds, "container", infos, uint64(memLimit), writer)
-			if err != nil {
-				return
-			}
 
-			time.Sleep(1 * time.Second)
-			count = 1
+		dclient, err := client.NewEnvClient()
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("Couldn't get docker client.")
+			return
 		}
-	} else {
+		dclient.UpdateClientVersion("1.22")
+
 		contList, err := dclient.ContainerList(context.Background(), types.ContainerListOptions{})
 		if err != nil {
 			log.WithFields(log.Fields{"error": err}).Error("Can not list containers")
 			return
 		}
 		IDList := []string{}
-		bufioReaders := []*bufio.Reader{}
-		pids := []int{}
 		for _, cont := range contList {
 			if _, ok := containerIds[cont.ID]; ok {
-				inspect, err := dclient.ContainerInspect(context.Background(), cont.ID)
-				if err != nil {
-					log.WithFields(log.Fields{"error": err}).Error("Can not inspect containers")
-					return
-				}
-				statsReader, err := dclient.ContainerStats(context.Background(), cont.ID, true)
-				if err != nil {
-					log.WithFields(log.Fields{"error": err}).Error("Can not get stats reader from docker")
-					return
-				}
-				defer statsReader.Close()
-				pids = append(pids, inspect.State.Pid)
-				bufioReader := bufio.NewReader(statsReader)
-				bufioReaders = append(bufioReaders, bufioReader)
 				IDList = append(IDList, cont.ID)
 			}
 		}
-		for {
-			infos := []containerInfo{}
-			allInfos, err := getAllDockerContainers(bufioReaders, count, IDList, pids)
-			if err != nil {
-				log.WithFields(log.Fields{"error": err}).Error("Error getting all container info.")
-				return
+		err = streamStats(IDList, id, containerIds, "container", uint64(memLimit), opts, changes, writer)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("Error getting all container info.")
+		}
+	}
+
+	return
+}
+
+// containerChange is a container that started or stopped while its stats
+// were being streamed.
+type containerChange struct {
+	id      string
+	started bool
+}
+
+// streamEntry is a stream being written, along with the sequence number of
+// the last sample written for it.
+type streamEntry struct {
+	id  string
+	sub *subscription
+	seq uint64
+}
+
+// streamStats writes the latest sample of each stream every interval, using the
+// shared stats hub, after the history kept for them. For a fixed set of
+// streams, it returns when any of them ends or writing fails. With changes,
+// the set follows the containers starting and stopping and a stream ending
+// only drops that stream. One-shot requests wait for a sample from every
+// stream, write it and return.
+func streamStats(IDList []string, id string, containerIds map[string]string, resourceType string, memLimit uint64, opts *streamOptions, changes <-chan containerChange, writer io.Writer) error {
+	if opts.format == formatDelta {
+		writer = newDeltaWriter(writer)
+	}
+	dynamic := changes != nil
+	entries := []*streamEntry{}
+	defer func() {
+		for _, entry := range entries {
+			entry.sub.Close()
+		}
+	}()
+	for _, streamId := range IDList {
+		sub, err := statsHub.subscribe(streamId)
+		if err != nil {
+			if !dynamic {
+				return err
+			}
+			log.WithFields(log.Fields{"error": err, "id": streamId}).Warn("Couldn't get container stats.")
+			continue
+		}
+		entries = append(entries, &streamEntry{id: streamId, sub: sub})
+	}
+
+	rates := newRateTracker(opts, resourceType)
+	decorator := newStatsDecorator(opts)
+	processes := newProcessTracker(opts)
+	if opts.oneShot {
+		timeout := time.After(oneShotTimeout)
+		for _, entry := range entries {
+			if stats, _ := entry.sub.Latest(); stats != nil {
+				continue
+			}
+			select {
+			case <-entry.sub.Updated():
+			case <-entry.sub.Done():
+			case <-timeout:
+			}
+		}
+		// A snapshot's rates come from the sample before it, if it's kept.
+		for _, entry := range entries {
+			if samples, _ := entry.sub.History(); len(samples) > 1 {
+				rates.prev[entry.id] = samples[len(samples)-2]
+			}
+		}
+		return writeAggregatedStats(id, containerIds, resourceType, latestInfos(entries, rates, processes), memLimit, decorator, writer)
+	}
+
+	IDs := []string{}
+	histories := [][]*containerStats{}
+	for _, entry := range entries {
+		samples, seq := entry.sub.History()
+		IDs = append(IDs, entry.id)
+		histories = append(histories, samples)
+		if len(samples) > 0 {
+			entry.seq = seq
+		}
+	}
+	// Samples of different containers aren't taken together, so rollups
+	// start from the live ones.
+	if opts.rollup == "" {
+		if err := writeBacklog(IDs, histories, id, containerIds, resourceType, memLimit, opts, rates, decorator, writer); err != nil {
+			return err
+		}
+	}
+
+	ticker := time.NewTicker(opts.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case change := <-changes:
+			entries = applyChange(entries, change)
+			if !change.started {
+				decorator.forget(change.id)
+				processes.forget(change.id)
 			}
-			infos = append(infos, allInfos...)
-			for i := range infos {
-				if len(infos[i].Stats) > 0 {
-					infos[i].Stats[0].Timestamp = time.Now()
+			continue
+		case <-ticker.C:
+		}
+
+		ended := map[*streamEntry]bool{}
+		for _, entry := range entries {
+			select {
+			case <-entry.sub.Done():
+				if !dynamic {
+					return entry.sub.Err()
 				}
+				log.WithFields(log.Fields{"error": entry.sub.Err(), "id": entry.id}).Debug("Container stats ended.")
+				ended[entry] = true
+			default:
 			}
-			err = writeAggregatedStats(id, containerIds, "container", infos, uint64(memLimit), writer)
-			if err != nil {
-				return
+		}
+
+		// A stream that ended still has its last sample written.
+		infos := latestInfos(entries, rates, processes)
+		if len(ended) > 0 {
+			remaining := []*streamEntry{}
+			for _, entry := range entries {
+				if ended[entry] {
+					entry.sub.Close()
+					decorator.forget(entry.id)
+					processes.forget(entry.id)
+				} else {
+					remaining = append(remaining, entry)
+				}
 			}
+			entries = remaining
+		}
 
-			time.Sleep(1 * time.Second)
+		if len(infos) == 0 {
+			continue
+		}
+		if err := writeAggregatedStats(id, containerIds, resourceType, infos, memLimit, decorator, writer); err != nil {
+			return err
 		}
 	}
+}
 
-	return
+// latestInfos returns the samples that are new since the last call, with the
+// top processes of each container if they're asked for.
+func latestInfos(entries []*streamEntry, rates *rateTracker, processes *processTracker) []containerInfo {
+	infos := []containerInfo{}
+	for _, entry := range entries {
+		stats, seq := entry.sub.Latest()
+		if stats == nil || seq == entry.seq {
+			continue
+		}
+		entry.seq = seq
+		info := rates.info(entry.id, stats)
+		info.Processes = processes.sample(entry.id)
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+func applyChange(entries []*streamEntry, change containerChange) []*streamEntry {
+	for i, entry := range entries {
+		if entry.id != change.id {
+			continue
+		}
+		if change.started {
+			return entries
+		}
+		entry.sub.Close()
+		return append(entries[:i], entries[i+1:]...)
+	}
+	if !change.started {
+		return entries
+	}
+
+	sub, err := statsHub.subscribe(change.id)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "id": change.id}).Warn("Couldn't get container stats.")
+		return entries
+	}
+	return append(entries, &streamEntry{id: change.id, sub: sub})
+}
+
+// watchContainers sends a change for each of the given containers that starts
+// or stops, until done is closed.
+func watchContainers(containerIds map[string]string, done <-chan struct{}) (<-chan containerChange, error) {
+	eventsClient, err := events.NewDockerClient()
+	if err != nil {
+		return nil, err
+	}
+	listener := make(chan *dockerClient.APIEvents, 10)
+	if err := eventsClient.AddEventListener(listener); err != nil {
+		return nil, err
+	}
+
+	changes := make(chan containerChange, 10)
+	go func() {
+		relisten := func() chan *dockerClient.APIEvents {
+			return relistenEvents(eventsClient, done)
+		}
+		listener := sendContainerChanges(containerIds, listener, relisten, listRunningContainers, changes, done)
+		if listener != nil {
+			eventsClient.RemoveEventListener(listener)
+		}
+	}()
+	return changes, nil
+}
+
+// sendContainerChanges turns docker events into changes until done is closed,
+// and returns the listener it was using then. When the daemon's event stream
+// ends, like when it restarts, every stats stream ends with it, so once
+// there's a new listener the containers that are running again are sent as
+// started.
+func sendContainerChanges(containerIds map[string]string, listener chan *dockerClient.APIEvents, relisten func() chan *dockerClient.APIEvents, list func() ([]string, error), changes chan<- containerChange, done <-chan struct{}) chan *dockerClient.APIEvents {
+	send := func(change containerChange) bool {
+		select {
+		case changes <- change:
+			return true
+		case <-done:
+			return false
+		}
+	}
+	for {
+		select {
+		case event, ok := <-listener:
+			if !ok {
+				if listener = relisten(); listener == nil {
+					return nil
+				}
+				ids, err := list()
+				if err != nil {
+					log.WithFields(log.Fields{"error": err}).Warn("Couldn't list containers after docker events ended.")
+					continue
+				}
+				for _, id := range ids {
+					if _, ok := containerIds[id]; ok && !send(containerChange{id: id, started: true}) {
+						return listener
+					}
+				}
+				continue
+			}
+			if event == nil {
+				continue
+			}
+			if _, ok := containerIds[event.ID]; !ok {
+				continue
+			}
+			change := containerChange{id: event.ID}
+			switch event.Status {
+			case "start":
+				change.started = true
+			case "die", "destroy":
+			default:
+				continue
+			}
+			if !send(change) {
+				return listener
+			}
+		case <-done:
+			return listener
+		}
+	}
+}
+
+// relistenEvents adds a new docker events listener once the previous one was
+// closed, retrying every few seconds. It returns nil if done is closed first.
+func relistenEvents(eventsClient *dockerClient.Client, done <-chan struct{}) chan *dockerClient.APIEvents {
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-time.After(eventsRetryInterval):
+		}
+		listener := make(chan *dockerClient.APIEvents, 10)
+		if err := eventsClient.AddEventListener(listener); err != nil {
+			log.WithFields(log.Fields{"error": err}).Warn("Couldn't listen to docker events.")
+			continue
+		}
+		return listener
+	}
 }
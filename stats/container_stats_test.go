@@ -0,0 +1,124 @@
+package stats
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	dockerClient "github.com/fsouza/go-dockerclient"
+)
+
+// lineWriter collects what's written, and fails once stop returns true so
+// that the stream ends.
+type lineWriter struct {
+	sync.Mutex
+	data string
+	stop func(data string) bool
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	w.data += string(p)
+	if w.stop(w.data) {
+		return 0, errors.New("done")
+	}
+	return len(p), nil
+}
+
+func TestStreamStatsDynamic(t *testing.T) {
+	readers := map[string]*fakeReader{
+		"c1": newFakeReader(),
+		"c2": newFakeReader(),
+	}
+	oldHub := statsHub
+	defer func() {
+		statsHub = oldHub
+	}()
+	statsHub = newHub(func(id string) (containerReader, error) {
+		return readers[id], nil
+	})
+
+	changes := make(chan containerChange)
+	writer := &lineWriter{stop: func(data string) bool {
+		return strings.Contains(data, `"id":"1i2"`)
+	}}
+	result := make(chan error)
+	go func() {
+		containerIds := map[string]string{"c1": "1i1", "c2": "1i2"}
+		opts := &streamOptions{interval: 10 * time.Millisecond}
+		result <- streamStats([]string{"c1"}, "", containerIds, "container", 0, opts, changes, writer)
+	}()
+
+	readers["c1"].samples <- &containerStats{}
+	// The first container going away mustn't end the stream.
+	close(readers["c1"].samples)
+	time.Sleep(50 * time.Millisecond)
+
+	changes <- containerChange{id: "c2", started: true}
+	go func() {
+		for {
+			select {
+			case readers["c2"].samples <- &containerStats{}:
+			case <-readers["c2"].closed:
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+
+	select {
+	case err := <-result:
+		if err == nil || err.Error() != "done" {
+			t.Fatalf("Expected the stream to end writing, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for the new container's stats")
+	}
+	if !strings.Contains(writer.data, `"id":"1i1"`) {
+		t.Error("Expected stats for the first container")
+	}
+}
+
+func TestRelistenEventsStopsWhenDone(t *testing.T) {
+	eventsClient, err := dockerClient.NewClient("unix:///nonexistent.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	close(done)
+	if listener := relistenEvents(eventsClient, done); listener != nil {
+		t.Errorf("Expected no listener once done, got %v", listener)
+	}
+}
+
+func TestContainerChangesAfterEventsEnd(t *testing.T) {
+	listener := make(chan *dockerClient.APIEvents, 1)
+	close(listener)
+	relisten := func() chan *dockerClient.APIEvents {
+		return make(chan *dockerClient.APIEvents)
+	}
+	list := func() ([]string, error) {
+		return []string{"c1", "other"}, nil
+	}
+	changes := make(chan containerChange, 10)
+	done := make(chan struct{})
+	defer close(done)
+	go sendContainerChanges(map[string]string{"c1": "1i1"}, listener, relisten, list, changes, done)
+
+	select {
+	case change := <-changes:
+		if change.id != "c1" || !change.started {
+			t.Errorf("Expected c1 to start, got %+v", change)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a start change once listening again")
+	}
+	select {
+	case change := <-changes:
+		t.Errorf("Expected only the watched container, got %+v", change)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
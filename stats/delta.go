@@ -0,0 +1,150 @@
+package stats
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+const (
+	formatJSON  = "json"
+	formatDelta = "delta"
+
+	// A keyframe with every value is sent first and then every this many
+	// frames, so a client that's missed a frame catches up.
+	deltaKeyframeInterval = 60
+)
+
+// deltaFrame is a line in the delta format. Stats are keyed by their id, or
+// by their position in the line if they have none. A keyframe has every
+// stats object as is. Other frames have only what changed, in the same shape
+// as the JSON format: objects are merged into the previous ones, and anything
+// else, arrays included, replaces the previous value whole. Removed has the
+// path of each key that's gone, starting with the id, and a path of just the
+// id when a whole stats object is gone.
+type deltaFrame struct {
+	Keyframe bool                   `json:"keyframe,omitempty"`
+	Stats    map[string]interface{} `json:"stats"`
+	Removed  [][]string             `json:"removed,omitempty"`
+}
+
+// deltaWriter turns lines of stats in the JSON format into delta frames.
+type deltaWriter struct {
+	writer io.Writer
+	buf    bytes.Buffer
+	prev   map[string]interface{}
+	frames int
+}
+
+func newDeltaWriter(writer io.Writer) *deltaWriter {
+	return &deltaWriter{writer: writer}
+}
+
+func (d *deltaWriter) Write(p []byte) (int, error) {
+	d.buf.Write(p)
+	for {
+		i := bytes.IndexByte(d.buf.Bytes(), '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := d.buf.Next(i + 1)
+		if err := d.writeLine(line); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (d *deltaWriter) writeLine(line []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+	var decoded interface{}
+	if err := decoder.Decode(&decoded); err != nil {
+		return err
+	}
+	stats := statsById(decoded)
+
+	frame := deltaFrame{Stats: stats}
+	if d.prev == nil || d.frames%deltaKeyframeInterval == 0 {
+		frame.Keyframe = true
+	} else {
+		frame.Stats = diffObject(d.prev, stats, nil, &frame.Removed)
+	}
+	d.prev = stats
+	d.frames++
+
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	_, err = d.writer.Write(append(data, '\n'))
+	return err
+}
+
+// statsById keys each stats object in a line by its id, or by its position if
+// it has none.
+func statsById(decoded interface{}) map[string]interface{} {
+	list, ok := decoded.([]interface{})
+	if !ok {
+		list = []interface{}{decoded}
+	}
+	stats := map[string]interface{}{}
+	for i, stat := range list {
+		key := strconv.Itoa(i)
+		if object, ok := stat.(map[string]interface{}); ok {
+			if id, ok := object["id"].(string); ok && id != "" {
+				key = id
+			}
+		}
+		stats[key] = stat
+	}
+	return stats
+}
+
+// diffObject returns the keys of cur that changed since prev, recursing into
+// objects, and adds the paths of the keys that are gone to removed.
+func diffObject(prev, cur map[string]interface{}, path []string, removed *[][]string) map[string]interface{} {
+	keys := []string{}
+	for key := range cur {
+		keys = append(keys, key)
+	}
+	// Sorted so that removed paths come in the same order every time.
+	sort.Strings(keys)
+
+	changed := map[string]interface{}{}
+	for _, key := range keys {
+		value := cur[key]
+		prevValue, ok := prev[key]
+		if !ok {
+			changed[key] = value
+			continue
+		}
+		prevObject, prevIsObject := prevValue.(map[string]interface{})
+		object, isObject := value.(map[string]interface{})
+		if prevIsObject && isObject {
+			if diff := diffObject(prevObject, object, appendPath(path, key), removed); len(diff) > 0 {
+				changed[key] = diff
+			}
+		} else if !reflect.DeepEqual(prevValue, value) {
+			changed[key] = value
+		}
+	}
+
+	gone := []string{}
+	for key := range prev {
+		if _, ok := cur[key]; !ok {
+			gone = append(gone, key)
+		}
+	}
+	sort.Strings(gone)
+	for _, key := range gone {
+		*removed = append(*removed, appendPath(path, key))
+	}
+	return changed
+}
+
+func appendPath(path []string, key string) []string {
+	return append(append([]string{}, path...), key)
+}
@@ -0,0 +1,138 @@
+package stats
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func decodeFrames(t *testing.T, data string) []deltaFrame {
+	frames := []deltaFrame{}
+	for _, line := range strings.Split(strings.TrimSpace(data), "\n") {
+		frame := deltaFrame{}
+		decoder := json.NewDecoder(strings.NewReader(line))
+		decoder.UseNumber()
+		if err := decoder.Decode(&frame); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+func TestDeltaWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writer := newDeltaWriter(buf)
+	// Lines can come in several writes, as writeAggregatedStats does.
+	writer.Write([]byte(`[{"id":"1i1","cpu":{"usage":{"total":10,"per_cpu_usage":[4,6]}},"a.b":{"c":1,"d":2}},{"cpu":{"usage":{"total":5}}}]`))
+	writer.Write([]byte("\n"))
+	writer.Write([]byte(`[{"id":"1i1","cpu":{"usage":{"total":12,"per_cpu_usage":[4,8]}},"a.b":{"c":1}}]` + "\n"))
+
+	frames := decodeFrames(t, buf.String())
+	if len(frames) != 2 {
+		t.Fatalf("Got %d frames, expected 2", len(frames))
+	}
+	keyframe := decodeValue(t, `{"1i1":{"id":"1i1","cpu":{"usage":{"total":10,"per_cpu_usage":[4,6]}},"a.b":{"c":1,"d":2}},"1":{"cpu":{"usage":{"total":5}}}}`)
+	if !frames[0].Keyframe || !reflect.DeepEqual(frames[0].Stats, keyframe) {
+		t.Errorf("Got %+v, expected a keyframe of %v", frames[0], keyframe)
+	}
+	// Arrays are sent whole, and keys with dots in them stay unambiguous.
+	changed := decodeValue(t, `{"1i1":{"cpu":{"usage":{"total":12,"per_cpu_usage":[4,8]}}}}`)
+	removed := [][]string{{"1i1", "a.b", "d"}, {"1"}}
+	if frames[1].Keyframe || !reflect.DeepEqual(frames[1].Stats, changed) || !reflect.DeepEqual(frames[1].Removed, removed) {
+		t.Errorf("Got %+v, expected changes %v and removed %v", frames[1], changed, removed)
+	}
+}
+
+func decodeValue(t *testing.T, data string) map[string]interface{} {
+	value := map[string]interface{}{}
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestDeltaWriterKeyframes(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writer := newDeltaWriter(buf)
+	for i := 0; i <= deltaKeyframeInterval; i++ {
+		writer.Write([]byte(`[{"id":"1h1","uptime":1}]` + "\n"))
+	}
+	frames := decodeFrames(t, buf.String())
+	if len(frames) != deltaKeyframeInterval+1 {
+		t.Fatalf("Got %d frames", len(frames))
+	}
+	if len(frames[1].Stats) != 0 || frames[1].Keyframe {
+		t.Errorf("Expected an empty frame when nothing changed, got %+v", frames[1])
+	}
+	if last := frames[deltaKeyframeInterval]; !last.Keyframe || len(last.Stats) != 1 {
+		t.Errorf("Expected another keyframe, got %+v", last)
+	}
+
+	if _, err := writer.Write([]byte("not json\n")); err == nil {
+		t.Error("Expected an error for a line that isn't JSON")
+	}
+}
+
+// Every counter of a 32 CPU host changes on every sample, which is where the
+// delta format has to be no bigger than the JSON it replaces.
+func TestDeltaSmallerThanJSON(t *testing.T) {
+	stats := &containerStats{
+		Memory: MemoryStats{Usage: 1 << 30, Limit: 64 << 30},
+		DiskIo: DiskIoStats{IoServiceBytes: []PerDiskStats{
+			{Major: 8, Minor: 0, Device: "sda", Stats: map[string]uint64{"Read": 1 << 30, "Write": 1 << 31}},
+		}},
+		Network: NetworkStats{Interfaces: []InterfaceStats{{Name: "eth0"}, {Name: "eth1"}}},
+	}
+	stats.Cpu.Usage.PerCpu = make([]uint64, 32)
+
+	jsonBuf := &bytes.Buffer{}
+	deltaBuf := &bytes.Buffer{}
+	writer := newDeltaWriter(deltaBuf)
+	now := time.Date(2016, 9, 1, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		stats.Timestamp = now.Add(time.Duration(i) * time.Second)
+		for cpu := range stats.Cpu.Usage.PerCpu {
+			stats.Cpu.Usage.PerCpu[cpu] += 123456789
+			stats.Cpu.Usage.Total += 123456789
+		}
+		stats.Cpu.Usage.User += 987654321
+		stats.Memory.Usage += 4096
+		stats.DiskIo.IoServiceBytes[0].Stats["Write"] += 65536
+		for j := range stats.Network.Interfaces {
+			stats.Network.Interfaces[j].RxBytes += 1500
+			stats.Network.Interfaces[j].TxBytes += 1500
+		}
+
+		line, err := json.Marshal(AggregatedStats{{Id: "1h1", ResourceType: "host", containerStats: stats}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			writer.Write(append(line, '\n'))
+			continue
+		}
+		jsonBuf.Write(append(line, '\n'))
+		writer.Write(append(line, '\n'))
+	}
+	keyframe := bytes.IndexByte(deltaBuf.Bytes(), '\n') + 1
+	if delta := deltaBuf.Len() - keyframe; delta >= jsonBuf.Len() {
+		t.Errorf("Delta frames are %d bytes, the JSON they replace %d", delta, jsonBuf.Len())
+	}
+}
+
+func TestParseStreamFormat(t *testing.T) {
+	for query, format := range map[string]string{"": formatJSON, "format=json": formatJSON, "format=delta": formatDelta} {
+		values, _ := url.ParseQuery(query)
+		opts, err := parseStreamOptions(values)
+		if err != nil || opts.format != format {
+			t.Errorf("%s: got %+v, %v", query, opts, err)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package stats
+
+import (
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+	"github.com/patrickmn/go-cache"
+	"golang.org/x/net/context"
+)
+
+const (
+	rollupService = "service"
+	rollupStack   = "stack"
+
+	stackNameLabel   = "io.rancher.stack.name"
+	serviceNameLabel = "io.rancher.stack_service.name"
+)
+
+// containerMetadata is what stats are enriched with. Containers don't change
+// their name or labels often, so it's cached for a while.
+type containerMetadata struct {
+	Name    string
+	Image   string
+	Stack   string
+	Service string
+}
+
+var metadataCache = cache.New(10*time.Minute, time.Minute)
+
+func getContainerMetadata(id string) (*containerMetadata, error) {
+	if cached, ok := metadataCache.Get(id); ok {
+		return cached.(*containerMetadata), nil
+	}
+
+	dclient, err := client.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+	dclient.UpdateClientVersion("1.22")
+	inspect, err := dclient.ContainerInspect(context.Background(), id)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := &containerMetadata{}
+	if inspect.ContainerJSONBase != nil {
+		metadata.Name = strings.TrimPrefix(inspect.Name, "/")
+	}
+	if inspect.Config != nil {
+		metadata.Image = inspect.Config.Image
+		metadata.Stack, metadata.Service = stackAndService(inspect.Config.Labels)
+	}
+	metadataCache.Set(id, metadata, cache.DefaultExpiration)
+	return metadata, nil
+}
+
+// stackAndService reads the Rancher labels, where the service is named
+// stack/service.
+func stackAndService(labels map[string]string) (string, string) {
+	stack := labels[stackNameLabel]
+	service := labels[serviceNameLabel]
+	if i := strings.LastIndex(service, "/"); i >= 0 {
+		if stack == "" {
+			stack = service[:i]
+		}
+		service = service[i+1:]
+	}
+	return stack, service
+}
+
+// statsDecorator adds container metadata to the stats of a request, or rolls
+// them up by service or stack, as its options ask.
+type statsDecorator struct {
+	metadata bool
+	rollup   string
+	lookup   func(id string) (*containerMetadata, error)
+	// The latest sample of each container, so that rollups always add up
+	// every container of a group.
+	latest map[string]containerInfo
+}
+
+func newStatsDecorator(opts *streamOptions) *statsDecorator {
+	return &statsDecorator{
+		metadata: opts.metadata,
+		rollup:   opts.rollup,
+		lookup:   getContainerMetadata,
+		latest:   map[string]containerInfo{},
+	}
+}
+
+func (d *statsDecorator) getMetadata(id string) *containerMetadata {
+	if id == hostStreamId {
+		return nil
+	}
+	metadata, err := d.lookup(id)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "id": id}).Debug("Couldn't get container metadata.")
+		return nil
+	}
+	return metadata
+}
+
+// enrich adds metadata to a container's stats.
+func (d *statsDecorator) enrich(stat *AggregatedStat, id string) {
+	if !d.metadata {
+		return
+	}
+	if metadata := d.getMetadata(id); metadata != nil {
+		stat.Name = metadata.Name
+		stat.Image = metadata.Image
+		stat.Stack = metadata.Stack
+		stat.Service = metadata.Service
+	}
+}
+
+// rollupStats adds up the latest samples of the containers in each service or
+// stack. Containers in neither are left out. hostMemory is the host's total
+// memory, which docker reports as the limit of containers without one.
+func (d *statsDecorator) rollupStats(infos []containerInfo, hostMemory uint64) AggregatedStats {
+	for _, info := range infos {
+		d.latest[info.Id] = info
+	}
+
+	groups := map[string]*AggregatedStat{}
+	keys := []string{}
+	for id, info := range d.latest {
+		metadata := d.getMetadata(id)
+		if metadata == nil || metadata.Stack == "" {
+			continue
+		}
+		key := metadata.Stack
+		if d.rollup == rollupService {
+			if metadata.Service == "" {
+				continue
+			}
+			key = metadata.Stack + "/" + metadata.Service
+		}
+
+		group, ok := groups[key]
+		if !ok {
+			group = &AggregatedStat{
+				Id:             key,
+				ResourceType:   d.rollup,
+				Stack:          metadata.Stack,
+				containerStats: &containerStats{},
+			}
+			if d.rollup == rollupService {
+				group.Service = metadata.Service
+			}
+			groups[key] = group
+			keys = append(keys, key)
+		}
+		addToRollup(group, info, hostMemory)
+	}
+
+	// The share of the group's CPU limit is worked out from the total.
+	sort.Strings(keys)
+	rollups := AggregatedStats{}
+	for _, key := range keys {
+		group := groups[key]
+		if group.Rates != nil {
+			group.Rates.CpuLimitPercent = group.Rates.CpuPercent
+			if group.Cpu.Limit > 0 {
+				group.Rates.CpuLimitPercent = group.Rates.CpuPercent * float64(runtime.NumCPU()) / (float64(group.Cpu.Limit) / 1000)
+			}
+		}
+		rollups = append(rollups, *group)
+	}
+	return rollups
+}
+
+// forget drops a container that's no longer streamed from rollups.
+func (d *statsDecorator) forget(id string) {
+	delete(d.latest, id)
+}
+
+// addToRollup adds a container's CPU, memory, network and rates to those of
+// its group. Limits only add up while every container has one, and a memory
+// limit of at least the host's memory is no limit.
+func addToRollup(group *AggregatedStat, info containerInfo, hostMemory uint64) {
+	stats := info.Stats[0]
+	sum := group.containerStats
+	first := group.Containers == 0
+	group.Containers++
+
+	if stats.Timestamp.After(sum.Timestamp) {
+		sum.Timestamp = stats.Timestamp
+	}
+	sum.Cpu.Usage.Total += stats.Cpu.Usage.Total
+	sum.Cpu.Usage.User += stats.Cpu.Usage.User
+	sum.Cpu.Usage.System += stats.Cpu.Usage.System
+	sum.Cpu.Throttling.Periods += stats.Cpu.Throttling.Periods
+	sum.Cpu.Throttling.ThrottledPeriods += stats.Cpu.Throttling.ThrottledPeriods
+	sum.Cpu.Throttling.ThrottledTime += stats.Cpu.Throttling.ThrottledTime
+
+	sum.Memory.Usage += stats.Memory.Usage
+	sum.Memory.WorkingSet += stats.Memory.WorkingSet
+	sum.Memory.Cache += stats.Memory.Cache
+	sum.Memory.RSS += stats.Memory.RSS
+	sum.Memory.Swap += stats.Memory.Swap
+	if stats.Pids != nil {
+		if sum.Pids == nil {
+			sum.Pids = &PidsStats{}
+		}
+		sum.Pids.Current += stats.Pids.Current
+	}
+
+	if first || (sum.Cpu.Limit > 0 && stats.Cpu.Limit > 0) {
+		sum.Cpu.Limit += stats.Cpu.Limit
+	} else {
+		sum.Cpu.Limit = 0
+	}
+	memoryLimit := stats.Memory.Limit
+	if hostMemory > 0 && memoryLimit >= hostMemory {
+		memoryLimit = 0
+	}
+	if first || (sum.Memory.Limit > 0 && memoryLimit > 0) {
+		sum.Memory.Limit += memoryLimit
+	} else {
+		sum.Memory.Limit = 0
+	}
+
+	interfaces := stats.Network.Interfaces
+	if len(interfaces) == 0 {
+		interfaces = []InterfaceStats{stats.Network.InterfaceStats}
+	}
+	for _, iface := range interfaces {
+		sum.Network.RxBytes += iface.RxBytes
+		sum.Network.RxPackets += iface.RxPackets
+		sum.Network.RxErrors += iface.RxErrors
+		sum.Network.RxDropped += iface.RxDropped
+		sum.Network.TxBytes += iface.TxBytes
+		sum.Network.TxPackets += iface.TxPackets
+		sum.Network.TxErrors += iface.TxErrors
+		sum.Network.TxDropped += iface.TxDropped
+	}
+
+	if info.Rates != nil {
+		if group.Rates == nil {
+			group.Rates = &Rates{}
+		}
+		group.Rates.CpuPercent += info.Rates.CpuPercent
+		group.Rates.RxBytes += info.Rates.RxBytes
+		group.Rates.TxBytes += info.Rates.TxBytes
+		group.Rates.ReadBytes += info.Rates.ReadBytes
+		group.Rates.WriteBytes += info.Rates.WriteBytes
+		group.Rates.ReadIops += info.Rates.ReadIops
+		group.Rates.WriteIops += info.Rates.WriteIops
+	}
+}
@@ -0,0 +1,158 @@
+package stats
+
+import (
+	"errors"
+	"net/url"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestStackAndService(t *testing.T) {
+	tests := []struct {
+		labels  map[string]string
+		stack   string
+		service string
+	}{
+		{map[string]string{stackNameLabel: "web", serviceNameLabel: "web/nginx"}, "web", "nginx"},
+		{map[string]string{serviceNameLabel: "web/nginx"}, "web", "nginx"},
+		{map[string]string{stackNameLabel: "web"}, "web", ""},
+		{map[string]string{}, "", ""},
+	}
+	for _, test := range tests {
+		stack, service := stackAndService(test.labels)
+		if stack != test.stack || service != test.service {
+			t.Errorf("%v: got %s/%s, expected %s/%s", test.labels, stack, service, test.stack, test.service)
+		}
+	}
+}
+
+func testDecorator(opts *streamOptions) *statsDecorator {
+	d := newStatsDecorator(opts)
+	d.lookup = func(id string) (*containerMetadata, error) {
+		switch id {
+		case "c1":
+			return &containerMetadata{Name: "web-nginx-1", Image: "nginx", Stack: "web", Service: "nginx"}, nil
+		case "c2":
+			return &containerMetadata{Name: "web-nginx-2", Image: "nginx", Stack: "web", Service: "nginx"}, nil
+		case "c3":
+			return &containerMetadata{Name: "web-db-1", Image: "mysql", Stack: "web", Service: "db"}, nil
+		case "c4":
+			return &containerMetadata{Name: "standalone", Image: "busybox"}, nil
+		}
+		return nil, errors.New("No such container")
+	}
+	return d
+}
+
+func testRollupInfo(id string, cpu, memory, memLimit, rx uint64, cpuPercent float64) containerInfo {
+	stats := &containerStats{Timestamp: time.Unix(100, 0)}
+	stats.Cpu.Usage.Total = cpu
+	stats.Cpu.Limit = 500
+	stats.Memory.Usage = memory
+	stats.Memory.Limit = memLimit
+	stats.Network.Interfaces = []InterfaceStats{{Name: "eth0", RxBytes: rx}}
+	return containerInfo{
+		Id:    id,
+		Stats: []*containerStats{stats},
+		Rates: &Rates{CpuPercent: cpuPercent, RxBytes: float64(rx)},
+	}
+}
+
+func TestEnrichStats(t *testing.T) {
+	decorator := testDecorator(&streamOptions{metadata: true})
+	infos := []containerInfo{testRollupInfo("c1", 1, 1, 1, 1, 1), testRollupInfo("missing", 1, 1, 1, 1, 1)}
+	stats := convertToAggregatedStats("", map[string]string{"c1": "1i1", "missing": "1i2"}, "container", infos, 0, decorator)
+	if len(stats) != 1 || len(stats[0]) != 2 {
+		t.Fatalf("Got %+v", stats)
+	}
+	if stat := stats[0][0]; stat.Id != "1i1" || stat.Name != "web-nginx-1" || stat.Image != "nginx" || stat.Stack != "web" || stat.Service != "nginx" {
+		t.Errorf("Wrong metadata %+v", stat)
+	}
+	if stat := stats[0][1]; stat.Id != "1i2" || stat.Name != "" {
+		t.Errorf("Expected no metadata %+v", stat)
+	}
+
+	plain := convertToAggregatedStats("", map[string]string{"c1": "1i1"}, "container", infos[:1], 0, testDecorator(&streamOptions{}))
+	if plain[0][0].Name != "" {
+		t.Errorf("Metadata added without asking %+v", plain[0][0])
+	}
+}
+
+func TestRollupByService(t *testing.T) {
+	decorator := testDecorator(&streamOptions{rollup: rollupService})
+	rollups := decorator.rollupStats([]containerInfo{
+		testRollupInfo("c1", 100, 10, 1000, 5, 10),
+		testRollupInfo("c2", 200, 20, 1000, 7, 20),
+		testRollupInfo("c3", 400, 40, 0, 11, 40),
+		testRollupInfo("c4", 800, 80, 1000, 13, 80),
+	}, 0)
+	if len(rollups) != 2 {
+		t.Fatalf("Expected db and nginx, got %+v", rollups)
+	}
+	db, nginx := rollups[0], rollups[1]
+	if db.Id != "web/db" || db.ResourceType != rollupService || db.Containers != 1 || db.Cpu.Usage.Total != 400 {
+		t.Errorf("Wrong db rollup %+v", db)
+	}
+	if nginx.Id != "web/nginx" || nginx.Stack != "web" || nginx.Service != "nginx" || nginx.Containers != 2 {
+		t.Errorf("Wrong nginx rollup %+v", nginx)
+	}
+	if nginx.Cpu.Usage.Total != 300 || nginx.Cpu.Limit != 1000 || nginx.Memory.Usage != 30 || nginx.Memory.Limit != 2000 || nginx.Network.RxBytes != 12 {
+		t.Errorf("Wrong nginx totals %+v", nginx.containerStats)
+	}
+	expectedLimit := 30 * float64(runtime.NumCPU())
+	if nginx.Rates == nil || nginx.Rates.CpuPercent != 30 || nginx.Rates.CpuLimitPercent != expectedLimit || nginx.Rates.RxBytes != 12 {
+		t.Errorf("Wrong nginx rates %+v", nginx.Rates)
+	}
+
+	// Later samples replace a container's, and the rest are kept.
+	rollups = decorator.rollupStats([]containerInfo{testRollupInfo("c1", 150, 10, 1000, 5, 10)}, 0)
+	if len(rollups) != 2 || rollups[1].Cpu.Usage.Total != 350 {
+		t.Errorf("Expected the latest of both containers, got %+v", rollups)
+	}
+	decorator.forget("c2")
+	rollups = decorator.rollupStats(nil, 0)
+	if rollups[1].Containers != 1 || rollups[1].Cpu.Usage.Total != 150 {
+		t.Errorf("Expected a forgotten container to be left out, got %+v", rollups[1])
+	}
+}
+
+func TestRollupByStack(t *testing.T) {
+	decorator := testDecorator(&streamOptions{rollup: rollupStack})
+	rollups := decorator.rollupStats([]containerInfo{
+		testRollupInfo("c1", 100, 10, 1000, 5, 10),
+		testRollupInfo("c3", 400, 40, 0, 11, 40),
+	}, 0)
+	if len(rollups) != 1 || rollups[0].Id != "web" || rollups[0].Service != "" || rollups[0].Containers != 2 {
+		t.Fatalf("Wrong stack rollup %+v", rollups)
+	}
+	// One container without a limit means the stack has none.
+	if rollups[0].Memory.Limit != 0 || rollups[0].Memory.Usage != 50 {
+		t.Errorf("Wrong memory %+v", rollups[0].Memory)
+	}
+
+	// Docker reports the host's memory as the limit of a container without
+	// one, which isn't added up either.
+	decorator = testDecorator(&streamOptions{rollup: rollupStack})
+	rollups = decorator.rollupStats([]containerInfo{
+		testRollupInfo("c1", 100, 10, 1000, 5, 10),
+		testRollupInfo("c2", 200, 20, 4096, 7, 20),
+	}, 4096)
+	if len(rollups) != 1 || rollups[0].Memory.Limit != 0 {
+		t.Errorf("Expected no memory limit, got %+v", rollups)
+	}
+}
+
+func TestParseEnrichOptions(t *testing.T) {
+	query, _ := url.ParseQuery("metadata=true&rollup=stack")
+	opts, err := parseStreamOptions(query)
+	if err != nil || !opts.metadata || opts.rollup != rollupStack {
+		t.Errorf("Got %+v, %v", opts, err)
+	}
+	for _, bad := range []string{"metadata=maybe", "rollup=host"} {
+		query, _ := url.ParseQuery(bad)
+		if _, err := parseStreamOptions(query); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package stats
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/docker/engine-api/client"
+	"github.com/shirou/gopsutil/disk"
+	"golang.org/x/net/context"
+)
+
+const (
+	fsTypeRootfs = "rootfs"
+	fsTypeVolume = "volume"
+	fsTypeBind   = "bind"
+)
+
+// fsReader adds the usage of a container's writable layer and mounts to the
+// samples of another reader. It's collected in the background on its own
+// interval, since working out the size of the layer can take docker a while.
+type fsReader struct {
+	containerReader
+	id      string
+	collect func(id string) ([]FsStats, error)
+
+	lock   sync.Mutex
+	latest []FsStats
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newFsReader(reader containerReader, id string, interval time.Duration, collect func(id string) ([]FsStats, error)) *fsReader {
+	r := &fsReader{
+		containerReader: reader,
+		id:              id,
+		collect:         collect,
+		done:            make(chan struct{}),
+	}
+	go r.run(interval)
+	return r
+}
+
+func (r *fsReader) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		stats, err := r.collect(r.id)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "id": r.id}).Debug("Couldn't get container filesystem usage.")
+		} else {
+			r.lock.Lock()
+			r.latest = stats
+			r.lock.Unlock()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-r.done:
+			return
+		}
+	}
+}
+
+func (r *fsReader) Next() (*containerStats, error) {
+	stats, err := r.containerReader.Next()
+	if err != nil {
+		return nil, err
+	}
+	r.lock.Lock()
+	stats.Filesystem = r.latest
+	r.lock.Unlock()
+	return stats, nil
+}
+
+func (r *fsReader) Close() error {
+	r.once.Do(func() {
+		close(r.done)
+	})
+	return r.containerReader.Close()
+}
+
+// getContainerFsStats returns the size of a container's writable layer, and
+// the usage of the filesystems its mounts are on.
+func getContainerFsStats(id string) ([]FsStats, error) {
+	dclient, err := client.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+	dclient.UpdateClientVersion("1.22")
+
+	inspect, _, err := dclient.ContainerInspectWithRaw(context.Background(), id, true)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := []FsStats{}
+	if inspect.ContainerJSONBase != nil && inspect.SizeRw != nil {
+		stats = append(stats, FsStats{
+			Mountpoint: "/",
+			Type:       fsTypeRootfs,
+			Usage:      uint64(*inspect.SizeRw),
+		})
+	}
+	for _, mount := range inspect.Mounts {
+		usage, err := disk.Usage(mount.Source)
+		if err != nil {
+			continue
+		}
+		fsType := fsTypeBind
+		if mount.Name != "" {
+			fsType = fsTypeVolume
+		}
+		stats = append(stats, FsStats{
+			Device:     mount.Source,
+			Mountpoint: mount.Destination,
+			Type:       fsType,
+			Limit:      usage.Total,
+			Usage:      usage.Used,
+			Available:  usage.Free,
+			Inodes:     usage.InodesTotal,
+			InodesFree: usage.InodesFree,
+		})
+	}
+	return stats, nil
+}
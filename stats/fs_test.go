@@ -0,0 +1,47 @@
+package stats
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFsReaderAddsLatestUsage(t *testing.T) {
+	collected := make(chan struct{}, 10)
+	calls := 0
+	inner := newFakeReader()
+	r := newFsReader(inner, "c1", 10*time.Millisecond, func(id string) ([]FsStats, error) {
+		calls++
+		defer func() { collected <- struct{}{} }()
+		if calls == 2 {
+			return nil, errors.New("inspect failed")
+		}
+		return []FsStats{{Mountpoint: "/", Type: fsTypeRootfs, Usage: uint64(calls)}}, nil
+	})
+
+	<-collected
+	go func() { inner.samples <- &containerStats{} }()
+	stats, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Filesystem) != 1 || stats.Filesystem[0].Usage < 1 {
+		t.Fatalf("Unexpected filesystem stats %+v", stats.Filesystem)
+	}
+
+	// A failed collection keeps the previous usage.
+	<-collected
+	go func() { inner.samples <- &containerStats{} }()
+	stats, err = r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Filesystem) != 1 {
+		t.Fatalf("Expected the previous usage, got %+v", stats.Filesystem)
+	}
+
+	r.Close()
+	if _, err := r.Next(); err == nil {
+		t.Fatal("Expected an error after closing")
+	}
+}
@@ -1,7 +1,8 @@
 package stats
 
 import (
-	"bufio"
+	"time"
+
 	"github.com/shirou/gopsutil/cpu"
 	"github.com/shirou/gopsutil/disk"
 	"github.com/shirou/gopsutil/mem"
@@ -24,12 +25,12 @@ func getRootContainerInfo(count int) (containerInfo, error) {
 		}
 		stats.Cpu.Usage.PerCpu = []uint64{}
 		for _, perStats := range cpuPerStats {
-			stats.Cpu.Usage.PerCpu = append(stats.Cpu.Usage.PerCpu, uint64(perStats.User+perStats.System)*1000000000)
+			stats.Cpu.Usage.PerCpu = append(stats.Cpu.Usage.PerCpu, cpuTimeNs(perStats.User+perStats.System))
 		}
 		if len(cpuStats) > 0 {
-			stats.Cpu.Usage.Total = uint64(cpuStats[0].User+cpuStats[0].System+cpuStats[0].Idle) * 1000000000
-			stats.Cpu.Usage.User = uint64(cpuStats[0].User) * 1000000000
-			stats.Cpu.Usage.System = uint64(cpuStats[0].System) * 1000000000
+			stats.Cpu.Usage.Total = cpuTimeNs(cpuStats[0].User + cpuStats[0].System + cpuStats[0].Idle)
+			stats.Cpu.Usage.User = cpuTimeNs(cpuStats[0].User)
+			stats.Cpu.Usage.System = cpuTimeNs(cpuStats[0].System)
 		}
 		// memory
 		memStats, err := mem.VirtualMemory()
@@ -37,22 +38,20 @@ func getRootContainerInfo(count int) (containerInfo, error) {
 			return containerInfo{}, err
 		}
 		stats.Memory.Usage = memStats.Used
+		stats.Memory.WorkingSet = memStats.Used
+		stats.Memory.Cache = memStats.Cached + memStats.Buffers
+		stats.Memory.Limit = memStats.Total
+		swapStats, err := mem.SwapMemory()
+		if err != nil {
+			return containerInfo{}, err
+		}
+		stats.Memory.Swap = swapStats.Used
 		//disk
 		diskIo, err := disk.IOCounters()
 		if err != nil {
 			return containerInfo{}, err
 		}
-		readBytes := uint64(0)
-		writeBytes := uint64(0)
-		for _, io := range diskIo {
-			readBytes += io.ReadBytes
-			writeBytes += io.WriteBytes
-		}
-		stats.DiskIo.IoServiceBytes = []PerDiskStats{}
-		stats.DiskIo.IoServiceBytes = append(stats.DiskIo.IoServiceBytes, PerDiskStats{})
-		stats.DiskIo.IoServiceBytes[0].Stats = map[string]uint64{}
-		stats.DiskIo.IoServiceBytes[0].Stats["Read"] = readBytes
-		stats.DiskIo.IoServiceBytes[0].Stats["Write"] = writeBytes
+		stats.DiskIo = hostDiskIo(diskIo)
 		//network
 		netStats, err := net.IOCounters(false)
 		if err != nil {
@@ -62,25 +61,32 @@ func getRootContainerInfo(count int) (containerInfo, error) {
 			stats.Network.Name = netStats[0].Name
 			stats.Network.RxBytes = netStats[0].BytesRecv
 			stats.Network.TxBytes = netStats[0].BytesSent
+			stats.Network.RxPackets = netStats[0].PacketsRecv
+			stats.Network.TxPackets = netStats[0].PacketsSent
+			stats.Network.RxErrors = netStats[0].Errin
+			stats.Network.TxErrors = netStats[0].Errout
+			stats.Network.RxDropped = netStats[0].Dropin
+			stats.Network.TxDropped = netStats[0].Dropout
+		}
+		if stats.Network.Interfaces, err = getHostInterfaceStats(); err != nil {
+			return containerInfo{}, err
 		}
+		// The rest are nice to have, and some of them may not be readable
+		// from inside a container.
+		stats.Network.Tcp, _ = getHostTcpStats()
+		stats.Load, _ = getLoadStats()
+		stats.Pressure, _ = getHostPressure()
+		stats.FileDescriptors, _ = getFdStats()
+		stats.Uptime, _ = getUptime()
 		rootStats = append(rootStats, &stats)
 	}
 	rootInfo.Stats = rootStats
 	return rootInfo, nil
 }
 
-func getDockerContainerInfo(reader *bufio.Reader, count int, id string, pid int) (containerInfo, error) {
-	return getContainerInfo(reader, count, id, pid)
-}
-
-func getAllDockerContainers(readers []*bufio.Reader, count int, IDList []string, pids []int) ([]containerInfo, error) {
-	ret := []containerInfo{}
-	for i, reader := range readers {
-		contInfo, err := getContainerInfo(reader, count, IDList[i], pids[i])
-		if err != nil {
-			return []containerInfo{}, err
-		}
-		ret = append(ret, contInfo)
-	}
-	return ret, nil
+// cpuTimeNs converts CPU times from gopsutil, in seconds with a fraction.
+// Dropping the fraction first would make host CPU rates jump in steps of a
+// whole second.
+func cpuTimeNs(seconds float64) uint64 {
+	return uint64(seconds * float64(time.Second))
 }
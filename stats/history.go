@@ -0,0 +1,171 @@
+package stats
+
+import (
+	"io"
+	"sort"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/rancher/host-api/config"
+	"golang.org/x/net/context"
+)
+
+// How often the history collector looks for newly started containers.
+const historyListInterval = 10 * time.Second
+
+// history is a ring buffer of the most recent samples of a stream. It isn't
+// safe for concurrent use, the stream's lock guards it.
+type history struct {
+	samples []*containerStats
+	next    int
+	full    bool
+}
+
+// newHistory returns a history of the given size, or nil if history is turned
+// off. A nil history keeps nothing.
+func newHistory(size int) *history {
+	if size <= 0 {
+		return nil
+	}
+	return &history{
+		samples: make([]*containerStats, size),
+	}
+}
+
+func (h *history) add(stats *containerStats) {
+	if h == nil {
+		return
+	}
+	h.samples[h.next] = stats
+	h.next = (h.next + 1) % len(h.samples)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// list returns the samples in the history, oldest first.
+func (h *history) list() []*containerStats {
+	if h == nil {
+		return nil
+	}
+	if !h.full {
+		return append([]*containerStats{}, h.samples[:h.next]...)
+	}
+	return append(append([]*containerStats{}, h.samples[h.next:]...), h.samples[:h.next]...)
+}
+
+// thinSamples drops samples so that the ones left are roughly interval apart,
+// matching the rate of the stream that follows them.
+func thinSamples(samples []*containerStats, interval time.Duration) []*containerStats {
+	thinned := []*containerStats{}
+	var last time.Time
+	for _, stats := range samples {
+		if len(thinned) > 0 && stats.Timestamp.Sub(last) < interval*9/10 {
+			continue
+		}
+		thinned = append(thinned, stats)
+		last = stats.Timestamp
+	}
+	return thinned
+}
+
+type backlogSample struct {
+	id    string
+	stats *containerStats
+}
+
+type byTimestamp []backlogSample
+
+func (s byTimestamp) Len() int           { return len(s) }
+func (s byTimestamp) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byTimestamp) Less(i, j int) bool { return s[i].stats.Timestamp.Before(s[j].stats.Timestamp) }
+
+// writeBacklog writes the history of each stream, oldest first, one sample per
+// message.
+func writeBacklog(IDList []string, histories [][]*containerStats, id string, containerIds map[string]string, resourceType string, memLimit uint64, opts *streamOptions, rates *rateTracker, decorator *statsDecorator, writer io.Writer) error {
+	backlog := []backlogSample{}
+	for i, samples := range histories {
+		for _, stats := range thinSamples(samples, opts.interval) {
+			backlog = append(backlog, backlogSample{IDList[i], stats})
+		}
+	}
+	sort.Stable(byTimestamp(backlog))
+
+	for _, sample := range backlog {
+		infos := []containerInfo{rates.info(sample.id, sample.stats)}
+		if err := writeAggregatedStats(id, containerIds, resourceType, infos, memLimit, decorator, writer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartHistory keeps the host's stream and those of up to stats-history
+// running containers open, so that their last samples can be sent as soon as
+// a session subscribes. It does nothing if num-stats is 0.
+func StartHistory() {
+	if config.Config.NumStats <= 0 {
+		return
+	}
+	go collectHistory(statsHub, listRunningContainers, historyListInterval, config.Config.StatsHistory)
+}
+
+// collectHistory holds a subscription to the host's stream and to at most
+// maxContainers container streams, relisting every interval.
+func collectHistory(h *hub, list func() ([]string, error), interval time.Duration, maxContainers int) {
+	subs := map[string]*subscription{}
+	for {
+		ids, err := list()
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Warn("Couldn't list containers for stats history.")
+		}
+		ids = append([]string{hostStreamId}, ids...)
+
+		for _, id := range ids {
+			if _, ok := subs[id]; ok {
+				continue
+			}
+			if id != hostStreamId && len(subs) > maxContainers {
+				continue
+			}
+			sub, err := h.subscribe(id)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err, "id": id}).Debug("Couldn't collect stats history.")
+				continue
+			}
+			subs[id] = sub
+		}
+
+		for id, sub := range subs {
+			select {
+			case <-sub.Done():
+				sub.Close()
+				delete(subs, id)
+			default:
+			}
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+func listRunningContainers() ([]string, error) {
+	dclient, err := client.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+	dclient.UpdateClientVersion("1.22")
+
+	contList, err := dclient.ContainerList(context.Background(), types.ContainerListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, cont := range contList {
+		ids = append(ids, cont.ID)
+	}
+	return ids, nil
+}
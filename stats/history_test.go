@@ -0,0 +1,136 @@
+package stats
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rancher/host-api/config"
+)
+
+func TestHistoryRing(t *testing.T) {
+	h := newHistory(3)
+	samples := []*containerStats{}
+	for i := 0; i < 5; i++ {
+		stats := &containerStats{}
+		stats.Memory.Usage = uint64(i)
+		samples = append(samples, stats)
+		h.add(stats)
+	}
+
+	list := h.list()
+	if len(list) != 3 {
+		t.Fatalf("Expected 3 samples, got %d", len(list))
+	}
+	for i, stats := range list {
+		if stats != samples[i+2] {
+			t.Errorf("Sample %d is %d, expected %d", i, stats.Memory.Usage, i+2)
+		}
+	}
+
+	off := newHistory(0)
+	off.add(samples[0])
+	if len(off.list()) != 0 {
+		t.Error("Expected no history when turned off")
+	}
+}
+
+func TestThinSamples(t *testing.T) {
+	start := time.Now()
+	samples := []*containerStats{}
+	for i := 0; i < 10; i++ {
+		samples = append(samples, &containerStats{Timestamp: start.Add(time.Duration(i) * time.Second)})
+	}
+
+	thinned := thinSamples(samples, 3*time.Second)
+	if len(thinned) != 4 {
+		t.Fatalf("Expected 4 samples, got %d", len(thinned))
+	}
+	if thinned[1] != samples[3] || thinned[3] != samples[9] {
+		t.Error("Wrong samples kept")
+	}
+}
+
+func TestHubSendsBacklog(t *testing.T) {
+	oldNumStats := config.Config.NumStats
+	defer func() {
+		config.Config.NumStats = oldNumStats
+	}()
+	config.Config.NumStats = 5
+
+	reader := newFakeReader()
+	h := newHub(func(id string) (containerReader, error) {
+		return reader, nil
+	})
+
+	collector, err := h.subscribe("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+	start := time.Now()
+	for i := 0; i < 7; i++ {
+		reader.samples <- &containerStats{}
+		waitUpdated(t, collector)
+	}
+
+	sub, err := h.subscribe("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples, seq := sub.History()
+	sub.Close()
+	if len(samples) != 5 || seq != 7 {
+		t.Fatalf("Expected 5 samples up to 7, got %d up to %d", len(samples), seq)
+	}
+	for i, stats := range samples {
+		stats.Timestamp = start.Add(time.Duration(i) * time.Second)
+	}
+
+	buf := &bytes.Buffer{}
+	opts := &streamOptions{interval: time.Second}
+	if err := writeBacklog([]string{"c1"}, [][]*containerStats{samples}, "c1", nil, "container", 0, opts, newRateTracker(opts, "container"), newStatsDecorator(opts), buf); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("Expected 5 backlog messages, got %d", len(lines))
+	}
+}
+
+func TestCollectHistoryCapsContainers(t *testing.T) {
+	oldNumStats := config.Config.NumStats
+	defer func() {
+		config.Config.NumStats = oldNumStats
+	}()
+	config.Config.NumStats = 5
+
+	opened := make(chan string, 10)
+	h := newHub(func(id string) (containerReader, error) {
+		opened <- id
+		return newFakeReader(), nil
+	})
+	list := func() ([]string, error) {
+		return []string{"c1", "c2", "c3"}, nil
+	}
+	go collectHistory(h, list, time.Hour, 1)
+
+	ids := map[string]bool{}
+	for len(ids) < 2 {
+		select {
+		case id := <-opened:
+			ids[id] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected the host and one container, got %v", ids)
+		}
+	}
+	if !ids[hostStreamId] || !ids["c1"] {
+		t.Errorf("Expected the host and c1, got %v", ids)
+	}
+	select {
+	case id := <-opened:
+		t.Errorf("Expected no more than one container, also got %s", id)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
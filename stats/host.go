@@ -0,0 +1,153 @@
+package stats
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/shirou/gopsutil/disk"
+	"github.com/shirou/gopsutil/net"
+
+	"github.com/rancher/host-api/proc"
+)
+
+// getLoadStats reads the load averages from /proc/loadavg.
+func getLoadStats() (*LoadStats, error) {
+	data, err := ioutil.ReadFile(proc.Path("loadavg"))
+	if err != nil {
+		return nil, err
+	}
+	return parseLoadAvg(string(data))
+}
+
+func parseLoadAvg(data string) (*LoadStats, error) {
+	stats := &LoadStats{}
+	fields := strings.Fields(data)
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("Invalid loadavg %q", data)
+	}
+	for i, load := range []*float64{&stats.Load1, &stats.Load5, &stats.Load15} {
+		value, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return nil, err
+		}
+		*load = value
+	}
+	if _, err := fmt.Sscanf(fields[3], "%d/%d", &stats.Running, &stats.Total); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// getUptime reads the whole seconds since boot from /proc/uptime.
+func getUptime() (uint64, error) {
+	uptime, err := proc.Uptime()
+	if err != nil {
+		return 0, err
+	}
+	return uint64(uptime), nil
+}
+
+// getFdStats reads the file handles in use from /proc/sys/fs/file-nr.
+func getFdStats() (*FdStats, error) {
+	data, err := ioutil.ReadFile(proc.Path("sys", "fs", "file-nr"))
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("Invalid file-nr %q", data)
+	}
+	stats := &FdStats{}
+	if stats.Allocated, err = strconv.ParseUint(fields[0], 10, 64); err != nil {
+		return nil, err
+	}
+	if stats.Max, err = strconv.ParseUint(fields[2], 10, 64); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// getFsStats returns the usage of each local filesystem. A device mounted
+// more than once is only reported for its first mount point.
+func getFsStats() ([]FsStats, error) {
+	partitions, err := disk.Partitions(false)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	stats := []FsStats{}
+	for _, partition := range partitions {
+		if seen[partition.Device] || isRemoteFs(partition.Fstype) {
+			continue
+		}
+		usage, err := disk.Usage(partition.Mountpoint)
+		if err != nil || usage.Total == 0 {
+			continue
+		}
+		seen[partition.Device] = true
+		stats = append(stats, FsStats{
+			Device:     partition.Device,
+			Mountpoint: partition.Mountpoint,
+			Type:       partition.Fstype,
+			Limit:      usage.Total,
+			Usage:      usage.Used,
+			Available:  usage.Free,
+			Inodes:     usage.InodesTotal,
+			InodesFree: usage.InodesFree,
+		})
+	}
+	return stats, nil
+}
+
+// isRemoteFs is whether a filesystem is on the network, where a statfs can
+// hang for as long as the server is unreachable. Partitions already leaves
+// out most of them, but not every FUSE one.
+func isRemoteFs(fsType string) bool {
+	for _, prefix := range []string{"nfs", "cifs", "smb", "ceph", "glusterfs", "fuse."} {
+		if strings.HasPrefix(fsType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// getHostInterfaceStats returns the stats of every physical interface.
+func getHostInterfaceStats() ([]InterfaceStats, error) {
+	counters, err := net.IOCounters(true)
+	if err != nil {
+		return nil, err
+	}
+	interfaces := []InterfaceStats{}
+	for _, counter := range counters {
+		if isVirtualInterface(counter.Name) {
+			continue
+		}
+		interfaces = append(interfaces, InterfaceStats{
+			Name:      counter.Name,
+			RxBytes:   counter.BytesRecv,
+			RxPackets: counter.PacketsRecv,
+			RxErrors:  counter.Errin,
+			RxDropped: counter.Dropin,
+			TxBytes:   counter.BytesSent,
+			TxPackets: counter.PacketsSent,
+			TxErrors:  counter.Errout,
+			TxDropped: counter.Dropout,
+		})
+	}
+	return interfaces, nil
+}
+
+// isVirtualInterface is whether an interface has no device behind it, like
+// loopback, docker0, veths and other bridges. Container traffic goes through
+// them as well as the physical interfaces, so it would be counted twice.
+// Without sysfs it goes by the names docker uses.
+func isVirtualInterface(name string) bool {
+	if _, err := os.Stat(hostSys("class", "net", name)); err == nil {
+		_, err := os.Stat(hostSys("class", "net", name, "device"))
+		return err != nil
+	}
+	return name == "lo" || name == "docker0" || strings.HasPrefix(name, "veth") || strings.HasPrefix(name, "br-")
+}
@@ -1,9 +1,9 @@
 package stats
 
 import (
-	"bufio"
 	"io"
 	"net/url"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -25,6 +25,12 @@ func (s *HostStatsHandler) Handle(key string, initialMessage string, incomingMes
 		return
 	}
 
+	opts, err := parseStreamOptions(requestUrl.Query())
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Invalid stats options.")
+		return
+	}
+
 	tokenString := requestUrl.Query().Get("token")
 
 	resourceId := ""
@@ -40,64 +46,71 @@ func (s *HostStatsHandler) Handle(key string, initialMessage string, incomingMes
 		}
 	}
 
-	reader, writer := io.Pipe()
+	writer, sent := newMessageWriter(key, incomingMessages, response)
+	defer func() {
+		writer.Close()
+		<-sent
+	}()
 
-	go func(w *io.PipeWriter) {
-		for {
-			_, ok := <-incomingMessages
-			if !ok {
-				w.Close()
-				return
-			}
-		}
-	}(writer)
-
-	go func(r *io.PipeReader) {
-		scanner := bufio.NewScanner(r)
-		for scanner.Scan() {
-			text := scanner.Text()
-			message := common.Message{
-				Key:  key,
-				Type: common.Body,
-				Body: text,
-			}
-			response <- message
-		}
-		if err := scanner.Err(); err != nil {
-			log.WithFields(log.Fields{"error": err}).Error("Error with the container stat scanner.")
-		}
-	}(reader)
-
-	count := 1
 	memLimit, err := getMemCapcity()
 	if err != nil {
 		log.WithFields(log.Fields{"error": err}).Error("Error getting memory capacity.")
 		return
 	}
 
-	for {
-		infos := []containerInfo{}
+	streamHostStats(resourceId, uint64(memLimit), opts, writer)
+}
 
-		cInfo, err := getRootContainerInfo(count)
-		if err != nil {
-			return
-		}
+// streamHostStats writes a host sample every interval until writing fails, or
+// just once for one-shot requests.
+func streamHostStats(resourceId string, memLimit uint64, opts *streamOptions, writer io.Writer) error {
+	return streamStats([]string{hostStreamId}, resourceId, nil, "host", memLimit, opts, nil, writer)
+}
 
-		infos = append(infos, cInfo)
-		for i := range infos {
-			if len(infos[i].Stats) > 0 {
-				infos[i].Stats[0].Timestamp = time.Now()
-			}
-		}
+// The host's samples are shared through the stats hub like a container's,
+// under an id no container can have.
+const hostStreamId = ""
+
+// How often the host is sampled, the same as docker's stats for containers.
+const hostSampleInterval = time.Second
+
+// How often the usage of the host's filesystems is collected. It's kept off
+// the sampling path so that a slow filesystem doesn't hold up samples.
+const hostFsInterval = time.Minute
+
+// hostReader samples the host's stats.
+type hostReader struct {
+	started bool
+	closed  chan struct{}
+	once    sync.Once
+}
 
-		err = writeAggregatedStats(resourceId, nil, "host", infos, uint64(memLimit), writer)
-		if err != nil {
-			return
+func newHostReader() *hostReader {
+	return &hostReader{
+		closed: make(chan struct{}),
+	}
+}
+
+func (r *hostReader) Next() (*containerStats, error) {
+	if r.started {
+		select {
+		case <-time.After(hostSampleInterval):
+		case <-r.closed:
+			return nil, errReaderClosed
 		}
+	}
+	r.started = true
 
-		time.Sleep(1 * time.Second)
-		count = 1
+	info, err := getRootContainerInfo(1)
+	if err != nil {
+		return nil, err
 	}
+	return info.Stats[0], nil
+}
 
-	return
+func (r *hostReader) Close() error {
+	r.once.Do(func() {
+		close(r.closed)
+	})
+	return nil
 }
@@ -0,0 +1,80 @@
+package stats
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestParseLoadAvg(t *testing.T) {
+	stats, err := parseLoadAvg("0.52 0.58 0.59 2/469 12345\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := LoadStats{Load1: 0.52, Load5: 0.58, Load15: 0.59, Running: 2, Total: 469}
+	if *stats != expected {
+		t.Errorf("Got %+v, expected %+v", *stats, expected)
+	}
+
+	if _, err := parseLoadAvg("0.52"); err == nil {
+		t.Error("Expected an error for a short loadavg")
+	}
+}
+
+func TestHostProcFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{
+		"uptime":         "3600.25 7000.00\n",
+		"sys/fs/file-nr": "1024\t0\t65536\n",
+	})
+	os.Setenv("HOST_PROC", dir)
+	defer os.Unsetenv("HOST_PROC")
+
+	uptime, err := getUptime()
+	if err != nil || uptime != 3600 {
+		t.Errorf("Got uptime %d, %v", uptime, err)
+	}
+	fds, err := getFdStats()
+	if err != nil || fds.Allocated != 1024 || fds.Max != 65536 {
+		t.Errorf("Got file descriptors %+v, %v", fds, err)
+	}
+}
+
+func TestCpuTimeNs(t *testing.T) {
+	if ns := cpuTimeNs(12.34); ns != 12340000000 {
+		t.Errorf("Expected the fraction to be kept, got %d", ns)
+	}
+}
+
+func TestIsVirtualInterface(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("HOST_SYS", dir)
+	defer os.Unsetenv("HOST_SYS")
+	writeFiles(t, dir, map[string]string{
+		"class/net/eth0/device/vendor": "0x8086\n",
+		"class/net/docker0/type":       "1\n",
+		"class/net/bond0/type":         "1\n",
+	})
+
+	for name, virtual := range map[string]bool{
+		"eth0":    false,
+		"docker0": true,
+		"bond0":   true,
+		// Not in sysfs, so going by the name.
+		"veth1a2b": true,
+		"br-0123":  true,
+		"ens3":     false,
+	} {
+		if isVirtualInterface(name) != virtual {
+			t.Errorf("%s: expected virtual to be %v", name, virtual)
+		}
+	}
+}
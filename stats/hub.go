@@ -0,0 +1,285 @@
+package stats
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/docker/engine-api/client"
+	"github.com/rancher/host-api/config"
+	"golang.org/x/net/context"
+)
+
+var errReaderClosed = errors.New("Stats reader closed")
+
+// containerReader reads successive stats samples for a single container.
+type containerReader interface {
+	Next() (*containerStats, error)
+	Close() error
+}
+
+// hub keeps one upstream stats stream per container and shares its samples
+// between every session subscribed to that container. Streams are opened by
+// the first subscriber and closed when the last one leaves.
+type hub struct {
+	sync.Mutex
+	streams map[string]*containerStream
+	open    func(id string) (containerReader, error)
+}
+
+// containerStream is the upstream stream for a container. The hub's lock must
+// be taken before the stream's.
+type containerStream struct {
+	sync.Mutex
+	id          string
+	reader      containerReader
+	subscribers map[*subscription]bool
+	// ready is closed once the reader is open, or failed to open.
+	ready   chan struct{}
+	done    chan struct{}
+	err     error
+	latest  *containerStats
+	seq     uint64
+	history *history
+}
+
+// subscription is a session's handle on a container's stream. Samples are
+// shared with other subscribers and must not be modified.
+type subscription struct {
+	hub     *hub
+	stream  *containerStream
+	updated chan struct{}
+}
+
+var statsHub = newHub(openReader)
+
+func newHub(open func(id string) (containerReader, error)) *hub {
+	return &hub{
+		streams: map[string]*containerStream{},
+		open:    open,
+	}
+}
+
+func (h *hub) subscribe(id string) (*subscription, error) {
+	h.Lock()
+	stream, ok := h.streams[id]
+	if !ok {
+		stream = &containerStream{
+			id:          id,
+			subscribers: map[*subscription]bool{},
+			ready:       make(chan struct{}),
+			done:        make(chan struct{}),
+			history:     newHistory(config.Config.NumStats),
+		}
+		h.streams[id] = stream
+	}
+	sub := &subscription{
+		hub:     h,
+		stream:  stream,
+		updated: make(chan struct{}, 1),
+	}
+	stream.Lock()
+	stream.subscribers[sub] = true
+	stream.Unlock()
+	h.Unlock()
+
+	if !ok {
+		reader, err := h.open(id)
+		if err != nil {
+			h.remove(stream)
+			stream.finish(err)
+		} else {
+			stream.reader = reader
+			go h.run(stream)
+		}
+		close(stream.ready)
+	}
+
+	<-stream.ready
+	select {
+	case <-stream.done:
+		err := sub.Err()
+		sub.Close()
+		return nil, err
+	default:
+	}
+	return sub, nil
+}
+
+func (h *hub) run(stream *containerStream) {
+	for {
+		stats, err := stream.reader.Next()
+		if err != nil {
+			h.remove(stream)
+			stream.reader.Close()
+			stream.finish(err)
+			return
+		}
+		stats.Timestamp = time.Now()
+		stream.publish(stats)
+	}
+}
+
+// remove takes the stream out of the hub so that new subscribers open a new
+// one, if it's still the current stream for its container.
+func (h *hub) remove(stream *containerStream) {
+	h.Lock()
+	defer h.Unlock()
+	if h.streams[stream.id] == stream {
+		delete(h.streams, stream.id)
+	}
+}
+
+func (h *hub) unsubscribe(sub *subscription) {
+	h.Lock()
+	stream := sub.stream
+	stream.Lock()
+	delete(stream.subscribers, sub)
+	last := len(stream.subscribers) == 0
+	stream.Unlock()
+	if last && h.streams[stream.id] == stream {
+		delete(h.streams, stream.id)
+	}
+	h.Unlock()
+
+	if last && stream.reader != nil {
+		stream.reader.Close()
+	}
+}
+
+func (s *containerStream) publish(stats *containerStats) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.latest = stats
+	s.seq++
+	s.history.add(stats)
+	for sub := range s.subscribers {
+		select {
+		case sub.updated <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *containerStream) finish(err error) {
+	s.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.Unlock()
+
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+}
+
+// Latest returns the most recent sample and its sequence number, which
+// increases with every new sample.
+func (s *subscription) Latest() (*containerStats, uint64) {
+	s.stream.Lock()
+	defer s.stream.Unlock()
+	return s.stream.latest, s.stream.seq
+}
+
+// History returns the samples kept for the stream, oldest first, and the
+// sequence number of the newest.
+func (s *subscription) History() ([]*containerStats, uint64) {
+	s.stream.Lock()
+	defer s.stream.Unlock()
+	return s.stream.history.list(), s.stream.seq
+}
+
+// Updated is signalled whenever a new sample arrives.
+func (s *subscription) Updated() <-chan struct{} {
+	return s.updated
+}
+
+// Done is closed when the upstream stream ends, such as when the container
+// stops.
+func (s *subscription) Done() <-chan struct{} {
+	return s.stream.done
+}
+
+func (s *subscription) Err() error {
+	s.stream.Lock()
+	defer s.stream.Unlock()
+	return s.stream.err
+}
+
+func (s *subscription) Close() {
+	s.hub.unsubscribe(s)
+}
+
+// dockerReader reads samples from the docker stats API.
+type dockerReader struct {
+	body     io.ReadCloser
+	reader   *bufio.Reader
+	network  *networkReader
+	cpuLimit uint64
+	// The container's cgroup on cgroup v2, where pressure stall information
+	// is read from.
+	unifiedCgroup string
+}
+
+func openDockerReader(id string) (containerReader, error) {
+	dclient, err := client.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+	dclient.UpdateClientVersion("1.22")
+
+	inspect, err := dclient.ContainerInspect(context.Background(), id)
+	if err != nil {
+		return nil, err
+	}
+	if inspect.ContainerJSONBase == nil || inspect.State == nil {
+		return nil, fmt.Errorf("No state for container %s", id)
+	}
+	limit := uint64(0)
+	if inspect.HostConfig != nil {
+		limit = cpuLimit(inspect.HostConfig.CPUQuota, inspect.HostConfig.CPUPeriod)
+	}
+	body, err := dclient.ContainerStats(context.Background(), id, true)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := &dockerReader{
+		body:     body,
+		reader:   bufio.NewReader(body),
+		network:  newNetworkReader(id, inspect.State.Pid),
+		cpuLimit: limit,
+	}
+	if cgroups, err := findCgroups(inspect.State.Pid); err == nil && cgroups.unified {
+		reader.unifiedCgroup = cgroups.dir("")
+	}
+	return reader, nil
+}
+
+func (r *dockerReader) Next() (*containerStats, error) {
+	str, err := r.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	dockerStats, err := FromString(str)
+	if err != nil {
+		return nil, err
+	}
+	stats := convertDockerStats(dockerStats)
+	stats.Cpu.Limit = r.cpuLimit
+	r.network.read(stats)
+	if r.unifiedCgroup != "" {
+		stats.Pressure, _ = readCgroupPressure(r.unifiedCgroup)
+	}
+	return stats, nil
+}
+
+func (r *dockerReader) Close() error {
+	return r.body.Close()
+}
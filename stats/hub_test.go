@@ -0,0 +1,133 @@
+package stats
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeReader struct {
+	samples chan *containerStats
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func newFakeReader() *fakeReader {
+	return &fakeReader{
+		samples: make(chan *containerStats),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (r *fakeReader) Next() (*containerStats, error) {
+	select {
+	case stats, ok := <-r.samples:
+		if !ok {
+			return nil, errors.New("stream ended")
+		}
+		return stats, nil
+	case <-r.closed:
+		return nil, errors.New("closed")
+	}
+}
+
+func (r *fakeReader) Close() error {
+	r.once.Do(func() {
+		close(r.closed)
+	})
+	return nil
+}
+
+func waitUpdated(t *testing.T, sub *subscription) *containerStats {
+	select {
+	case <-sub.Updated():
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for sample")
+	}
+	stats, _ := sub.Latest()
+	return stats
+}
+
+func TestHubSharesStream(t *testing.T) {
+	opened := 0
+	reader := newFakeReader()
+	h := newHub(func(id string) (containerReader, error) {
+		opened++
+		return reader, nil
+	})
+
+	sub1, err := h.subscribe("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub2, err := h.subscribe("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened != 1 {
+		t.Fatalf("Expected one upstream stream, got %d", opened)
+	}
+
+	sample := &containerStats{}
+	sample.Memory.Usage = 42
+	reader.samples <- sample
+	if stats := waitUpdated(t, sub1); stats.Memory.Usage != 42 {
+		t.Fatalf("Unexpected sample %#v", stats)
+	}
+	if stats := waitUpdated(t, sub2); stats.Memory.Usage != 42 {
+		t.Fatalf("Unexpected sample %#v", stats)
+	}
+
+	sub1.Close()
+	select {
+	case <-reader.closed:
+		t.Fatal("Stream closed while it still had a subscriber")
+	default:
+	}
+
+	sub2.Close()
+	select {
+	case <-reader.closed:
+	case <-time.After(time.Second):
+		t.Fatal("Stream wasn't closed after the last subscriber left")
+	}
+	if len(h.streams) != 0 {
+		t.Fatalf("Expected no streams, got %d", len(h.streams))
+	}
+}
+
+func TestHubStreamEnds(t *testing.T) {
+	reader := newFakeReader()
+	h := newHub(func(id string) (containerReader, error) {
+		return reader, nil
+	})
+
+	sub, err := h.subscribe("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	close(reader.samples)
+	select {
+	case <-sub.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Subscription wasn't done after the stream ended")
+	}
+	if sub.Err() == nil {
+		t.Fatal("Expected an error after the stream ended")
+	}
+}
+
+func TestHubOpenError(t *testing.T) {
+	h := newHub(func(id string) (containerReader, error) {
+		return nil, errors.New("no such container")
+	})
+	if _, err := h.subscribe("c1"); err == nil {
+		t.Fatal("Expected error")
+	}
+	if len(h.streams) != 0 {
+		t.Fatalf("Expected no streams, got %d", len(h.streams))
+	}
+}
@@ -0,0 +1,397 @@
+package stats
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	jwt "github.com/dgrijalva/jwt-go"
+
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/rancher/websocket-proxy/backend"
+	"github.com/rancher/websocket-proxy/common"
+	"golang.org/x/net/context"
+
+	"github.com/rancher/host-api/auth"
+)
+
+// How long a scrape waits for containers that don't have a sample yet.
+const metricsSampleTimeout = 2 * time.Second
+
+// rancherLabelPrefix marks the container labels that are added to metrics.
+const rancherLabelPrefix = "io.rancher."
+
+// MetricsHTTPHandler serves host and container metrics in the Prometheus text
+// format.
+type MetricsHTTPHandler struct {
+}
+
+func (m *MetricsHTTPHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	metrics, err := metricsSource.gather()
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Error gathering metrics.")
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.write(rw)
+}
+
+// MetricsHandler sends the same metrics as MetricsHTTPHandler through the
+// websocket proxy, in a single message.
+type MetricsHandler struct {
+}
+
+func (m *MetricsHandler) Handle(key string, initialMessage string, incomingMessages <-chan string, response chan<- common.Message) {
+	defer backend.SignalHandlerClosed(key, response)
+
+	requestUrl, err := url.Parse(initialMessage)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "message": initialMessage}).Error("Couldn't parse url from message.")
+		return
+	}
+	token, valid := auth.GetAndCheckToken(requestUrl.Query().Get("token"))
+	if !valid {
+		return
+	}
+	if !hasHostScope(token) {
+		log.Warn("Metrics token isn't for the host's stats.")
+		return
+	}
+
+	metrics, err := metricsSource.gather()
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Error gathering metrics.")
+		return
+	}
+	buf := &bytes.Buffer{}
+	metrics.write(buf)
+	response <- common.Message{
+		Key:  key,
+		Type: common.Body,
+		Body: buf.String(),
+	}
+}
+
+// hasHostScope is whether a token is for the host's stats, like those given
+// to the host stats handler. Metrics include every container on the host, so
+// a token for some of its containers isn't enough.
+func hasHostScope(token *jwt.Token) bool {
+	resourceId, _ := token.Claims["resourceId"].(string)
+	return resourceId != ""
+}
+
+func listContainers() ([]types.Container, error) {
+	dclient, err := client.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+	dclient.UpdateClientVersion("1.22")
+	return dclient.ContainerList(context.Background(), types.ContainerListOptions{})
+}
+
+// metricsSource is shared by every scrape and by the stats sink.
+var metricsSource = newMetricsCollector(statsHub, listContainers)
+
+// metricsCollector keeps the streams of the host and of every running
+// container open between scrapes, so that a scrape only reads their latest
+// samples.
+type metricsCollector struct {
+	sync.Mutex
+	h    *hub
+	list func() ([]types.Container, error)
+	subs map[string]*subscription
+}
+
+func newMetricsCollector(h *hub, list func() ([]types.Container, error)) *metricsCollector {
+	return &metricsCollector{
+		h:    h,
+		list: list,
+		subs: map[string]*subscription{},
+	}
+}
+
+// gather takes the latest sample of the host and of every running container.
+func (c *metricsCollector) gather() (*metricSet, error) {
+	containers, err := c.list()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{hostStreamId}
+	for _, container := range containers {
+		ids = append(ids, container.ID)
+	}
+	samples := c.latestSamples(ids)
+
+	metrics := newMetricSet()
+	if stats := samples[hostStreamId]; stats != nil {
+		addHostMetrics(metrics, stats)
+	}
+	for _, container := range containers {
+		if stats := samples[container.ID]; stats != nil {
+			addContainerMetrics(metrics, stats, containerLabels(container))
+		}
+	}
+	return metrics, nil
+}
+
+// latestSamples returns the latest sample of each stream. Streams that aren't
+// open yet are subscribed to and waited on a little, and those of containers
+// that are gone are closed. Streams that can't be opened, like for containers
+// that just stopped, are left out.
+func (c *metricsCollector) latestSamples(ids []string) map[string]*containerStats {
+	c.Lock()
+	defer c.Unlock()
+
+	wanted := map[string]bool{}
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	for id, sub := range c.subs {
+		select {
+		case <-sub.Done():
+		default:
+			if wanted[id] {
+				continue
+			}
+		}
+		sub.Close()
+		delete(c.subs, id)
+	}
+	for _, id := range ids {
+		if _, ok := c.subs[id]; ok {
+			continue
+		}
+		sub, err := c.h.subscribe(id)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "id": id}).Debug("Couldn't get stats for metrics.")
+			continue
+		}
+		c.subs[id] = sub
+	}
+
+	timeout := time.After(metricsSampleTimeout)
+	samples := map[string]*containerStats{}
+	for id, sub := range c.subs {
+		stats, _ := sub.Latest()
+		if stats == nil {
+			select {
+			case <-sub.Updated():
+			case <-sub.Done():
+			case <-timeout:
+			}
+			stats, _ = sub.Latest()
+		}
+		if stats != nil {
+			samples[id] = stats
+		}
+	}
+	return samples
+}
+
+// close closes every stream the collector holds.
+func (c *metricsCollector) close() {
+	c.Lock()
+	defer c.Unlock()
+	for id, sub := range c.subs {
+		sub.Close()
+		delete(c.subs, id)
+	}
+}
+
+// containerLabels are the labels identifying a container's metrics: its id,
+// name and image, and its Rancher labels.
+func containerLabels(container types.Container) []string {
+	name := ""
+	if len(container.Names) > 0 {
+		name = strings.TrimPrefix(container.Names[0], "/")
+	}
+	labels := []string{"id", container.ID, "name", name, "image", container.Image}
+
+	keys := []string{}
+	for key := range container.Labels {
+		if strings.HasPrefix(key, rancherLabelPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		labels = append(labels, "container_label_"+sanitizeLabelName(key), container.Labels[key])
+	}
+	return labels
+}
+
+func addContainerMetrics(m *metricSet, stats *containerStats, labels []string) {
+	with := func(extra ...string) []string {
+		return append(append([]string{}, labels...), extra...)
+	}
+	seconds := func(ns uint64) float64 {
+		return float64(ns) / float64(time.Second)
+	}
+
+	m.add("container_cpu_usage_seconds_total", metricCounter, "Cumulative CPU time consumed.", seconds(stats.Cpu.Usage.Total), labels...)
+	m.add("container_cpu_user_seconds_total", metricCounter, "Cumulative user CPU time consumed.", seconds(stats.Cpu.Usage.User), labels...)
+	m.add("container_cpu_system_seconds_total", metricCounter, "Cumulative system CPU time consumed.", seconds(stats.Cpu.Usage.System), labels...)
+	m.add("container_cpu_cfs_periods_total", metricCounter, "Number of elapsed enforcement periods.", float64(stats.Cpu.Throttling.Periods), labels...)
+	m.add("container_cpu_cfs_throttled_periods_total", metricCounter, "Number of throttled periods.", float64(stats.Cpu.Throttling.ThrottledPeriods), labels...)
+	m.add("container_cpu_cfs_throttled_seconds_total", metricCounter, "Total time the container was throttled.", seconds(stats.Cpu.Throttling.ThrottledTime), labels...)
+
+	m.add("container_memory_usage_bytes", metricGauge, "Current memory usage, including all memory regardless of when it was accessed.", float64(stats.Memory.Usage), labels...)
+	m.add("container_memory_working_set_bytes", metricGauge, "Current working set.", float64(stats.Memory.WorkingSet), labels...)
+	m.add("container_memory_cache", metricGauge, "Page cache memory.", float64(stats.Memory.Cache), labels...)
+	m.add("container_memory_rss", metricGauge, "Anonymous and swap cache memory.", float64(stats.Memory.RSS), labels...)
+	m.add("container_memory_swap", metricGauge, "Swap usage.", float64(stats.Memory.Swap), labels...)
+	m.add("container_memory_failcnt", metricCounter, "Number of times memory usage hit the limit.", float64(stats.Memory.Failcnt), labels...)
+	m.add("container_spec_memory_limit_bytes", metricGauge, "Memory limit.", float64(stats.Memory.Limit), labels...)
+	if stats.Pids != nil {
+		m.add("container_pids", metricGauge, "Number of processes and threads.", float64(stats.Pids.Current), labels...)
+	}
+
+	for _, iface := range stats.Network.Interfaces {
+		addInterfaceMetrics(m, "container", iface, with("interface", iface.Name))
+	}
+	if stats.Network.Tcp != nil {
+		addTcpMetrics(m, "container", stats.Network.Tcp, labels)
+	}
+	if stats.Pressure != nil {
+		addPressureMetrics(m, "container", stats.Pressure, labels)
+	}
+	for _, fs := range stats.Filesystem {
+		fsLabels := with("mountpoint", fs.Mountpoint, "type", fs.Type)
+		m.add("container_fs_usage_bytes", metricGauge, "Bytes used by the writable layer, or on the filesystem of a mount.", float64(fs.Usage), fsLabels...)
+		if fs.Type != fsTypeRootfs {
+			m.add("container_fs_limit_bytes", metricGauge, "Size of the filesystem of a mount.", float64(fs.Limit), fsLabels...)
+			m.add("container_fs_inodes_free", metricGauge, "Free inodes on the filesystem of a mount.", float64(fs.InodesFree), fsLabels...)
+		}
+	}
+	for _, device := range stats.DiskIo.IoServiceBytes {
+		deviceLabels := with("device", deviceLabel(device))
+		m.add("container_fs_reads_bytes_total", metricCounter, "Cumulative bytes read.", float64(device.Stats["Read"]), deviceLabels...)
+		m.add("container_fs_writes_bytes_total", metricCounter, "Cumulative bytes written.", float64(device.Stats["Write"]), deviceLabels...)
+	}
+	for _, device := range stats.DiskIo.IoServiced {
+		deviceLabels := with("device", deviceLabel(device))
+		m.add("container_fs_reads_total", metricCounter, "Cumulative reads completed.", float64(device.Stats["Read"]), deviceLabels...)
+		m.add("container_fs_writes_total", metricCounter, "Cumulative writes completed.", float64(device.Stats["Write"]), deviceLabels...)
+	}
+}
+
+func addHostMetrics(m *metricSet, stats *containerStats) {
+	seconds := func(ns uint64) float64 {
+		return float64(ns) / float64(time.Second)
+	}
+
+	// The host's total includes idle time.
+	idle := uint64(0)
+	if busy := stats.Cpu.Usage.User + stats.Cpu.Usage.System; stats.Cpu.Usage.Total > busy {
+		idle = stats.Cpu.Usage.Total - busy
+	}
+	m.add("host_cpu_seconds_total", metricCounter, "Cumulative CPU time by mode.", seconds(stats.Cpu.Usage.User), "mode", "user")
+	m.add("host_cpu_seconds_total", metricCounter, "Cumulative CPU time by mode.", seconds(stats.Cpu.Usage.System), "mode", "system")
+	m.add("host_cpu_seconds_total", metricCounter, "Cumulative CPU time by mode.", seconds(idle), "mode", "idle")
+
+	m.add("host_memory_usage_bytes", metricGauge, "Memory in use.", float64(stats.Memory.Usage))
+	m.add("host_memory_cache_bytes", metricGauge, "Page cache and buffers.", float64(stats.Memory.Cache))
+	m.add("host_memory_total_bytes", metricGauge, "Total memory.", float64(stats.Memory.Limit))
+	m.add("host_memory_swap_bytes", metricGauge, "Swap in use.", float64(stats.Memory.Swap))
+
+	if stats.Load != nil {
+		m.add("host_load1", metricGauge, "1 minute load average.", stats.Load.Load1)
+		m.add("host_load5", metricGauge, "5 minute load average.", stats.Load.Load5)
+		m.add("host_load15", metricGauge, "15 minute load average.", stats.Load.Load15)
+	}
+	if stats.Pressure != nil {
+		addPressureMetrics(m, "host", stats.Pressure, nil)
+	}
+	if stats.FileDescriptors != nil {
+		m.add("host_file_descriptors_allocated", metricGauge, "File handles allocated.", float64(stats.FileDescriptors.Allocated))
+		m.add("host_file_descriptors_max", metricGauge, "Most file handles that can be allocated.", float64(stats.FileDescriptors.Max))
+	}
+	if stats.Uptime > 0 {
+		m.add("host_uptime_seconds", metricGauge, "Seconds since boot.", float64(stats.Uptime))
+	}
+
+	for _, fs := range stats.Filesystem {
+		labels := []string{"device", fs.Device, "mountpoint", fs.Mountpoint, "fstype", fs.Type}
+		m.add("host_filesystem_size_bytes", metricGauge, "Filesystem size.", float64(fs.Limit), labels...)
+		m.add("host_filesystem_used_bytes", metricGauge, "Filesystem space used.", float64(fs.Usage), labels...)
+		m.add("host_filesystem_avail_bytes", metricGauge, "Filesystem space available to unprivileged users.", float64(fs.Available), labels...)
+		m.add("host_filesystem_files", metricGauge, "Filesystem inodes.", float64(fs.Inodes), labels...)
+		m.add("host_filesystem_files_free", metricGauge, "Filesystem inodes free.", float64(fs.InodesFree), labels...)
+	}
+	for _, iface := range stats.Network.Interfaces {
+		addInterfaceMetrics(m, "host", iface, []string{"interface", iface.Name})
+	}
+	if stats.Network.Tcp != nil {
+		addTcpMetrics(m, "host", stats.Network.Tcp, nil)
+	}
+	for _, device := range stats.DiskIo.IoServiceBytes {
+		labels := []string{"device", deviceLabel(device)}
+		m.add("host_disk_read_bytes_total", metricCounter, "Cumulative bytes read.", float64(device.Stats["Read"]), labels...)
+		m.add("host_disk_written_bytes_total", metricCounter, "Cumulative bytes written.", float64(device.Stats["Write"]), labels...)
+	}
+	for _, device := range stats.DiskIo.IoServiced {
+		labels := []string{"device", deviceLabel(device)}
+		m.add("host_disk_reads_completed_total", metricCounter, "Cumulative reads completed.", float64(device.Stats["Read"]), labels...)
+		m.add("host_disk_writes_completed_total", metricCounter, "Cumulative writes completed.", float64(device.Stats["Write"]), labels...)
+	}
+}
+
+func addInterfaceMetrics(m *metricSet, prefix string, iface InterfaceStats, labels []string) {
+	m.add(prefix+"_network_receive_bytes_total", metricCounter, "Cumulative bytes received.", float64(iface.RxBytes), labels...)
+	m.add(prefix+"_network_transmit_bytes_total", metricCounter, "Cumulative bytes transmitted.", float64(iface.TxBytes), labels...)
+	m.add(prefix+"_network_receive_packets_total", metricCounter, "Cumulative packets received.", float64(iface.RxPackets), labels...)
+	m.add(prefix+"_network_transmit_packets_total", metricCounter, "Cumulative packets transmitted.", float64(iface.TxPackets), labels...)
+	m.add(prefix+"_network_receive_errors_total", metricCounter, "Cumulative errors while receiving.", float64(iface.RxErrors), labels...)
+	m.add(prefix+"_network_transmit_errors_total", metricCounter, "Cumulative errors while transmitting.", float64(iface.TxErrors), labels...)
+	m.add(prefix+"_network_receive_packets_dropped_total", metricCounter, "Cumulative packets dropped while receiving.", float64(iface.RxDropped), labels...)
+	m.add(prefix+"_network_transmit_packets_dropped_total", metricCounter, "Cumulative packets dropped while transmitting.", float64(iface.TxDropped), labels...)
+}
+
+func addTcpMetrics(m *metricSet, prefix string, tcp *TcpStats, labels []string) {
+	m.add(prefix+"_network_tcp_connections", metricGauge, "TCP connections established or closing.", float64(tcp.CurrEstab), labels...)
+	m.add(prefix+"_network_tcp_active_opens_total", metricCounter, "Cumulative TCP connections opened.", float64(tcp.ActiveOpens), labels...)
+	m.add(prefix+"_network_tcp_passive_opens_total", metricCounter, "Cumulative TCP connections accepted.", float64(tcp.PassiveOpens), labels...)
+	m.add(prefix+"_network_tcp_attempt_fails_total", metricCounter, "Cumulative TCP connection attempts that failed.", float64(tcp.AttemptFails), labels...)
+	m.add(prefix+"_network_tcp_resets_total", metricCounter, "Cumulative established TCP connections reset.", float64(tcp.EstabResets), labels...)
+	m.add(prefix+"_network_tcp_retransmitted_segments_total", metricCounter, "Cumulative TCP segments retransmitted.", float64(tcp.RetransSegs), labels...)
+	m.add(prefix+"_network_tcp_segments_sent_total", metricCounter, "Cumulative TCP segments sent.", float64(tcp.OutSegs), labels...)
+	m.add(prefix+"_network_tcp_segments_received_total", metricCounter, "Cumulative TCP segments received.", float64(tcp.InSegs), labels...)
+}
+
+// addPressureMetrics reports the total time stalled, as with cAdvisor, since
+// averages can be worked out from the counters.
+func addPressureMetrics(m *metricSet, prefix string, pressure *PressureStats, labels []string) {
+	seconds := func(us uint64) float64 {
+		return float64(us) / float64(time.Second/time.Microsecond)
+	}
+	for _, resource := range []struct {
+		name     string
+		pressure *ResourcePressure
+	}{
+		{"cpu", pressure.Cpu},
+		{"memory", pressure.Memory},
+		{"io", pressure.Io},
+	} {
+		if resource.pressure == nil {
+			continue
+		}
+		m.add(prefix+"_pressure_"+resource.name+"_waiting_seconds_total", metricCounter, "Cumulative time some tasks were stalled on "+resource.name+".", seconds(resource.pressure.Some.Total), labels...)
+		m.add(prefix+"_pressure_"+resource.name+"_stalled_seconds_total", metricCounter, "Cumulative time all non-idle tasks were stalled on "+resource.name+".", seconds(resource.pressure.Full.Total), labels...)
+	}
+}
+
+func deviceLabel(device PerDiskStats) string {
+	if device.Device != "" {
+		return device.Device
+	}
+	return strconv.FormatUint(device.Major, 10) + ":" + strconv.FormatUint(device.Minor, 10)
+}
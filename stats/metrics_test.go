@@ -0,0 +1,138 @@
+package stats
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/docker/engine-api/types"
+)
+
+func TestMetricSetWrite(t *testing.T) {
+	m := newMetricSet()
+	m.add("test_bytes", metricGauge, "Some bytes.", 1024, "name", `a "quoted"\name`)
+	m.add("test_total", metricCounter, "A count.", 1.5)
+	m.add("test_bytes", metricGauge, "Some bytes.", 2048, "name", "b")
+
+	buf := &bytes.Buffer{}
+	if err := m.write(buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP test_bytes Some bytes.
+# TYPE test_bytes gauge
+test_bytes{name="a \"quoted\"\\name"} 1024
+test_bytes{name="b"} 2048
+# HELP test_total A count.
+# TYPE test_total counter
+test_total 1.5
+`
+	if buf.String() != expected {
+		t.Errorf("Got:\n%s\nExpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestGatherMetrics(t *testing.T) {
+	readers := map[string]*fakeReader{
+		hostStreamId: newFakeReader(),
+		"c1":         newFakeReader(),
+	}
+	h := newHub(func(id string) (containerReader, error) {
+		return readers[id], nil
+	})
+	for id, reader := range readers {
+		go func(id string, reader *fakeReader) {
+			stats := &containerStats{}
+			stats.Memory.Usage = 100
+			stats.Network.Interfaces = []InterfaceStats{{Name: "eth0", RxBytes: 10}}
+			if id == hostStreamId {
+				stats.Load = &LoadStats{Load1: 0.5}
+			}
+			select {
+			case reader.samples <- stats:
+			case <-reader.closed:
+			}
+		}(id, reader)
+	}
+
+	list := func() ([]types.Container, error) {
+		return []types.Container{{
+			ID:     "c1",
+			Names:  []string{"/web"},
+			Image:  "nginx",
+			Labels: map[string]string{"io.rancher.stack.name": "front", "other": "x"},
+		}}, nil
+	}
+	c := newMetricsCollector(h, list)
+	defer c.close()
+	metrics, err := c.gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	metrics.write(buf)
+	output := buf.String()
+
+	for _, line := range []string{
+		`container_memory_usage_bytes{id="c1",name="web",image="nginx",container_label_io_rancher_stack_name="front"} 100`,
+		`container_network_receive_bytes_total{id="c1",name="web",image="nginx",container_label_io_rancher_stack_name="front",interface="eth0"} 10`,
+		`host_load1 0.5`,
+		`host_network_receive_bytes_total{interface="eth0"} 10`,
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("Missing %s in:\n%s", line, output)
+		}
+	}
+	if strings.Contains(output, "other") {
+		t.Error("Only Rancher labels should be added")
+	}
+}
+
+func TestMetricsCollectorKeepsStreamsOpen(t *testing.T) {
+	opens := 0
+	reader := newFakeReader()
+	h := newHub(func(id string) (containerReader, error) {
+		opens++
+		return reader, nil
+	})
+	go func() {
+		for {
+			select {
+			case reader.samples <- &containerStats{}:
+			case <-reader.closed:
+				return
+			}
+		}
+	}()
+
+	list := func() ([]types.Container, error) {
+		return nil, nil
+	}
+	c := newMetricsCollector(h, list)
+	for i := 0; i < 3; i++ {
+		if _, err := c.gather(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if opens != 1 {
+		t.Errorf("Expected the host's stream to be opened once, got %d", opens)
+	}
+	c.close()
+	select {
+	case <-reader.closed:
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the stream to be closed")
+	}
+}
+
+func TestHasHostScope(t *testing.T) {
+	host := &jwt.Token{Claims: map[string]interface{}{"resourceId": "1h1"}}
+	if !hasHostScope(host) {
+		t.Error("Expected a host token to have the host's scope")
+	}
+	containers := &jwt.Token{Claims: map[string]interface{}{"containerIds": map[string]interface{}{"c1": "1i1"}}}
+	if hasHostScope(containers) {
+		t.Error("Expected a container token not to have the host's scope")
+	}
+}
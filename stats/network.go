@@ -0,0 +1,229 @@
+package stats
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+
+	"github.com/rancher/host-api/config"
+	"github.com/rancher/host-api/proc"
+)
+
+const (
+	statsNetworkProc    = "proc"
+	statsNetworkNetlink = "netlink"
+)
+
+// TcpStats are counters from the Tcp lines of /proc/net/snmp.
+type TcpStats struct {
+	// Connections opened from and to the network namespace.
+	ActiveOpens  uint64 `json:"active_opens"`
+	PassiveOpens uint64 `json:"passive_opens"`
+	// Connection attempts that failed, and established connections reset.
+	AttemptFails uint64 `json:"attempt_fails"`
+	EstabResets  uint64 `json:"estab_resets"`
+	// Connections currently established or closing.
+	CurrEstab uint64 `json:"curr_estab"`
+	// Segments received, sent and retransmitted.
+	InSegs      uint64 `json:"in_segs"`
+	OutSegs     uint64 `json:"out_segs"`
+	RetransSegs uint64 `json:"retrans_segs"`
+	// Segments received with errors, and resets sent.
+	InErrs  uint64 `json:"in_errs"`
+	OutRsts uint64 `json:"out_rsts"`
+}
+
+// networkReader reads the network stats of a container's network namespace,
+// through the /proc of its init process or with netlink, depending on
+// --stats-network. Errors are logged when reading starts failing rather than
+// on every sample.
+type networkReader struct {
+	id      string
+	pid     int
+	failing bool
+}
+
+func newNetworkReader(id string, pid int) *networkReader {
+	return &networkReader{
+		id:  id,
+		pid: pid,
+	}
+}
+
+func (r *networkReader) read(stats *containerStats) {
+	var err error
+	if config.Config.StatsNetwork == statsNetworkNetlink {
+		stats.Network.Interfaces, err = getNetlinkInterfaceStats(r.pid)
+	} else {
+		stats.Network.Interfaces, stats.Network.Tcp, err = getProcNetworkStats(r.pid)
+	}
+
+	if err != nil && !r.failing {
+		log.WithFields(log.Fields{"error": err, "id": r.id}).Warn("Couldn't read container network stats.")
+	} else if err == nil && r.failing {
+		log.WithFields(log.Fields{"id": r.id}).Info("Reading container network stats again.")
+	}
+	r.failing = err != nil
+}
+
+// getProcNetworkStats reads the interfaces and TCP counters of the network
+// namespace of a process from its /proc/<pid>/net.
+func getProcNetworkStats(pid int) ([]InterfaceStats, *TcpStats, error) {
+	dir := strconv.Itoa(pid)
+	data, err := ioutil.ReadFile(proc.Path(dir, "net", "dev"))
+	if err != nil {
+		return nil, nil, err
+	}
+	interfaces, err := parseNetDev(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err = ioutil.ReadFile(proc.Path(dir, "net", "snmp"))
+	if err != nil {
+		return nil, nil, err
+	}
+	tcp, err := parseSnmpTcp(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return interfaces, tcp, nil
+}
+
+// getHostTcpStats reads the host's TCP counters.
+func getHostTcpStats() (*TcpStats, error) {
+	data, err := ioutil.ReadFile(proc.Path("net", "snmp"))
+	if err != nil {
+		return nil, err
+	}
+	return parseSnmpTcp(data)
+}
+
+// parseNetDev parses /proc/net/dev, skipping loopback. After two header lines
+// each interface has eight receive counters and eight transmit ones.
+func parseNetDev(data []byte) ([]InterfaceStats, error) {
+	interfaces := []InterfaceStats{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 0; scanner.Scan(); line++ {
+		if line < 2 {
+			continue
+		}
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid net/dev line %q", scanner.Text())
+		}
+		name := strings.TrimSpace(parts[0])
+		if name == "lo" {
+			continue
+		}
+		fields := strings.Fields(parts[1])
+		if len(fields) < 16 {
+			return nil, fmt.Errorf("Invalid net/dev line %q", scanner.Text())
+		}
+		values := make([]uint64, 16)
+		for i := range values {
+			value, err := strconv.ParseUint(fields[i], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid net/dev line %q", scanner.Text())
+			}
+			values[i] = value
+		}
+		interfaces = append(interfaces, InterfaceStats{
+			Name:      name,
+			RxBytes:   values[0],
+			RxPackets: values[1],
+			RxErrors:  values[2],
+			RxDropped: values[3],
+			TxBytes:   values[8],
+			TxPackets: values[9],
+			TxErrors:  values[10],
+			TxDropped: values[11],
+		})
+	}
+	return interfaces, scanner.Err()
+}
+
+// parseSnmpTcp parses the Tcp lines of /proc/net/snmp, a line of names
+// followed by a line of values.
+func parseSnmpTcp(data []byte) (*TcpStats, error) {
+	var names []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "Tcp:") {
+			continue
+		}
+		fields := strings.Fields(line)[1:]
+		if names == nil {
+			names = fields
+			continue
+		}
+		if len(fields) != len(names) {
+			return nil, fmt.Errorf("Invalid snmp Tcp line %q", line)
+		}
+
+		tcp := &TcpStats{}
+		counters := map[string]*uint64{
+			"ActiveOpens":  &tcp.ActiveOpens,
+			"PassiveOpens": &tcp.PassiveOpens,
+			"AttemptFails": &tcp.AttemptFails,
+			"EstabResets":  &tcp.EstabResets,
+			"CurrEstab":    &tcp.CurrEstab,
+			"InSegs":       &tcp.InSegs,
+			"OutSegs":      &tcp.OutSegs,
+			"RetransSegs":  &tcp.RetransSegs,
+			"InErrs":       &tcp.InErrs,
+			"OutRsts":      &tcp.OutRsts,
+		}
+		for i, name := range names {
+			if counter, ok := counters[name]; ok {
+				*counter, _ = strconv.ParseUint(fields[i], 10, 64)
+			}
+		}
+		return tcp, nil
+	}
+	return nil, fmt.Errorf("No Tcp counters in snmp")
+}
+
+// getNetlinkInterfaceStats lists the interfaces in the network namespace of a
+// process with netlink, which means opening a handle in the namespace.
+func getNetlinkInterfaceStats(pid int) ([]InterfaceStats, error) {
+	nsHandle, err := netns.GetFromPid(pid)
+	if err != nil {
+		return nil, err
+	}
+	defer nsHandle.Close()
+	handle, err := netlink.NewHandleAt(nsHandle)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Delete()
+	links, err := handle.LinkList()
+	if err != nil {
+		return nil, err
+	}
+
+	interfaces := []InterfaceStats{}
+	for _, link := range links {
+		attrs := link.Attrs()
+		if attrs.Name == "lo" || attrs.Statistics == nil {
+			continue
+		}
+		interfaces = append(interfaces, InterfaceStats{
+			Name:      attrs.Name,
+			RxBytes:   uint64(attrs.Statistics.RxBytes),
+			RxPackets: uint64(attrs.Statistics.RxPackets),
+			RxErrors:  uint64(attrs.Statistics.RxErrors),
+			RxDropped: uint64(attrs.Statistics.RxDropped),
+			TxBytes:   uint64(attrs.Statistics.TxBytes),
+			TxPackets: uint64(attrs.Statistics.TxPackets),
+			TxErrors:  uint64(attrs.Statistics.TxErrors),
+			TxDropped: uint64(attrs.Statistics.TxDropped),
+		})
+	}
+	return interfaces, nil
+}
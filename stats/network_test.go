@@ -0,0 +1,98 @@
+package stats
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+const testNetDev = `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo:    1024      10    0    0    0     0          0         0     1024      10    0    0    0     0       0          0
+  eth0: 5000000    4000    1    2    0     0          0         0  3000000    2500    3    4    0     0       0          0
+`
+
+const testSnmp = `Ip: Forwarding DefaultTTL InReceives
+Ip: 1 64 12345
+Tcp: RtoAlgorithm RtoMin RtoMax MaxConn ActiveOpens PassiveOpens AttemptFails EstabResets CurrEstab InSegs OutSegs RetransSegs InErrs OutRsts InCsumErrors
+Tcp: 1 200 120000 -1 41 39 2 10 8 4331 4330 17 1 4 0
+Udp: InDatagrams NoPorts
+Udp: 10 0
+`
+
+func TestParseNetDev(t *testing.T) {
+	interfaces, err := parseNetDev([]byte(testNetDev))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := InterfaceStats{
+		Name:      "eth0",
+		RxBytes:   5000000,
+		RxPackets: 4000,
+		RxErrors:  1,
+		RxDropped: 2,
+		TxBytes:   3000000,
+		TxPackets: 2500,
+		TxErrors:  3,
+		TxDropped: 4,
+	}
+	if len(interfaces) != 1 || interfaces[0] != expected {
+		t.Errorf("Got %+v, expected only %+v", interfaces, expected)
+	}
+
+	if _, err := parseNetDev([]byte(testNetDev + "  eth1: 1 2 3\n")); err == nil {
+		t.Error("Expected an error for a short line")
+	}
+}
+
+func TestParseSnmpTcp(t *testing.T) {
+	tcp, err := parseSnmpTcp([]byte(testSnmp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := TcpStats{
+		ActiveOpens:  41,
+		PassiveOpens: 39,
+		AttemptFails: 2,
+		EstabResets:  10,
+		CurrEstab:    8,
+		InSegs:       4331,
+		OutSegs:      4330,
+		RetransSegs:  17,
+		InErrs:       1,
+		OutRsts:      4,
+	}
+	if *tcp != expected {
+		t.Errorf("Got %+v, expected %+v", *tcp, expected)
+	}
+
+	if _, err := parseSnmpTcp([]byte("Ip: Forwarding\nIp: 1\n")); err == nil {
+		t.Error("Expected an error without Tcp lines")
+	}
+}
+
+func TestProcNetworkStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{
+		"42/net/dev":  testNetDev,
+		"42/net/snmp": testSnmp,
+	})
+	os.Setenv("HOST_PROC", dir)
+	defer os.Unsetenv("HOST_PROC")
+
+	interfaces, tcp, err := getProcNetworkStats(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(interfaces) != 1 || tcp == nil || tcp.RetransSegs != 17 {
+		t.Errorf("Got %+v and %+v", interfaces, tcp)
+	}
+
+	if _, _, err := getProcNetworkStats(43); err == nil {
+		t.Error("Expected an error for a process that's gone")
+	}
+}
@@ -0,0 +1,125 @@
+package stats
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/rancher/host-api/config"
+)
+
+// oneShotTimeout is how long a one-shot request waits for every container to
+// have a sample.
+const oneShotTimeout = 5 * time.Second
+
+// streamOptions are the per-request settings for a stats stream, taken from
+// the URL's query parameters.
+type streamOptions struct {
+	// interval is how often a sample is sent, within the host's configured
+	// bounds.
+	interval time.Duration
+	// oneShot sends a single sample and then closes the stream.
+	oneShot bool
+	// rates adds rates computed from consecutive samples to each one.
+	rates bool
+	// format is json for full stats on every line, or delta for changes
+	// after a keyframe.
+	format string
+	// metadata adds each container's name, image, stack and service.
+	metadata bool
+	// rollup adds up the containers of each service or stack. Samples of
+	// different containers aren't taken together, so rollups start from the
+	// live samples and no history is sent before them.
+	rollup string
+	// processes is how many of each container's busiest processes are
+	// sent with its stats.
+	processes int
+}
+
+func parseStreamOptions(query url.Values) (*streamOptions, error) {
+	opts := &streamOptions{
+		interval: time.Second,
+		format:   formatJSON,
+	}
+
+	if val := query.Get("interval"); val != "" {
+		interval, err := parseInterval(val)
+		if err != nil {
+			return nil, err
+		}
+		opts.interval = interval
+	}
+	if opts.interval < config.Config.StatsMinInterval {
+		opts.interval = config.Config.StatsMinInterval
+	}
+	if config.Config.StatsMaxInterval > 0 && opts.interval > config.Config.StatsMaxInterval {
+		opts.interval = config.Config.StatsMaxInterval
+	}
+
+	if val := query.Get("oneshot"); val != "" {
+		oneShot, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid oneshot value %s", val)
+		}
+		opts.oneShot = oneShot
+	}
+
+	if val := query.Get("rates"); val != "" {
+		rates, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid rates value %s", val)
+		}
+		opts.rates = rates
+	}
+
+	if val := query.Get("format"); val != "" {
+		if val != formatJSON && val != formatDelta {
+			return nil, fmt.Errorf("Invalid format %s", val)
+		}
+		opts.format = val
+	}
+
+	if val := query.Get("metadata"); val != "" {
+		metadata, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid metadata value %s", val)
+		}
+		opts.metadata = metadata
+	}
+
+	if val := query.Get("rollup"); val != "" {
+		if val != rollupService && val != rollupStack {
+			return nil, fmt.Errorf("Invalid rollup %s", val)
+		}
+		opts.rollup = val
+	}
+
+	if val := query.Get("processes"); val != "" {
+		processes, err := strconv.Atoi(val)
+		if err != nil || processes < 0 {
+			return nil, fmt.Errorf("Invalid processes value %s", val)
+		}
+		if processes > maxTopProcesses {
+			processes = maxTopProcesses
+		}
+		opts.processes = processes
+	}
+
+	return opts, nil
+}
+
+// parseInterval accepts a positive duration such as 5s or 500ms, or a number
+// of seconds.
+func parseInterval(val string) (time.Duration, error) {
+	var interval time.Duration
+	if seconds, err := strconv.ParseFloat(val, 64); err == nil {
+		interval = time.Duration(seconds * float64(time.Second))
+	} else if interval, err = time.ParseDuration(val); err != nil {
+		return 0, fmt.Errorf("Invalid interval %s", val)
+	}
+	if interval <= 0 {
+		return 0, fmt.Errorf("Invalid interval %s", val)
+	}
+	return interval, nil
+}
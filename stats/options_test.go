@@ -0,0 +1,48 @@
+package stats
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/rancher/host-api/config"
+)
+
+func TestParseStreamOptions(t *testing.T) {
+	oldMin, oldMax := config.Config.StatsMinInterval, config.Config.StatsMaxInterval
+	defer func() {
+		config.Config.StatsMinInterval, config.Config.StatsMaxInterval = oldMin, oldMax
+	}()
+	config.Config.StatsMinInterval = time.Second
+	config.Config.StatsMaxInterval = time.Minute
+
+	tests := []struct {
+		query    string
+		interval time.Duration
+		oneShot  bool
+	}{
+		{"", time.Second, false},
+		{"interval=5", 5 * time.Second, false},
+		{"interval=2500ms", 2500 * time.Millisecond, false},
+		{"interval=100ms", time.Second, false},
+		{"interval=1h", time.Minute, false},
+		{"oneshot=true", time.Second, true},
+	}
+	for _, test := range tests {
+		query, _ := url.ParseQuery(test.query)
+		opts, err := parseStreamOptions(query)
+		if err != nil {
+			t.Fatalf("%s: %v", test.query, err)
+		}
+		if opts.interval != test.interval || opts.oneShot != test.oneShot {
+			t.Errorf("%s: got %v/%v, expected %v/%v", test.query, opts.interval, opts.oneShot, test.interval, test.oneShot)
+		}
+	}
+
+	for _, bad := range []string{"interval=soon", "interval=0", "interval=-1", "interval=-5s", "oneshot=maybe", "format=msgpack"} {
+		query, _ := url.ParseQuery(bad)
+		if _, err := parseStreamOptions(query); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+}
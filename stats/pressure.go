@@ -0,0 +1,121 @@
+package stats
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rancher/host-api/proc"
+)
+
+// PressureStats are the pressure stall information of every resource.
+type PressureStats struct {
+	Cpu    *ResourcePressure `json:"cpu,omitempty"`
+	Memory *ResourcePressure `json:"memory,omitempty"`
+	Io     *ResourcePressure `json:"io,omitempty"`
+}
+
+// ResourcePressure is how long some, or all, non-idle tasks were stalled
+// waiting for a resource.
+type ResourcePressure struct {
+	Some PressureAverages `json:"some"`
+	Full PressureAverages `json:"full"`
+}
+
+type PressureAverages struct {
+	// Percentage of time stalled over the last 10, 60 and 300 seconds.
+	Avg10  float64 `json:"avg10"`
+	Avg60  float64 `json:"avg60"`
+	Avg300 float64 `json:"avg300"`
+	// Cumulative time stalled.
+	// Units: Microseconds.
+	Total uint64 `json:"total"`
+}
+
+// getHostPressure reads /proc/pressure, which needs a 4.20 kernel with PSI
+// turned on.
+func getHostPressure() (*PressureStats, error) {
+	return readPressureFiles(proc.Path("pressure", "cpu"), proc.Path("pressure", "memory"), proc.Path("pressure", "io"))
+}
+
+// readCgroupPressure reads the pressure files of a cgroup v2 directory.
+func readCgroupPressure(dir string) (*PressureStats, error) {
+	return readPressureFiles(filepath.Join(dir, "cpu.pressure"), filepath.Join(dir, "memory.pressure"), filepath.Join(dir, "io.pressure"))
+}
+
+// readPressureFiles reads whichever of the files exist, failing only when
+// none of them do.
+func readPressureFiles(cpu, memory, io string) (*PressureStats, error) {
+	stats := &PressureStats{}
+	found := false
+	for _, file := range []struct {
+		path     string
+		pressure **ResourcePressure
+	}{
+		{cpu, &stats.Cpu},
+		{memory, &stats.Memory},
+		{io, &stats.Io},
+	} {
+		data, err := ioutil.ReadFile(file.path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if *file.pressure, err = parsePressure(string(data)); err != nil {
+			return nil, err
+		}
+		found = true
+	}
+	if !found {
+		return nil, fmt.Errorf("No pressure stall information in %s", filepath.Dir(cpu))
+	}
+	return stats, nil
+}
+
+// parsePressure parses a pressure file, a some line and, except for the CPU
+// on older kernels, a full line:
+//
+//	some avg10=0.00 avg60=0.00 avg300=0.00 total=0
+func parsePressure(data string) (*ResourcePressure, error) {
+	pressure := &ResourcePressure{}
+	for _, line := range strings.Split(strings.TrimSpace(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		var averages *PressureAverages
+		switch fields[0] {
+		case "some":
+			averages = &pressure.Some
+		case "full":
+			averages = &pressure.Full
+		default:
+			return nil, fmt.Errorf("Invalid pressure line %q", line)
+		}
+		for _, field := range fields[1:] {
+			parts := strings.SplitN(field, "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("Invalid pressure line %q", line)
+			}
+			var err error
+			switch parts[0] {
+			case "avg10":
+				averages.Avg10, err = strconv.ParseFloat(parts[1], 64)
+			case "avg60":
+				averages.Avg60, err = strconv.ParseFloat(parts[1], 64)
+			case "avg300":
+				averages.Avg300, err = strconv.ParseFloat(parts[1], 64)
+			case "total":
+				averages.Total, err = strconv.ParseUint(parts[1], 10, 64)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Invalid pressure line %q", line)
+			}
+		}
+	}
+	return pressure, nil
+}
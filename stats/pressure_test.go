@@ -0,0 +1,59 @@
+package stats
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestParsePressure(t *testing.T) {
+	pressure, err := parsePressure("some avg10=3.97 avg60=2.76 avg300=2.42 total=64280480\nfull avg10=0.10 avg60=0.00 avg300=0.00 total=15\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ResourcePressure{
+		Some: PressureAverages{Avg10: 3.97, Avg60: 2.76, Avg300: 2.42, Total: 64280480},
+		Full: PressureAverages{Avg10: 0.10, Total: 15},
+	}
+	if *pressure != expected {
+		t.Errorf("Got %+v, expected %+v", *pressure, expected)
+	}
+
+	// Older kernels only have a some line for the CPU.
+	pressure, err = parsePressure("some avg10=1.00 avg60=0.00 avg300=0.00 total=1\n")
+	if err != nil || pressure.Some.Avg10 != 1 || pressure.Full.Total != 0 {
+		t.Errorf("Got %+v, %v", pressure, err)
+	}
+
+	for _, data := range []string{"most avg10=1.00\n", "some avg10\n", "some avg10=x\n"} {
+		if _, err := parsePressure(data); err == nil {
+			t.Errorf("Expected an error for %q", data)
+		}
+	}
+}
+
+func TestHostPressure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("HOST_PROC", dir)
+	defer os.Unsetenv("HOST_PROC")
+
+	if _, err := getHostPressure(); err == nil {
+		t.Error("Expected an error without PSI")
+	}
+
+	writeFiles(t, dir, map[string]string{
+		"pressure/cpu": "some avg10=1.00 avg60=0.50 avg300=0.10 total=100\n",
+		"pressure/io":  "some avg10=0.00 avg60=0.00 avg300=0.00 total=5\nfull avg10=0.00 avg60=0.00 avg300=0.00 total=2\n",
+	})
+	pressure, err := getHostPressure()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pressure.Cpu == nil || pressure.Cpu.Some.Total != 100 || pressure.Memory != nil || pressure.Io == nil || pressure.Io.Full.Total != 2 {
+		t.Errorf("Got %+v", pressure)
+	}
+}
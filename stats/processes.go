@@ -0,0 +1,189 @@
+package stats
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+	"golang.org/x/net/context"
+
+	"github.com/rancher/host-api/proc"
+)
+
+// maxTopProcesses is the most processes a request can ask for.
+const maxTopProcesses = 100
+
+// ProcessStats is the usage of one process in a container.
+type ProcessStats struct {
+	Pid     int    `json:"pid"`
+	Command string `json:"command"`
+	// CPU used since the previous sample, or since the process started for
+	// the first one, as a percentage of one CPU.
+	CpuPercent float64 `json:"cpu_percent"`
+	// Total CPU time used.
+	// Units: nanoseconds
+	CpuTime uint64 `json:"cpu_time"`
+	// Units: Bytes.
+	Rss uint64 `json:"rss"`
+	// Bytes read from and written to storage, if they can be read.
+	// Units: Bytes.
+	ReadBytes  uint64 `json:"read_bytes"`
+	WriteBytes uint64 `json:"write_bytes"`
+}
+
+// processTracker samples the processes of each container of a request, the
+// ones that use the most CPU first, keeping their CPU time to work out their
+// usage between samples.
+type processTracker struct {
+	top        int
+	findPid    func(id string) (int, error)
+	containers map[string]*containerProcesses
+}
+
+type containerProcesses struct {
+	procsFile string
+	cpu       *proc.CpuUsage
+}
+
+func newProcessTracker(opts *streamOptions) *processTracker {
+	return &processTracker{
+		top:        opts.processes,
+		findPid:    containerPid,
+		containers: map[string]*containerProcesses{},
+	}
+}
+
+// sample returns the top processes of a container, or nothing if they weren't
+// asked for or can't be read.
+func (t *processTracker) sample(id string) []ProcessStats {
+	if t.top <= 0 || id == hostStreamId {
+		return nil
+	}
+	c, ok := t.containers[id]
+	if !ok {
+		procsFile, err := t.procsFile(id)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "id": id}).Debug("Couldn't find container processes.")
+			return nil
+		}
+		c = &containerProcesses{
+			procsFile: procsFile,
+			cpu:       proc.NewCpuUsage(),
+		}
+		t.containers[id] = c
+	}
+
+	processes, err := c.sample(time.Now())
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "id": id}).Debug("Couldn't read container processes.")
+		delete(t.containers, id)
+		return nil
+	}
+	sort.Sort(byProcessUsage(processes))
+	if len(processes) > t.top {
+		processes = processes[:t.top]
+	}
+	return processes
+}
+
+func (t *processTracker) forget(id string) {
+	delete(t.containers, id)
+}
+
+// procsFile finds the cgroup.procs file listing the processes of a container.
+func (t *processTracker) procsFile(id string) (string, error) {
+	pid, err := t.findPid(id)
+	if err != nil {
+		return "", err
+	}
+	cgroups, err := findCgroups(pid)
+	if err != nil {
+		return "", err
+	}
+	for _, controller := range []string{"cpuacct", "memory", "pids"} {
+		if dir := cgroups.dir(controller); dir != "" {
+			return filepath.Join(dir, "cgroup.procs"), nil
+		}
+	}
+	return "", fmt.Errorf("No cgroup with the processes of %s", id)
+}
+
+func (c *containerProcesses) sample(now time.Time) ([]ProcessStats, error) {
+	data, err := ioutil.ReadFile(c.procsFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.cpu.Next(now); err != nil {
+		return nil, err
+	}
+
+	processes := []ProcessStats{}
+	for _, field := range strings.Fields(string(data)) {
+		pid, err := strconv.Atoi(field)
+		if err != nil {
+			continue
+		}
+		// The cgroup can list processes that have exited since.
+		stat, err := proc.ReadStat(pid)
+		if err != nil {
+			continue
+		}
+		process := ProcessStats{
+			Pid:        pid,
+			Command:    stat.Command,
+			CpuPercent: c.cpu.Percent(pid, stat),
+			CpuTime:    stat.CpuTime * (uint64(time.Second) / proc.UserHz),
+			Rss:        stat.Rss,
+		}
+		// io needs the same user or root, and is skipped if it can't be read.
+		if io, err := readKeyValues(proc.Path(field, "io")); err == nil {
+			process.ReadBytes = io["read_bytes:"]
+			process.WriteBytes = io["write_bytes:"]
+		}
+		processes = append(processes, process)
+	}
+	return processes, nil
+}
+
+type byProcessUsage []ProcessStats
+
+func (p byProcessUsage) Len() int {
+	return len(p)
+}
+
+func (p byProcessUsage) Swap(i, j int) {
+	p[i], p[j] = p[j], p[i]
+}
+
+// Less puts the busiest first, then the biggest, then by pid.
+func (p byProcessUsage) Less(i, j int) bool {
+	if p[i].CpuPercent != p[j].CpuPercent {
+		return p[i].CpuPercent > p[j].CpuPercent
+	}
+	if p[i].Rss != p[j].Rss {
+		return p[i].Rss > p[j].Rss
+	}
+	return p[i].Pid < p[j].Pid
+}
+
+func containerPid(id string) (int, error) {
+	dclient, err := client.NewEnvClient()
+	if err != nil {
+		return 0, err
+	}
+	dclient.UpdateClientVersion("1.22")
+	inspect, err := dclient.ContainerInspect(context.Background(), id)
+	if err != nil {
+		return 0, err
+	}
+	if inspect.ContainerJSONBase == nil || inspect.State == nil || inspect.State.Pid == 0 {
+		return 0, fmt.Errorf("Container %s isn't running", id)
+	}
+	return inspect.State.Pid, nil
+}
@@ -0,0 +1,96 @@
+package stats
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rancher/host-api/proc"
+)
+
+// testStat is a /proc/<pid>/stat line with the fields that are read set.
+func testStat(pid int, command string, utime, stime, startTime, rss uint64) string {
+	fields := make([]string, 22)
+	for i := range fields {
+		fields[i] = "0"
+	}
+	fields[0] = "S"
+	fields[14-3] = fmt.Sprint(utime)
+	fields[15-3] = fmt.Sprint(stime)
+	fields[22-3] = fmt.Sprint(startTime)
+	fields[24-3] = fmt.Sprint(rss)
+	return fmt.Sprintf("%d (%s) %s\n", pid, command, strings.Join(fields, " "))
+}
+
+func TestProcessTracker(t *testing.T) {
+	root, err := ioutil.TempDir("", "procs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	procDir := filepath.Join(root, "proc")
+	sys := filepath.Join(root, "sys")
+	os.Setenv("HOST_PROC", procDir)
+	defer os.Unsetenv("HOST_PROC")
+	os.Setenv("HOST_SYS", sys)
+	defer os.Unsetenv("HOST_SYS")
+
+	cgroup := "fs/cgroup/system.slice/docker-abc.scope"
+	writeFiles(t, procDir, map[string]string{
+		"uptime":      "100.00 0.00\n",
+		"1000/cgroup": "0::/system.slice/docker-abc.scope\n",
+		"1000/stat":   testStat(1000, "nginx", 500, 500, 0, 100),
+		"1000/io":     "rchar: 10\nread_bytes: 4096\nwrite_bytes: 8192\n",
+		"1001/stat":   testStat(1001, "worker", 2000, 0, 5000, 200),
+		"1002/stat":   testStat(1002, "idle", 0, 0, 5000, 300),
+		"2000/stat":   testStat(2000, "other", 9000, 0, 0, 1),
+	})
+	writeFiles(t, sys, map[string]string{
+		cgroup + "/cgroup.controllers": "cpu memory\n",
+		cgroup + "/cgroup.procs":       "1000\n1001\n1002\n1003\n",
+	})
+
+	tracker := newProcessTracker(&streamOptions{processes: 2})
+	tracker.findPid = func(id string) (int, error) {
+		return 1000, nil
+	}
+
+	processes := tracker.sample("abc")
+	if len(processes) != 2 {
+		t.Fatalf("Expected the top 2 processes, got %+v", processes)
+	}
+	if processes[0].Pid != 1001 || processes[0].CpuPercent != 40 || processes[0].Rss != 200*proc.PageSize {
+		t.Errorf("Wrong busiest process %+v", processes[0])
+	}
+	if processes[1].Pid != 1000 || processes[1].CpuPercent != 10 || processes[1].ReadBytes != 4096 || processes[1].WriteBytes != 8192 {
+		t.Errorf("Wrong second process %+v", processes[1])
+	}
+
+	if tracker.sample(hostStreamId) != nil {
+		t.Error("Expected no processes for the host")
+	}
+	off := newProcessTracker(&streamOptions{})
+	if off.sample("abc") != nil {
+		t.Error("Expected no processes without asking")
+	}
+}
+
+func TestParseProcessesOption(t *testing.T) {
+	for query, expected := range map[string]int{"": 0, "processes=5": 5, "processes=1000": maxTopProcesses} {
+		values, _ := url.ParseQuery(query)
+		opts, err := parseStreamOptions(values)
+		if err != nil || opts.processes != expected {
+			t.Errorf("%s: got %+v, %v", query, opts, err)
+		}
+	}
+	for _, bad := range []string{"processes=-1", "processes=all"} {
+		values, _ := url.ParseQuery(bad)
+		if _, err := parseStreamOptions(values); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+}
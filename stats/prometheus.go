@@ -0,0 +1,108 @@
+package stats
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	metricCounter = "counter"
+	metricGauge   = "gauge"
+)
+
+// metricSet collects samples grouped by metric, to be written in the
+// Prometheus text format.
+type metricSet struct {
+	families map[string]*metricFamily
+	names    []string
+}
+
+type metricFamily struct {
+	name    string
+	kind    string
+	help    string
+	samples []metricSample
+}
+
+type metricSample struct {
+	labels []string
+	value  float64
+}
+
+func newMetricSet() *metricSet {
+	return &metricSet{
+		families: map[string]*metricFamily{},
+	}
+}
+
+// add records a sample. labels are pairs of names and values.
+func (m *metricSet) add(name, kind, help string, value float64, labels ...string) {
+	family, ok := m.families[name]
+	if !ok {
+		family = &metricFamily{
+			name: name,
+			kind: kind,
+			help: help,
+		}
+		m.families[name] = family
+		m.names = append(m.names, name)
+	}
+	family.samples = append(family.samples, metricSample{labels, value})
+}
+
+func (m *metricSet) write(w io.Writer) error {
+	writer := bufio.NewWriter(w)
+	for _, name := range m.names {
+		family := m.families[name]
+		writer.WriteString("# HELP " + name + " " + escapeHelp(family.help) + "\n")
+		writer.WriteString("# TYPE " + name + " " + family.kind + "\n")
+		for _, sample := range family.samples {
+			writer.WriteString(name)
+			if len(sample.labels) > 0 {
+				writer.WriteString("{")
+				for i := 0; i+1 < len(sample.labels); i += 2 {
+					if i > 0 {
+						writer.WriteString(",")
+					}
+					writer.WriteString(sample.labels[i] + `="` + escapeLabelValue(sample.labels[i+1]) + `"`)
+				}
+				writer.WriteString("}")
+			}
+			writer.WriteString(" " + formatMetricValue(sample.value) + "\n")
+		}
+	}
+	return writer.Flush()
+}
+
+func formatMetricValue(value float64) string {
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(value)
+}
+
+// sanitizeLabelName turns a docker label into a valid Prometheus label name.
+func sanitizeLabelName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
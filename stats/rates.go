@@ -0,0 +1,136 @@
+package stats
+
+import (
+	"runtime"
+)
+
+// Rates are computed from two consecutive samples of a stream.
+type Rates struct {
+	// CPU used as a percentage of all of the host's CPUs.
+	CpuPercent float64 `json:"cpu_percent"`
+	// CPU used as a percentage of the container's CPU limit, the same as
+	// CpuPercent if it has none.
+	CpuLimitPercent float64 `json:"cpu_limit_percent"`
+	// Units: bytes per second.
+	RxBytes    float64 `json:"rx_bytes_per_second"`
+	TxBytes    float64 `json:"tx_bytes_per_second"`
+	ReadBytes  float64 `json:"read_bytes_per_second"`
+	WriteBytes float64 `json:"write_bytes_per_second"`
+	// Units: operations per second.
+	ReadIops  float64 `json:"read_iops"`
+	WriteIops float64 `json:"write_iops"`
+}
+
+// rateTracker remembers the previous sample of each stream, to compute rates
+// for the next one.
+type rateTracker struct {
+	enabled bool
+	host    bool
+	prev    map[string]*containerStats
+}
+
+func newRateTracker(opts *streamOptions, resourceType string) *rateTracker {
+	return &rateTracker{
+		enabled: opts.rates,
+		host:    resourceType == "host",
+		prev:    map[string]*containerStats{},
+	}
+}
+
+// info returns the containerInfo for a sample, with its rates if they're
+// turned on and there's a previous sample to compute them from.
+func (r *rateTracker) info(id string, stats *containerStats) containerInfo {
+	info := containerInfo{
+		Id:    id,
+		Stats: []*containerStats{stats},
+	}
+	if !r.enabled {
+		return info
+	}
+	if prev, ok := r.prev[id]; ok {
+		info.Rates = computeRates(prev, stats, r.host)
+	}
+	r.prev[id] = stats
+	return info
+}
+
+func computeRates(prev, cur *containerStats, host bool) *Rates {
+	elapsed := cur.Timestamp.Sub(prev.Timestamp)
+	if elapsed <= 0 {
+		return nil
+	}
+	seconds := elapsed.Seconds()
+	perSecond := func(prev, cur uint64) float64 {
+		return float64(counterDelta(prev, cur)) / seconds
+	}
+
+	// The host's total includes idle time.
+	prevCpu, curCpu := prev.Cpu.Usage.Total, cur.Cpu.Usage.Total
+	if host {
+		prevCpu = prev.Cpu.Usage.User + prev.Cpu.Usage.System
+		curCpu = cur.Cpu.Usage.User + cur.Cpu.Usage.System
+	}
+	cpus := len(cur.Cpu.Usage.PerCpu)
+	if cpus == 0 {
+		cpus = runtime.NumCPU()
+	}
+	cpuUsed := float64(counterDelta(prevCpu, curCpu)) / float64(elapsed)
+
+	rates := &Rates{
+		CpuPercent: cpuUsed / float64(cpus) * 100,
+	}
+	rates.CpuLimitPercent = rates.CpuPercent
+	if cur.Cpu.Limit > 0 {
+		rates.CpuLimitPercent = cpuUsed / (float64(cur.Cpu.Limit) / 1000) * 100
+	}
+
+	prevRx, prevTx := networkTotals(prev)
+	curRx, curTx := networkTotals(cur)
+	rates.RxBytes = perSecond(prevRx, curRx)
+	rates.TxBytes = perSecond(prevTx, curTx)
+
+	rates.ReadBytes = perSecond(diskTotal(prev.DiskIo.IoServiceBytes, "Read"), diskTotal(cur.DiskIo.IoServiceBytes, "Read"))
+	rates.WriteBytes = perSecond(diskTotal(prev.DiskIo.IoServiceBytes, "Write"), diskTotal(cur.DiskIo.IoServiceBytes, "Write"))
+	rates.ReadIops = perSecond(diskTotal(prev.DiskIo.IoServiced, "Read"), diskTotal(cur.DiskIo.IoServiced, "Read"))
+	rates.WriteIops = perSecond(diskTotal(prev.DiskIo.IoServiced, "Write"), diskTotal(cur.DiskIo.IoServiced, "Write"))
+
+	return rates
+}
+
+// counterDelta is how much a counter went up. Counters start again from zero
+// when a container restarts, in which case it's all of the current value.
+func counterDelta(prev, cur uint64) uint64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}
+
+func networkTotals(stats *containerStats) (uint64, uint64) {
+	if len(stats.Network.Interfaces) == 0 {
+		return stats.Network.RxBytes, stats.Network.TxBytes
+	}
+	var rx, tx uint64
+	for _, iface := range stats.Network.Interfaces {
+		rx += iface.RxBytes
+		tx += iface.TxBytes
+	}
+	return rx, tx
+}
+
+func diskTotal(devices []PerDiskStats, op string) uint64 {
+	var total uint64
+	for _, device := range devices {
+		total += device.Stats[op]
+	}
+	return total
+}
+
+// cpuLimit is the CPU limit set with a CFS quota, in millicores, or 0 if
+// there isn't one.
+func cpuLimit(quota, period int64) uint64 {
+	if quota <= 0 || period <= 0 {
+		return 0
+	}
+	return uint64(quota * 1000 / period)
+}
@@ -0,0 +1,62 @@
+package stats
+
+import (
+	"testing"
+	"time"
+)
+
+func rateSample(at time.Time, cpu, rx, read, reads uint64) *containerStats {
+	stats := &containerStats{Timestamp: at}
+	stats.Cpu.Usage.Total = cpu
+	stats.Cpu.Usage.PerCpu = []uint64{0, 0, 0, 0}
+	stats.Network.Interfaces = []InterfaceStats{{Name: "eth0", RxBytes: rx}}
+	stats.DiskIo.IoServiceBytes = []PerDiskStats{{Stats: map[string]uint64{"Read": read}}}
+	stats.DiskIo.IoServiced = []PerDiskStats{{Stats: map[string]uint64{"Read": reads}}}
+	return stats
+}
+
+func TestComputeRates(t *testing.T) {
+	start := time.Now()
+	prev := rateSample(start, 0, 1000, 0, 0)
+	cur := rateSample(start.Add(2*time.Second), uint64(2*time.Second), 3000, 4096, 10)
+	cur.Cpu.Limit = 500
+
+	rates := computeRates(prev, cur, false)
+	if rates.CpuPercent != 25 {
+		t.Errorf("Expected 25%% of the host, got %v", rates.CpuPercent)
+	}
+	if rates.CpuLimitPercent != 200 {
+		t.Errorf("Expected 200%% of the limit, got %v", rates.CpuLimitPercent)
+	}
+	if rates.RxBytes != 1000 || rates.ReadBytes != 2048 || rates.ReadIops != 5 {
+		t.Errorf("Wrong rates %+v", rates)
+	}
+
+	// The container restarted, so its counters did too.
+	restarted := rateSample(start.Add(4*time.Second), uint64(time.Second), 500, 0, 0)
+	rates = computeRates(cur, restarted, false)
+	if rates.RxBytes != 250 || rates.CpuPercent != 12.5 {
+		t.Errorf("Wrong rates after reset %+v", rates)
+	}
+
+	if computeRates(cur, cur, false) != nil {
+		t.Error("Expected no rates without time passing")
+	}
+}
+
+func TestRateTracker(t *testing.T) {
+	tracker := newRateTracker(&streamOptions{rates: true}, "container")
+	start := time.Now()
+	if info := tracker.info("c1", rateSample(start, 0, 0, 0, 0)); info.Rates != nil {
+		t.Error("Expected no rates for the first sample")
+	}
+	if info := tracker.info("c1", rateSample(start.Add(time.Second), 0, 100, 0, 0)); info.Rates == nil || info.Rates.RxBytes != 100 {
+		t.Errorf("Wrong rates for the second sample %+v", info.Rates)
+	}
+
+	tracker = newRateTracker(&streamOptions{}, "container")
+	tracker.info("c1", rateSample(start, 0, 0, 0, 0))
+	if info := tracker.info("c1", rateSample(start.Add(time.Second), 0, 100, 0, 0)); info.Rates != nil {
+		t.Error("Expected no rates unless asked for")
+	}
+}
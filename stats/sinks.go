@@ -0,0 +1,241 @@
+package stats
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/rancher/host-api/config"
+)
+
+const (
+	sinkStatsd    = "statsd"
+	sinkDogStatsd = "dogstatsd"
+	sinkInfluxDB  = "influxdb"
+
+	// Datagrams are kept under the usual Ethernet MTU so they aren't
+	// fragmented, the same as the StatsD clients.
+	maxDatagramSize = 1432
+	// Most lines sent to InfluxDB in one request.
+	maxInfluxBatch = 5000
+
+	// After a failed export the next one waits twice as long, up to this.
+	maxSinkBackoff = 5 * time.Minute
+)
+
+// metricSink exports the same metrics that are served for Prometheus.
+type metricSink interface {
+	send(metrics *metricSet, now time.Time) error
+}
+
+// StartSink exports host and container metrics to the --stats-sink every
+// --stats-sink-interval. It does nothing if no sink is set.
+func StartSink() error {
+	if config.Config.StatsSink == "" {
+		return nil
+	}
+	sink, err := newMetricSink(config.Config.StatsSink, config.Config.StatsSinkUrl)
+	if err != nil {
+		return err
+	}
+	go exportMetrics(metricsSource, sink, config.Config.StatsSinkInterval)
+	return nil
+}
+
+func newMetricSink(kind, rawurl string) (metricSink, error) {
+	sinkUrl, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case (kind == sinkStatsd || kind == sinkDogStatsd) && sinkUrl.Scheme == "udp":
+		conn, err := net.Dial("udp", sinkUrl.Host)
+		if err != nil {
+			return nil, err
+		}
+		return &datagramSink{conn, statsdLines(kind == sinkDogStatsd)}, nil
+	case kind == sinkInfluxDB && sinkUrl.Scheme == "udp":
+		conn, err := net.Dial("udp", sinkUrl.Host)
+		if err != nil {
+			return nil, err
+		}
+		return &datagramSink{conn, influxLines}, nil
+	case kind == sinkInfluxDB && (sinkUrl.Scheme == "http" || sinkUrl.Scheme == "https"):
+		return &influxHTTPSink{
+			url:    sinkUrl.String(),
+			client: &http.Client{Timeout: 30 * time.Second},
+		}, nil
+	}
+	return nil, fmt.Errorf("Unsupported stats sink %s at %s", kind, rawurl)
+}
+
+// exportMetrics gathers from the same collector as the Prometheus handlers, so
+// the streams it reads stay open between exports.
+func exportMetrics(c *metricsCollector, sink metricSink, interval time.Duration) {
+	wait := interval
+	for {
+		time.Sleep(wait)
+		metrics, err := c.gather()
+		if err == nil {
+			err = sink.send(metrics, time.Now())
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Warn("Couldn't export metrics.")
+		}
+		wait = sinkBackoff(wait, interval, err)
+	}
+}
+
+// sinkBackoff is how long to wait before the next export.
+func sinkBackoff(wait, interval time.Duration, err error) time.Duration {
+	if err == nil {
+		return interval
+	}
+	wait *= 2
+	if wait > maxSinkBackoff {
+		wait = maxSinkBackoff
+	}
+	if wait < interval {
+		wait = interval
+	}
+	return wait
+}
+
+// metricLine formats one sample for a sink. Labels are pairs of names and
+// values.
+type metricLine func(name string, labels []string, value float64, now time.Time) string
+
+// sinkLines formats every sample, skipping values a sink can't take.
+func sinkLines(metrics *metricSet, format metricLine, now time.Time) []string {
+	lines := []string{}
+	for _, name := range metrics.names {
+		for _, sample := range metrics.families[name].samples {
+			if math.IsNaN(sample.value) || math.IsInf(sample.value, 0) {
+				continue
+			}
+			lines = append(lines, format(name, sample.labels, sample.value, now))
+		}
+	}
+	return lines
+}
+
+// statsdLines sends every metric as a gauge, counters included, since they're
+// already totals. DogStatsD gets labels as tags, plain StatsD has them in
+// the name, leaving out the container's Rancher labels.
+func statsdLines(tags bool) metricLine {
+	return func(name string, labels []string, value float64, now time.Time) string {
+		buf := &bytes.Buffer{}
+		buf.WriteString(name)
+		if !tags {
+			for i := 0; i+1 < len(labels); i += 2 {
+				if !strings.HasPrefix(labels[i], "container_label_") && labels[i+1] != "" {
+					buf.WriteString("." + sanitizeLabelName(labels[i+1]))
+				}
+			}
+		}
+		buf.WriteString(":" + formatMetricValue(value) + "|g")
+		if tags && len(labels) > 0 {
+			escape := strings.NewReplacer(",", "_", "|", "_", "\n", "_")
+			buf.WriteString("|#")
+			for i := 0; i+1 < len(labels); i += 2 {
+				if i > 0 {
+					buf.WriteString(",")
+				}
+				buf.WriteString(labels[i] + ":" + escape.Replace(labels[i+1]))
+			}
+		}
+		return buf.String()
+	}
+}
+
+// influxLines writes each sample as a point with a value field. InfluxDB
+// doesn't take empty tag values, so those are left out.
+func influxLines(name string, labels []string, value float64, now time.Time) string {
+	escapeName := strings.NewReplacer(",", `\,`, " ", `\ `)
+	escapeTag := strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+	buf := &bytes.Buffer{}
+	buf.WriteString(escapeName.Replace(name))
+	for i := 0; i+1 < len(labels); i += 2 {
+		if labels[i+1] != "" {
+			buf.WriteString("," + escapeTag.Replace(labels[i]) + "=" + escapeTag.Replace(labels[i+1]))
+		}
+	}
+	buf.WriteString(" value=" + strconv.FormatFloat(value, 'g', -1, 64))
+	buf.WriteString(" " + strconv.FormatInt(now.UnixNano(), 10))
+	return buf.String()
+}
+
+// datagramSink sends lines over UDP, as many to a datagram as fit.
+type datagramSink struct {
+	conn   net.Conn
+	format metricLine
+}
+
+func (s *datagramSink) send(metrics *metricSet, now time.Time) error {
+	for _, packet := range batchLines(sinkLines(metrics, s.format, now), maxDatagramSize) {
+		if _, err := s.conn.Write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batchLines joins lines with newlines into batches of at most size bytes. A
+// line longer than that goes on its own.
+func batchLines(lines []string, size int) [][]byte {
+	batches := [][]byte{}
+	buf := &bytes.Buffer{}
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+1+len(line) > size {
+			batches = append(batches, append([]byte{}, buf.Bytes()...))
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() > 0 {
+		batches = append(batches, buf.Bytes())
+	}
+	return batches
+}
+
+// influxHTTPSink posts lines to InfluxDB's /write endpoint, whose URL has the
+// database and any credentials in its query.
+type influxHTTPSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *influxHTTPSink) send(metrics *metricSet, now time.Time) error {
+	lines := sinkLines(metrics, influxLines, now)
+	for len(lines) > 0 {
+		batch := lines
+		if len(batch) > maxInfluxBatch {
+			batch = batch[:maxInfluxBatch]
+		}
+		lines = lines[len(batch):]
+
+		resp, err := s.client.Post(s.url, "text/plain", strings.NewReader(strings.Join(batch, "\n")))
+		if err != nil {
+			return err
+		}
+		message, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("InfluxDB returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package stats
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSinkMetrics() *metricSet {
+	m := newMetricSet()
+	labels := []string{"id", "abc", "name", "web 1", "image", "", "container_label_io_rancher_stack_name", "front,end"}
+	m.add("container_memory_usage_bytes", metricGauge, "Memory.", 1024, labels...)
+	m.add("container_cpu_usage_seconds_total", metricCounter, "CPU.", 1.5, labels...)
+	m.add("host_load1", metricGauge, "Load.", 0.25)
+	return m
+}
+
+func readDatagrams(t *testing.T, conn net.PacketConn) []string {
+	lines := []string{}
+	buf := make([]byte, 65536)
+	for {
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return lines
+		}
+		if n > maxDatagramSize {
+			t.Errorf("Datagram of %d bytes is too long", n)
+		}
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+}
+
+func TestStatsdSinks(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for kind, expected := range map[string][]string{
+		sinkStatsd: {
+			"container_memory_usage_bytes.abc.web_1:1024|g",
+			"container_cpu_usage_seconds_total.abc.web_1:1.5|g",
+			"host_load1:0.25|g",
+		},
+		sinkDogStatsd: {
+			"container_memory_usage_bytes:1024|g|#id:abc,name:web 1,image:,container_label_io_rancher_stack_name:front_end",
+			"container_cpu_usage_seconds_total:1.5|g|#id:abc,name:web 1,image:,container_label_io_rancher_stack_name:front_end",
+			"host_load1:0.25|g",
+		},
+	} {
+		sink, err := newMetricSink(kind, "udp://"+conn.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.send(testSinkMetrics(), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		lines := readDatagrams(t, conn)
+		if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+			t.Errorf("%s got %q, expected %q", kind, lines, expected)
+		}
+	}
+}
+
+func TestInfluxDBUDPSink(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sink, err := newMetricSink(sinkInfluxDB, "udp://"+conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Enough samples for several datagrams.
+	m := newMetricSet()
+	for i := 0; i < 100; i++ {
+		m.add("container_pids", metricGauge, "Pids.", float64(i), "id", strings.Repeat("a", 64))
+	}
+	if err := sink.send(m, time.Unix(0, 42)); err != nil {
+		t.Fatal(err)
+	}
+	lines := readDatagrams(t, conn)
+	if len(lines) != 100 {
+		t.Fatalf("Got %d lines, expected 100", len(lines))
+	}
+	if expected := "container_pids,id=" + strings.Repeat("a", 64) + " value=99 42"; lines[99] != expected {
+		t.Errorf("Got %q, expected %q", lines[99], expected)
+	}
+}
+
+func TestInfluxDBHTTPSink(t *testing.T) {
+	var body string
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/write" || r.URL.Query().Get("db") != "rancher" {
+			http.NotFound(w, r)
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		body = string(data)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	sink, err := newMetricSink(sinkInfluxDB, server.URL+"/write?db=rancher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.send(testSinkMetrics(), time.Unix(1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	expected := strings.Join([]string{
+		`container_memory_usage_bytes,id=abc,name=web\ 1,container_label_io_rancher_stack_name=front\,end value=1024 1000000000`,
+		`container_cpu_usage_seconds_total,id=abc,name=web\ 1,container_label_io_rancher_stack_name=front\,end value=1.5 1000000000`,
+		`host_load1 value=0.25 1000000000`,
+	}, "\n")
+	if body != expected {
+		t.Errorf("Got %q, expected %q", body, expected)
+	}
+
+	status = http.StatusBadRequest
+	if err := sink.send(testSinkMetrics(), time.Unix(1, 0)); err == nil {
+		t.Error("Expected an error when InfluxDB rejects the points")
+	}
+}
+
+func TestNewMetricSinkChecksUrl(t *testing.T) {
+	for kind, rawurl := range map[string]string{
+		sinkStatsd:   "http://localhost:8125",
+		sinkInfluxDB: "tcp://localhost:8086",
+		"graphite":   "udp://localhost:2003",
+	} {
+		if _, err := newMetricSink(kind, rawurl); err == nil {
+			t.Errorf("Expected an error for %s at %s", kind, rawurl)
+		}
+	}
+}
+
+func TestBatchLines(t *testing.T) {
+	batches := batchLines([]string{"aaaa", "bbbb", "cccccccccccc", "dd"}, 10)
+	expected := []string{"aaaa\nbbbb", "cccccccccccc", "dd"}
+	if len(batches) != len(expected) {
+		t.Fatalf("Got %q, expected %q", batches, expected)
+	}
+	for i := range expected {
+		if string(batches[i]) != expected[i] {
+			t.Errorf("Got %q, expected %q", batches[i], expected[i])
+		}
+	}
+}
+
+func TestSinkBackoff(t *testing.T) {
+	interval := 10 * time.Second
+	failed := errors.New("unreachable")
+	wait := sinkBackoff(interval, interval, failed)
+	if wait != 20*time.Second {
+		t.Errorf("Got %v after a failure", wait)
+	}
+	for i := 0; i < 10; i++ {
+		wait = sinkBackoff(wait, interval, failed)
+	}
+	if wait != maxSinkBackoff {
+		t.Errorf("Got %v, expected the backoff to stop at %v", wait, maxSinkBackoff)
+	}
+	if wait = sinkBackoff(wait, interval, nil); wait != interval {
+		t.Errorf("Got %v after a success", wait)
+	}
+}
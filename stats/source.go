@@ -0,0 +1,99 @@
+package stats
+
+import (
+	"fmt"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/rancher/host-api/config"
+)
+
+const (
+	statsBackendDocker   = "docker"
+	statsBackendCgroup   = "cgroup"
+	statsBackendCadvisor = "cadvisor"
+)
+
+// statsSource is where samples of the host and of containers come from,
+// chosen with --stats-backend. Every source produces the same containerStats,
+// so streams look the same whichever one is used.
+type statsSource interface {
+	openHost() (containerReader, error)
+	openContainer(id string) (containerReader, error)
+}
+
+func newStatsSource(backend string) (statsSource, error) {
+	switch backend {
+	case statsBackendDocker, "":
+		return dockerSource{}, nil
+	case statsBackendCgroup:
+		return cgroupSource{}, nil
+	case statsBackendCadvisor:
+		return newCadvisorSource(config.Config.CAdvisorUrl, config.Config.CAdvisorApi)
+	}
+	return nil, fmt.Errorf("Unknown stats backend %s", backend)
+}
+
+// The source is built the first time a stream is opened, once the config has
+// been parsed, and shared by every stream after that.
+var (
+	sharedSourceOnce sync.Once
+	sharedSource     statsSource
+	sharedSourceErr  error
+)
+
+func openReader(id string) (containerReader, error) {
+	sharedSourceOnce.Do(func() {
+		sharedSource, sharedSourceErr = newStatsSource(config.Config.StatsBackend)
+	})
+	if sharedSourceErr != nil {
+		return nil, sharedSourceErr
+	}
+	if id == hostStreamId {
+		return sharedSource.openHost()
+	}
+	return sharedSource.openContainer(id)
+}
+
+// dockerSource reads the host with gopsutil and containers from the docker
+// stats API.
+type dockerSource struct{}
+
+func (dockerSource) openHost() (containerReader, error) {
+	return newFsReader(newHostReader(), hostStreamId, hostFsInterval, func(string) ([]FsStats, error) {
+		return getFsStats()
+	}), nil
+}
+
+func (dockerSource) openContainer(id string) (containerReader, error) {
+	reader, err := openDockerReader(id)
+	if err != nil {
+		return nil, err
+	}
+	return withFsUsage(reader, id), nil
+}
+
+// cgroupSource reads containers from their cgroup files, falling back to the
+// docker stats API when it can't find them.
+type cgroupSource struct {
+	dockerSource
+}
+
+func (s cgroupSource) openContainer(id string) (containerReader, error) {
+	reader, err := openCgroupReader(id)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "id": id}).Debug("Couldn't read cgroup stats, using the docker API.")
+		return s.dockerSource.openContainer(id)
+	}
+	return withFsUsage(reader, id), nil
+}
+
+// withFsUsage adds the usage of the container's writable layer and mounts
+// every --stats-fs-interval.
+func withFsUsage(reader containerReader, id string) containerReader {
+	if config.Config.StatsFsInterval > 0 {
+		return newFsReader(reader, id, config.Config.StatsFsInterval, getContainerFsStats)
+	}
+	return reader
+}
@@ -1,18 +1,12 @@
 package stats
 
 import (
-	"bufio"
-	"io"
 	"net/url"
-	"time"
 
 	log "github.com/Sirupsen/logrus"
 
-	"github.com/docker/engine-api/client"
-
 	"github.com/rancher/websocket-proxy/backend"
 	"github.com/rancher/websocket-proxy/common"
-	"golang.org/x/net/context"
 )
 
 type StatsHandler struct {
@@ -27,48 +21,23 @@ func (s *StatsHandler) Handle(key string, initialMessage string, incomingMessage
 		return
 	}
 
+	opts, err := parseStreamOptions(requestUrl.Query())
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Invalid stats options.")
+		return
+	}
+
 	id := ""
 	parts := pathParts(requestUrl.Path)
 	if len(parts) == 3 {
 		id = parts[2]
 	}
 
-	dclient, err := client.NewEnvClient()
-	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Couldn't get docker client")
-		return
-	}
-	dclient.UpdateClientVersion("1.22")
-
-	reader, writer := io.Pipe()
-
-	go func(w *io.PipeWriter) {
-		for {
-			_, ok := <-incomingMessages
-			if !ok {
-				w.Close()
-				return
-			}
-		}
-	}(writer)
-
-	go func(r *io.PipeReader) {
-		scanner := bufio.NewScanner(r)
-		for scanner.Scan() {
-			text := scanner.Text()
-			message := common.Message{
-				Key:  key,
-				Type: common.Body,
-				Body: text,
-			}
-			response <- message
-		}
-		if err := scanner.Err(); err != nil {
-			log.WithFields(log.Fields{"error": err}).Error("Error with the container stat scanner.")
-		}
-	}(reader)
-
-	count := 1
+	writer, sent := newMessageWriter(key, incomingMessages, response)
+	defer func() {
+		writer.Close()
+		<-sent
+	}()
 
 	memLimit, err := getMemCapcity()
 	if err != nil {
@@ -76,65 +45,11 @@ func (s *StatsHandler) Handle(key string, initialMessage string, incomingMessage
 		return
 	}
 	if id == "" {
-		for {
-			infos := []containerInfo{}
-
-			cInfo, err := getRootContainerInfo(count)
-			if err != nil {
-				return
-			}
-
-			infos = append(infos, cInfo)
-			for i := range infos {
-				if len(infos[i].Stats) > 0 {
-					infos[i].Stats[0].Timestamp = time.Now()
-				}
-			}
-
-			err = writeAggregatedStats("", nil, "host", infos, uint64(memLimit), writer)
-			if err != nil {
-				return
-			}
-
-			time.Sleep(1 * time.Second)
-			count = 1
-		}
+		streamHostStats("", uint64(memLimit), opts, writer)
 	} else {
-		inspect, err := dclient.ContainerInspect(context.Background(), id)
+		err := streamStats([]string{id}, id, nil, "container", uint64(memLimit), opts, nil, writer)
 		if err != nil {
-			log.WithFields(log.Fields{"error": err}).Error("Can not inspect containers")
-			return
-		}
-		statsReader, err := dclient.ContainerStats(context.Background(), id, true)
-		if err != nil {
-			log.WithFields(log.Fields{"error": err}).Error("Can not get stats reader from docker")
-			return
-		}
-		defer statsReader.Close()
-		pid := inspect.State.Pid
-		bufioReader := bufio.NewReader(statsReader)
-		for {
-			infos := []containerInfo{}
-			cInfo, err := getContainerStats(bufioReader, count, id, pid)
-
-			if err != nil {
-				log.WithFields(log.Fields{"error": err, "id": id}).Error("Error getting container info.")
-				return
-			}
-			infos = append(infos, cInfo)
-			for i := range infos {
-				if len(infos[i].Stats) > 0 {
-					infos[i].Stats[0].Timestamp = time.Now()
-				}
-			}
-
-			err = writeAggregatedStats(id, nil, "container", infos, uint64(memLimit), writer)
-			if err != nil {
-				return
-			}
-
-			time.Sleep(1 * time.Second)
-			count = 1
+			log.WithFields(log.Fields{"error": err, "id": id}).Error("Error getting container info.")
 		}
 	}
 }
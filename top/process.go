@@ -0,0 +1,154 @@
+package top
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rancher/host-api/proc"
+)
+
+// Process is a process in a container, as sent to the client.
+type Process struct {
+	Pid   int    `json:"pid"`
+	Ppid  int    `json:"ppid"`
+	User  string `json:"user"`
+	State string `json:"state"`
+	// CPU used since the last sample, or since the process started for the
+	// first one, as a percentage of one CPU.
+	Cpu float64 `json:"cpu"`
+	// Units: Bytes.
+	Rss     uint64 `json:"rss"`
+	Command string `json:"command"`
+	// How deep the process is in the tree, when a tree is asked for.
+	Depth int `json:"depth,omitempty"`
+}
+
+// procReader lists the processes in the pid namespace of a container's init
+// process from /proc, keeping the CPU time of each one to work out CPU usage
+// between calls.
+type procReader struct {
+	pid   int
+	cpu   *proc.CpuUsage
+	users map[string]string
+}
+
+func newProcReader(pid int) (*procReader, error) {
+	namespace, err := os.Readlink(proc.Path(strconv.Itoa(pid), "ns", "pid"))
+	if err != nil {
+		return nil, err
+	}
+	// A container sharing the host's pid namespace would list every process
+	// on the host.
+	if host, err := os.Readlink(proc.Path("1", "ns", "pid")); err == nil && host == namespace {
+		return nil, fmt.Errorf("Container %d shares the host's pid namespace", pid)
+	}
+	return &procReader{
+		pid: pid,
+		cpu: proc.NewCpuUsage(),
+	}, nil
+}
+
+func (r *procReader) list() ([]*Process, error) {
+	namespace, err := os.Readlink(proc.Path(strconv.Itoa(r.pid), "ns", "pid"))
+	if err != nil {
+		return nil, fmt.Errorf("Container process %d is gone", r.pid)
+	}
+	if r.users == nil {
+		r.users = readPasswd(proc.Path(strconv.Itoa(r.pid), "root", "etc", "passwd"))
+	}
+	entries, err := ioutil.ReadDir(proc.Path())
+	if err != nil {
+		return nil, err
+	}
+	if err := r.cpu.Next(time.Now()); err != nil {
+		return nil, err
+	}
+
+	processes := []*Process{}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if ns, err := os.Readlink(proc.Path(entry.Name(), "ns", "pid")); err != nil || ns != namespace {
+			continue
+		}
+		// Processes can exit while we're reading them.
+		stat, err := proc.ReadStat(pid)
+		if err != nil {
+			continue
+		}
+		process := readProcess(pid, stat, r.users)
+		process.Cpu = r.cpu.Percent(pid, stat)
+		processes = append(processes, process)
+	}
+	return processes, nil
+}
+
+// readProcess adds the user from /proc/<pid>/status and the command line from
+// cmdline to what's in a process's stat.
+func readProcess(pid int, stat *proc.Stat, users map[string]string) *Process {
+	dir := strconv.Itoa(pid)
+	process := &Process{
+		Pid:   pid,
+		Ppid:  stat.Ppid,
+		State: stat.State,
+		Rss:   stat.Rss,
+	}
+
+	if status, err := ioutil.ReadFile(proc.Path(dir, "status")); err == nil {
+		uid := statusUid(status)
+		process.User = uid
+		if name, ok := users[uid]; ok {
+			process.User = name
+		}
+	}
+
+	// Kernel threads and zombies have no command line, only a name.
+	cmdline, _ := ioutil.ReadFile(proc.Path(dir, "cmdline"))
+	if command := strings.TrimSpace(string(bytes.Replace(cmdline, []byte{0}, []byte{' '}, -1))); command != "" {
+		process.Command = command
+	} else {
+		process.Command = "[" + stat.Command + "]"
+	}
+	return process
+}
+
+func statusUid(status []byte) string {
+	for _, line := range strings.Split(string(status), "\n") {
+		if strings.HasPrefix(line, "Uid:") {
+			fields := strings.Fields(line)
+			if len(fields) > 1 {
+				return fields[1]
+			}
+		}
+	}
+	return ""
+}
+
+// readPasswd maps uids to user names from the container's /etc/passwd.
+func readPasswd(path string) map[string]string {
+	users := map[string]string{}
+	file, err := os.Open(path)
+	if err != nil {
+		return users
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) > 2 {
+			if _, ok := users[fields[2]]; !ok {
+				users[fields[2]] = fields[0]
+			}
+		}
+	}
+	return users
+}
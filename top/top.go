@@ -0,0 +1,297 @@
+package top
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	dockerClient "github.com/fsouza/go-dockerclient"
+
+	"github.com/rancher/websocket-proxy/backend"
+	"github.com/rancher/websocket-proxy/common"
+
+	"github.com/rancher/host-api/auth"
+	"github.com/rancher/host-api/events"
+)
+
+const (
+	defaultInterval = 2 * time.Second
+	minInterval     = time.Second
+
+	sortCpu     = "cpu"
+	sortMemory  = "memory"
+	sortPid     = "pid"
+	sortUser    = "user"
+	sortCommand = "command"
+
+	// Columns asked of ps when going through the docker top API.
+	dockerPsArgs = "-o pid,ppid,user,stat,pcpu,rss,args"
+)
+
+// topMessage is sent every interval with the container's processes.
+type topMessage struct {
+	Timestamp time.Time  `json:"timestamp"`
+	Processes []*Process `json:"processes"`
+}
+
+// topOptions come from the top claim, or the sort, tree and interval URL
+// parameters.
+type topOptions struct {
+	sort     string
+	tree     bool
+	interval time.Duration
+}
+
+// lister lists a container's processes, from /proc or the docker API.
+type lister func() ([]*Process, error)
+
+type Handler struct {
+}
+
+func (h *Handler) Handle(key string, initialMessage string, incomingMessages <-chan string, response chan<- common.Message) {
+	defer backend.SignalHandlerClosed(key, response)
+
+	requestUrl, err := url.Parse(initialMessage)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "url": initialMessage}).Error("Couldn't parse url.")
+		return
+	}
+	tokenString := requestUrl.Query().Get("token")
+	token, valid := auth.GetAndCheckToken(tokenString)
+	if !valid {
+		return
+	}
+
+	top, _ := token.Claims["top"].(map[string]interface{})
+	container, _ := top["Container"].(string)
+	if container == "" {
+		log.Error("No container to list processes for.")
+		return
+	}
+	opts, err := getTopOptions(top, requestUrl.Query())
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Invalid top options.")
+		return
+	}
+
+	client, err := events.NewDockerClient()
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Couldn't get docker client.")
+		return
+	}
+	list, err := newLister(client, container)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "container": container}).Error("Couldn't list container processes.")
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			if _, ok := <-incomingMessages; !ok {
+				close(done)
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(opts.interval)
+	defer ticker.Stop()
+	for {
+		processes, err := list()
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "container": container}).Info("Stopped listing container processes.")
+			return
+		}
+		sortProcesses(processes, opts.sort)
+		if opts.tree {
+			processes = processTree(processes)
+		}
+
+		data, err := json.Marshal(topMessage{time.Now(), processes})
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("Error encoding processes.")
+			return
+		}
+		response <- common.Message{
+			Key:  key,
+			Type: common.Body,
+			Body: string(data),
+		}
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+func getTopOptions(top map[string]interface{}, query url.Values) (*topOptions, error) {
+	opts := &topOptions{
+		sort:     sortCpu,
+		interval: defaultInterval,
+	}
+
+	if val, ok := top["Sort"].(string); ok && val != "" {
+		opts.sort = val
+	}
+	if val := query.Get("sort"); val != "" {
+		opts.sort = val
+	}
+	switch opts.sort {
+	case sortCpu, sortMemory, sortPid, sortUser, sortCommand:
+	default:
+		return nil, fmt.Errorf("Invalid sort %s", opts.sort)
+	}
+
+	opts.tree, _ = top["Tree"].(bool)
+	if val := query.Get("tree"); val != "" {
+		opts.tree = val == "true" || val == "1"
+	}
+
+	if val, ok := top["Interval"].(float64); ok && val > 0 {
+		opts.interval = time.Duration(val * float64(time.Second))
+	}
+	if val := query.Get("interval"); val != "" {
+		seconds, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid interval %s", val)
+		}
+		opts.interval = time.Duration(seconds * float64(time.Second))
+	}
+	if opts.interval < minInterval {
+		opts.interval = minInterval
+	}
+	return opts, nil
+}
+
+// newLister reads /proc when it can see the container's processes, and goes
+// through the docker top API otherwise.
+func newLister(client *dockerClient.Client, id string) (lister, error) {
+	container, err := client.InspectContainer(id)
+	if err != nil {
+		return nil, err
+	}
+	if !container.State.Running {
+		return nil, fmt.Errorf("Container %s isn't running", id)
+	}
+
+	reader, err := newProcReader(container.State.Pid)
+	if err == nil {
+		return reader.list, nil
+	}
+	log.WithFields(log.Fields{"error": err, "container": id}).Debug("Couldn't read container processes from /proc, using the docker API.")
+	return func() ([]*Process, error) {
+		result, err := client.TopContainer(id, dockerPsArgs)
+		if err != nil {
+			return nil, err
+		}
+		return parseTopResult(result), nil
+	}, nil
+}
+
+// parseTopResult converts the output of ps run with dockerPsArgs. Only the
+// command can contain spaces, and it comes last.
+func parseTopResult(result dockerClient.TopResult) []*Process {
+	processes := []*Process{}
+	for _, row := range result.Processes {
+		if len(row) < 7 {
+			continue
+		}
+		process := &Process{
+			User:    row[2],
+			State:   row[3],
+			Command: strings.Join(row[6:], " "),
+		}
+		process.Pid, _ = strconv.Atoi(row[0])
+		process.Ppid, _ = strconv.Atoi(row[1])
+		process.Cpu, _ = strconv.ParseFloat(row[4], 64)
+		rss, _ := strconv.ParseUint(row[5], 10, 64)
+		process.Rss = rss * 1024
+		processes = append(processes, process)
+	}
+	return processes
+}
+
+type processSorter struct {
+	processes []*Process
+	less      func(a, b *Process) bool
+}
+
+func (s processSorter) Len() int {
+	return len(s.processes)
+}
+
+func (s processSorter) Swap(i, j int) {
+	s.processes[i], s.processes[j] = s.processes[j], s.processes[i]
+}
+
+func (s processSorter) Less(i, j int) bool {
+	return s.less(s.processes[i], s.processes[j])
+}
+
+// sortProcesses sorts by the given column, busiest first for CPU and memory,
+// and by pid for ties.
+func sortProcesses(processes []*Process, by string) {
+	var less func(a, b *Process) bool
+	switch by {
+	case sortCpu:
+		less = func(a, b *Process) bool { return a.Cpu > b.Cpu }
+	case sortMemory:
+		less = func(a, b *Process) bool { return a.Rss > b.Rss }
+	case sortUser:
+		less = func(a, b *Process) bool { return a.User < b.User }
+	case sortCommand:
+		less = func(a, b *Process) bool { return a.Command < b.Command }
+	default:
+		less = func(a, b *Process) bool { return false }
+	}
+	sort.Sort(processSorter{processes, func(a, b *Process) bool {
+		if less(a, b) {
+			return true
+		}
+		if less(b, a) {
+			return false
+		}
+		return a.Pid < b.Pid
+	}})
+}
+
+// processTree orders already sorted processes so that each one is followed
+// by its children, setting how deep each one is. Processes whose parent isn't
+// in the container are at the top.
+func processTree(processes []*Process) []*Process {
+	pids := map[int]bool{}
+	for _, process := range processes {
+		pids[process.Pid] = true
+	}
+	children := map[int][]*Process{}
+	roots := []*Process{}
+	for _, process := range processes {
+		if process.Ppid != process.Pid && pids[process.Ppid] {
+			children[process.Ppid] = append(children[process.Ppid], process)
+		} else {
+			roots = append(roots, process)
+		}
+	}
+
+	tree := []*Process{}
+	var walk func(process *Process, depth int)
+	walk = func(process *Process, depth int) {
+		process.Depth = depth
+		tree = append(tree, process)
+		for _, child := range children[process.Pid] {
+			walk(child, depth+1)
+		}
+	}
+	for _, root := range roots {
+		walk(root, 0)
+	}
+	return tree
+}
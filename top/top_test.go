@@ -0,0 +1,102 @@
+package top
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	dockerClient "github.com/fsouza/go-dockerclient"
+)
+
+func TestProcReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("HOST_PROC", dir)
+	defer os.Unsetenv("HOST_PROC")
+
+	write := func(path, content string) {
+		path = filepath.Join(dir, path)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, []byte(content), 0644)
+	}
+	link := func(path, target string) {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(path)), 0755)
+		os.Symlink(target, filepath.Join(dir, path))
+	}
+	write("uptime", "100.00 50.00\n")
+	link("1/ns/pid", "pid:[1]")
+	for _, pid := range []string{"10", "11"} {
+		link(pid+"/ns/pid", "pid:[2]")
+		write(pid+"/status", "Name:\tapp\nUid:\t33\t33\t33\t33\n")
+	}
+	write("10/stat", "10 (init) S 9 10 10 0 -1 0 0 0 0 0 100 0 0 0 20 0 1 0 0 100 1\n")
+	write("10/cmdline", "/sbin/init\x00--foo\x00")
+	write("11/stat", "11 (worker) R 10 10 10 0 -1 0 0 0 0 0 1000 0 0 0 20 0 1 0 0 100 2\n")
+	write("10/root/etc/passwd", "root:x:0:0::/root:/bin/sh\nwww-data:x:33:33::/var/www:/bin/sh\n")
+
+	reader, err := newProcReader(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	processes, err := reader.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(processes) != 2 {
+		t.Fatalf("Expected 2 processes, got %d", len(processes))
+	}
+	sortProcesses(processes, sortCpu)
+	worker, init := processes[0], processes[1]
+	if worker.Pid != 11 || worker.Cpu != 10 || worker.Command != "[worker]" || worker.User != "www-data" {
+		t.Errorf("Wrong worker %+v", worker)
+	}
+	if init.Pid != 10 || init.Cpu != 1 || init.Command != "/sbin/init --foo" || init.User != "www-data" {
+		t.Errorf("Wrong init %+v", init)
+	}
+
+	tree := processTree(processes)
+	if tree[0] != init || tree[1] != worker || worker.Depth != 1 {
+		t.Errorf("Wrong tree %+v %+v", tree[0], tree[1])
+	}
+
+	// Sharing the host's pid namespace would list every process on it.
+	link("12/ns/pid", "pid:[1]")
+	if _, err := newProcReader(12); err == nil {
+		t.Error("Expected an error for the host's pid namespace")
+	}
+}
+
+func TestParseTopResult(t *testing.T) {
+	processes := parseTopResult(dockerClient.TopResult{
+		Titles:    []string{"PID", "PPID", "USER", "STAT", "%CPU", "RSS", "COMMAND"},
+		Processes: [][]string{{"5", "1", "root", "Ss", "1.5", "2048", "nginx: master process"}},
+	})
+	if len(processes) != 1 {
+		t.Fatalf("Expected 1 process, got %d", len(processes))
+	}
+	process := processes[0]
+	if process.Pid != 5 || process.Ppid != 1 || process.Cpu != 1.5 || process.Rss != 2048*1024 || process.Command != "nginx: master process" {
+		t.Errorf("Wrong process %+v", process)
+	}
+}
+
+func TestGetTopOptions(t *testing.T) {
+	query, _ := url.ParseQuery("sort=memory&tree=true&interval=0.1")
+	opts, err := getTopOptions(map[string]interface{}{"Sort": "pid"}, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.sort != sortMemory || !opts.tree || opts.interval != minInterval {
+		t.Errorf("Wrong options %+v", opts)
+	}
+
+	query, _ = url.ParseQuery("sort=size")
+	if _, err := getTopOptions(nil, query); err == nil {
+		t.Error("Expected an error for an unknown sort")
+	}
+}